@@ -0,0 +1,188 @@
+package gedis
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Interface for types that know how to encode themselves as a
+// command argument
+type Argument interface {
+	RedisArg() ([]byte, error)
+}
+
+// Appends arg to buf, encoded as a bulk string
+//
+// The following types are supported, in order of precedence:
+//
+//   - Argument
+//   - string and []byte, as is
+//   - all integer and float types, in decimal notation; infinite
+//     floats are encoded as +inf and -inf
+//   - bool, as 1 or 0
+//   - time.Duration, as whole seconds, which is what commands like
+//     EXPIRE or SET EX take; durations with a fraction of a second
+//     return an error instead of being truncated, so pass
+//     milliseconds to PEXPIRE or SET PX for those, i.e.
+//     d.Milliseconds()
+//   - time.Time, as Unix seconds
+//   - nil, as an empty string
+//   - encoding.BinaryMarshaler
+//   - fmt.Stringer
+//   - any type whose underlying type is one of the above, i.e.
+//     type ID int64
+//
+// Any other type returns an error.
+func AppendArg(buf []byte, arg interface{}) ([]byte, error) {
+	var bs []byte
+
+	switch arg := arg.(type) {
+	case Argument:
+		var err error
+		if bs, err = arg.RedisArg(); err != nil {
+			return buf, err
+		}
+	case string:
+		return appendBulkString(buf, arg), nil
+	case []byte:
+		bs = arg
+	case int:
+		bs = strconv.AppendInt(nil, int64(arg), 10)
+	case int8:
+		bs = strconv.AppendInt(nil, int64(arg), 10)
+	case int16:
+		bs = strconv.AppendInt(nil, int64(arg), 10)
+	case int32:
+		bs = strconv.AppendInt(nil, int64(arg), 10)
+	case int64:
+		bs = strconv.AppendInt(nil, arg, 10)
+	case uint:
+		bs = strconv.AppendUint(nil, uint64(arg), 10)
+	case uint8:
+		bs = strconv.AppendUint(nil, uint64(arg), 10)
+	case uint16:
+		bs = strconv.AppendUint(nil, uint64(arg), 10)
+	case uint32:
+		bs = strconv.AppendUint(nil, uint64(arg), 10)
+	case uint64:
+		bs = strconv.AppendUint(nil, arg, 10)
+	case float32:
+		bs = appendFloat(nil, float64(arg), 32)
+	case float64:
+		bs = appendFloat(nil, arg, 64)
+	case bool:
+		if arg {
+			bs = []byte{'1'}
+		} else {
+			bs = []byte{'0'}
+		}
+	case time.Duration:
+		if arg%time.Second != 0 {
+			return buf, fmt.Errorf("gedis: duration %v is not a whole number of seconds", arg)
+		}
+		bs = strconv.AppendInt(nil, int64(arg/time.Second), 10)
+	case time.Time:
+		bs = strconv.AppendInt(nil, arg.Unix(), 10)
+	case nil:
+		bs = []byte{}
+	case encoding.BinaryMarshaler:
+		var err error
+		if bs, err = arg.MarshalBinary(); err != nil {
+			return buf, err
+		}
+	case fmt.Stringer:
+		return appendBulkString(buf, arg.String()), nil
+	default:
+		return appendKind(buf, arg)
+	}
+
+	return appendBulk(buf, bs), nil
+}
+
+// Encodes named types by their underlying kind
+func appendKind(buf []byte, arg interface{}) ([]byte, error) {
+	v := reflect.ValueOf(arg)
+
+	switch v.Kind() {
+	case reflect.String:
+		return AppendArg(buf, v.String())
+	case reflect.Bool:
+		return AppendArg(buf, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return AppendArg(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return AppendArg(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return AppendArg(buf, v.Float())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return AppendArg(buf, v.Bytes())
+		}
+	}
+
+	return buf, fmt.Errorf("gedis: unsupported argument type %T", arg)
+}
+
+func appendFloat(buf []byte, f float64, bits int) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(buf, "+inf"...)
+	case math.IsInf(f, -1):
+		return append(buf, "-inf"...)
+	}
+	return strconv.AppendFloat(buf, f, 'f', -1, bits)
+}
+
+func appendBulk(buf []byte, bs []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(bs)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, bs...)
+	return append(buf, '\r', '\n')
+}
+
+func appendBulkString(buf []byte, s string) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// Encodes a command as a multi-bulk of bulk strings, which is the
+// only request format a Redis server understands
+//
+// See AppendArg for the supported argument types.
+func EncodeCommand(args ...interface{}) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Must write at least one argument")
+	}
+
+	buf := make([]byte, 0, 16*len(args))
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	var err error
+
+	for _, arg := range args {
+		if buf, err = AppendArg(buf, arg); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// Writes a command to w, encoded with EncodeCommand
+func WriteCommand(w Writer, args ...interface{}) (n int, err error) {
+	bs, err := EncodeCommand(args...)
+	if err != nil {
+		return -1, err
+	}
+	return w.Write(bs)
+}
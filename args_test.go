@@ -0,0 +1,106 @@
+package gedis
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+type point struct{ x, y int }
+
+func (p point) RedisArg() ([]byte, error) {
+	return []byte("1,2"), nil
+}
+
+type id int64
+
+type name struct{}
+
+func (n name) String() string {
+	return "inkel"
+}
+
+func TestAppendArg(t *testing.T) {
+	tests := []struct {
+		arg      interface{}
+		expected string
+	}{
+		{"lorem", "$5\r\nlorem\r\n"},
+		{[]byte("ipsum"), "$5\r\nipsum\r\n"},
+		{1234, "$4\r\n1234\r\n"},
+		{int8(-12), "$3\r\n-12\r\n"},
+		{uint64(42), "$2\r\n42\r\n"},
+		{3.5, "$3\r\n3.5\r\n"},
+		{float32(0.25), "$4\r\n0.25\r\n"},
+		{math.Inf(-1), "$4\r\n-inf\r\n"},
+		{true, "$1\r\n1\r\n"},
+		{false, "$1\r\n0\r\n"},
+		{90 * time.Second, "$2\r\n90\r\n"},
+		{time.Unix(1370080800, 0), "$10\r\n1370080800\r\n"},
+		{nil, "$0\r\n\r\n"},
+		{point{1, 2}, "$3\r\n1,2\r\n"},
+		{name{}, "$5\r\ninkel\r\n"},
+		{id(7), "$1\r\n7\r\n"},
+	}
+
+	for _, test := range tests {
+		bs, err := AppendArg(nil, test.arg)
+		if err != nil {
+			t.Errorf("AppendArg(%#v): unexpected error: %v", test.arg, err)
+			continue
+		}
+		if string(bs) != test.expected {
+			t.Errorf("AppendArg(%#v)\nexpected %q\nreturned %q", test.arg, test.expected, bs)
+		}
+	}
+
+	if _, err := AppendArg(nil, errors.New("unknown")); err == nil {
+		t.Errorf("expected error for unsupported type")
+	}
+
+	if _, err := AppendArg(nil, []int{1, 2}); err == nil {
+		t.Errorf("expected error for unsupported type")
+	}
+
+	if _, err := AppendArg(nil, 500*time.Millisecond); err == nil {
+		t.Errorf("expected error for a duration that isn't whole seconds")
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	expected := "*4\r\n$3\r\nSET\r\n$5\r\nlorem\r\n$2\r\n12\r\n$1\r\n1\r\n"
+
+	bs, err := EncodeCommand("SET", "lorem", 12, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(bs) != expected {
+		t.Errorf("\nexpected %q\nreturned %q", expected, bs)
+	}
+
+	if _, err = EncodeCommand(); err == nil {
+		t.Errorf("expected error without arguments")
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	var writer bytes.Buffer
+
+	_, err := WriteCommand(&writer, "SET", "lorem", struct{}{})
+	if err == nil {
+		t.Errorf("expected error for unsupported type")
+	}
+
+	if writer.Len() != 0 {
+		t.Errorf("nothing should be written on error, got %q", writer.String())
+	}
+}
+
+func BenchmarkEncodeCommand(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		EncodeCommand("SET", "lorem", 12345)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis cache - Cache-aside on top of Redis
+
+This package caches values in Redis, loading them on a miss. Values
+are encoded with a pluggable Codec, expire after a TTL with some
+jitter so keys set together don't expire together, and misses of the
+underlying data can be cached too.
+
+Concurrent misses for the same key in a process trigger a single
+call to the loader, and the other callers share its result.
+
+Example
+
+    package main
+
+    import (
+    	"fmt"
+    	"github.com/inkel/gedis/cache"
+    	"github.com/inkel/gedis/client"
+    	"time"
+    )
+
+    type User struct {
+    	ID   int
+    	Name string
+    }
+
+    func main() {
+    	c, err := client.DialMux("tcp", "localhost:6379")
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer c.Close()
+
+    	users := cache.New(c)
+
+    	var u User
+
+    	err = users.Once("user:1", &u, time.Hour, func() (interface{}, error) {
+    		// Load the user from the database
+    		return User{1, "inkel"}, nil
+    	})
+    	if err != nil {
+    		panic(err)
+    	}
+
+    	fmt.Println(u.Name)
+    }
+*/
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis/client"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Returned by Get when the key isn't cached
+var ErrCacheMiss = errors.New("cache: miss")
+
+// Returned by loaders when the value doesn't exist, and by Get and
+// Once when that was cached
+var ErrNotFound = errors.New("cache: not found")
+
+// Stored instead of a value to cache that it wasn't found
+const notFound = "\x00gedis:cache:notfound"
+
+// A loader call in progress or done
+type call struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// A cache of values stored in Redis
+//
+// It is safe for concurrent use if its Sender is, i.e. a
+// client.MuxClient.
+type Cache struct {
+	s client.Sender
+
+	// Encodes the cached values, defaults to JSON
+	Codec Codec
+	// Prepended to every key, defaults to "cache:"
+	Prefix string
+	// Fraction of the TTL randomly added to or subtracted from it,
+	// defaults to 0.1
+	Jitter float64
+	// How long to cache that a loader returned ErrNotFound; zero,
+	// the default, doesn't cache it
+	NegativeTTL time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Create a new Cache
+func New(s client.Sender) *Cache {
+	return &Cache{
+		s:      s,
+		Codec:  JSON,
+		Prefix: "cache:",
+		Jitter: 0.1,
+		calls:  make(map[string]*call),
+	}
+}
+
+// Read a cached value into v
+//
+// Returns ErrCacheMiss if the key isn't cached, or ErrNotFound if it
+// was cached that the value doesn't exist.
+func (c *Cache) Get(key string, v interface{}) error {
+	data, err := c.get(key)
+	if err != nil {
+		return err
+	}
+	return c.decode(data, v)
+}
+
+func (c *Cache) get(key string) ([]byte, error) {
+	res, err := c.s.Send("GET", c.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := res.(string)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	return []byte(s), nil
+}
+
+func (c *Cache) decode(data []byte, v interface{}) error {
+	if string(data) == notFound {
+		return ErrNotFound
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+// Cache a value for about ttl
+func (c *Cache) Set(key string, v interface{}, ttl time.Duration) error {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.set(key, data, ttl)
+}
+
+func (c *Cache) set(key string, data []byte, ttl time.Duration) error {
+	_, err := c.s.Send("SET", c.Prefix+key, data, "PX", c.jitter(ttl).Milliseconds())
+	return err
+}
+
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.Jitter > 0 {
+		ttl += time.Duration((rand.Float64()*2 - 1) * c.Jitter * float64(ttl))
+	}
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	return ttl
+}
+
+// Remove a value from the cache
+func (c *Cache) Delete(key string) error {
+	_, err := c.s.Send("DEL", c.Prefix+key)
+	return err
+}
+
+// Read a cached value into v, calling load and caching what it returns
+// for about ttl on a miss
+//
+// Concurrent calls for the same key wait for a single call to load.
+// If load returns ErrNotFound, or an error wrapping it, that is cached
+// for NegativeTTL. Errors talking to Redis are treated as misses, and
+// errors caching the loaded value are ignored, so the cache being down
+// doesn't stop values from being loaded. A panic in load is returned
+// as an error to every caller waiting for it.
+func (c *Cache) Once(key string, v interface{}, ttl time.Duration, load func() (interface{}, error)) error {
+	if data, err := c.get(key); err == nil {
+		return c.decode(data, v)
+	}
+
+	c.mu.Lock()
+	cl, ok := c.calls[key]
+	if !ok {
+		cl = &call{}
+		cl.wg.Add(1)
+		c.calls[key] = cl
+	}
+	c.mu.Unlock()
+
+	if ok {
+		cl.wg.Wait()
+	} else {
+		c.do(key, cl, ttl, load)
+	}
+
+	if cl.err != nil {
+		return cl.err
+	}
+
+	return c.Codec.Unmarshal(cl.data, v)
+}
+
+// Load the value of cl, waking up whoever is waiting for it
+//
+// A panic in load is returned as an error, otherwise the call would
+// never be removed and the next callers would wait for it forever.
+func (c *Cache) do(key string, cl *call, ttl time.Duration, load func() (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			cl.data, cl.err = nil, fmt.Errorf("cache: load panicked: %v", r)
+		}
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+
+		cl.wg.Done()
+	}()
+
+	cl.data, cl.err = c.load(key, ttl, load)
+}
+
+func (c *Cache) load(key string, ttl time.Duration, load func() (interface{}, error)) ([]byte, error) {
+	v, err := load()
+
+	if errors.Is(err, ErrNotFound) {
+		if c.NegativeTTL > 0 {
+			c.set(key, []byte(notFound), c.NegativeTTL)
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(key, data, ttl)
+
+	return data, nil
+}
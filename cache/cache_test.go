@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis/client"
+	"github.com/inkel/gedis/internal/redistest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCache(t *testing.T) (*redistest.Server, *Cache) {
+	s := redistest.NewServer(t)
+	s.SetTime(time.Unix(1700000000, 0))
+
+	m, err := client.DialMux("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	return s, New(m)
+}
+
+type user struct {
+	ID   int
+	Name string
+}
+
+func TestCache(t *testing.T) {
+	s, c := newCache(t)
+
+	var u user
+
+	if err := c.Get("user:1", &u); err != ErrCacheMiss {
+		t.Fatalf("Expected ErrCacheMiss, got %v", err)
+	}
+
+	if err := c.Set("user:1", user{1, "inkel"}, time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if v, _ := s.Get("cache:user:1"); v != `{"ID":1,"Name":"inkel"}` {
+		t.Fatalf("Unexpected value: %q", v)
+	}
+
+	if err := c.Get("user:1", &u); err != nil || u.Name != "inkel" {
+		t.Fatalf("Unexpected %+v, %v", u, err)
+	}
+
+	if err := c.Delete("user:1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := c.Get("user:1", &u); err != ErrCacheMiss {
+		t.Fatalf("Expected ErrCacheMiss, got %v", err)
+	}
+}
+
+func TestCache_jitter(t *testing.T) {
+	s, c := newCache(t)
+	c.Jitter = 0.5
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		c.Set(key, i, time.Minute)
+
+		if ttl := s.TTL("cache:" + key); ttl < 30*time.Second || ttl > 90*time.Second {
+			t.Fatalf("TTL out of range: %v", ttl)
+		}
+	}
+
+	c.Jitter = 0
+	c.Set("exact", 1, time.Minute)
+
+	if ttl := s.TTL("cache:exact"); ttl != time.Minute {
+		t.Fatalf("Unexpected TTL: %v", ttl)
+	}
+}
+
+func TestCache_Once(t *testing.T) {
+	_, c := newCache(t)
+
+	var calls int32
+	release := make(chan struct{})
+
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return user{1, "inkel"}, nil
+	}
+
+	var wg sync.WaitGroup
+	users := make([]user, 10)
+	errs := make([]error, 10)
+
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Once("user:1", &users[i], time.Minute, load)
+		}(i)
+	}
+
+	// Let every goroutine miss before loading
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected a single load, got %d", calls)
+	}
+
+	for i, u := range users {
+		if errs[i] != nil || u.Name != "inkel" {
+			t.Fatalf("Unexpected %+v, %v", u, errs[i])
+		}
+	}
+
+	// Cached now
+	var u user
+	err := c.Once("user:1", &u, time.Minute, func() (interface{}, error) {
+		t.Fatal("The value should be cached")
+		return nil, nil
+	})
+	if err != nil || u.ID != 1 {
+		t.Fatalf("Unexpected %+v, %v", u, err)
+	}
+}
+
+func TestCache_Once_negative(t *testing.T) {
+	_, c := newCache(t)
+	c.NegativeTTL = time.Minute
+
+	calls := 0
+	load := func() (interface{}, error) {
+		calls++
+		return nil, fmt.Errorf("user 2: %w", ErrNotFound)
+	}
+
+	var u user
+
+	for i := 0; i < 2; i++ {
+		if err := c.Once("user:2", &u, time.Minute, load); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("Expected the miss to be cached, got %d loads", calls)
+	}
+
+	if err := c.Get("user:2", &u); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCache_Once_down(t *testing.T) {
+	s, c := newCache(t)
+	s.SetFailure("ERR down")
+
+	var n int
+	err := c.Once("n", &n, time.Minute, func() (interface{}, error) {
+		return 42, nil
+	})
+	if err != nil || n != 42 {
+		t.Fatalf("Unexpected %d, %v", n, err)
+	}
+
+	boom := errors.New("boom")
+	err = c.Once("n", &n, time.Minute, func() (interface{}, error) {
+		return nil, boom
+	})
+	if err != boom {
+		t.Fatalf("Expected the loader error, got %v", err)
+	}
+}
+
+func TestCache_Once_panic(t *testing.T) {
+	_, c := newCache(t)
+
+	var n int
+	err := c.Once("n", &n, time.Minute, func() (interface{}, error) {
+		panic("boom")
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Expected the panic as an error, got %v", err)
+	}
+
+	// The call was removed, so the next one loads again instead of
+	// waiting forever
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Once("n", &n, time.Minute, func() (interface{}, error) {
+			return 42, nil
+		})
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil || n != 42 {
+			t.Fatalf("Unexpected %d, %v", n, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Once is still waiting for the call that panicked")
+	}
+}
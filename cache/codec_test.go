@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSON, Gob} {
+		data, err := codec.Marshal(user{1, "inkel"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		var u user
+		if err = codec.Unmarshal(data, &u); err != nil || u != (user{1, "inkel"}) {
+			t.Fatalf("Unexpected %+v, %v", u, err)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	data, err := Raw.Marshal("lorem")
+	if err != nil || string(data) != "lorem" {
+		t.Fatalf("Unexpected %q, %v", data, err)
+	}
+
+	if data, err = Raw.Marshal([]byte("ipsum")); err != nil || string(data) != "ipsum" {
+		t.Fatalf("Unexpected %q, %v", data, err)
+	}
+
+	if _, err = Raw.Marshal(1); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	var s string
+	if err = Raw.Unmarshal([]byte("lorem"), &s); err != nil || s != "lorem" {
+		t.Fatalf("Unexpected %q, %v", s, err)
+	}
+
+	var bs []byte
+	if err = Raw.Unmarshal([]byte("ipsum"), &bs); err != nil || string(bs) != "ipsum" {
+		t.Fatalf("Unexpected %q, %v", bs, err)
+	}
+
+	var n int
+	if err = Raw.Unmarshal([]byte("1"), &n); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/inkel/gedis"
+	"strconv"
+	"time"
+)
+
+// An entry of a Redis stream
+type XMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+// Entries read from a Redis stream
+type XStream struct {
+	Stream   string
+	Messages []XMessage
+}
+
+// Send a blocking command, waiting up to timeout for its reply on top
+// of the read timeout; zero waits forever
+//
+// If ctx is done before the reply arrives the connection is closed,
+// as the reply would otherwise be read by the next command, and the
+// Client can't be used anymore.
+func (c *Client) blocking(ctx context.Context, timeout time.Duration, args ...interface{}) (interface{}, error) {
+	block := timeout
+	if block == 0 {
+		block = -1
+	}
+
+	var res interface{}
+	var err error
+
+	if ctxErr := c.watchContext(ctx, func() {
+		res, err = c.do(ctx, args, block)
+	}); ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	if err == nil && res == nil {
+		err = gedis.ErrNil
+	}
+
+	return res, err
+}
+
+// Format a timeout in seconds, as expected by BLPOP and friends
+func seconds(timeout time.Duration) string {
+	return strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+}
+
+func blockingArgs(cmd string, keys []string, extra ...interface{}) []interface{} {
+	args := make([]interface{}, 0, 1+len(keys)+len(extra))
+	args = append(args, cmd)
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	return append(args, extra...)
+}
+
+// Pop an element from the head of the first non-empty list, waiting
+// up to timeout for one to be available; zero waits forever
+//
+// Returns gedis.ErrNil if the timeout expires.
+func (c *Client) BLPop(ctx context.Context, timeout time.Duration, keys ...string) (key, value string, err error) {
+	return c.bpop(ctx, "BLPOP", timeout, keys)
+}
+
+// Pop an element from the tail of the first non-empty list, waiting
+// up to timeout for one to be available; zero waits forever
+//
+// Returns gedis.ErrNil if the timeout expires.
+func (c *Client) BRPop(ctx context.Context, timeout time.Duration, keys ...string) (key, value string, err error) {
+	return c.bpop(ctx, "BRPOP", timeout, keys)
+}
+
+func (c *Client) bpop(ctx context.Context, cmd string, timeout time.Duration, keys []string) (key, value string, err error) {
+	res, err := c.blocking(ctx, timeout, blockingArgs(cmd, keys, seconds(timeout))...)
+	if err != nil {
+		return "", "", err
+	}
+
+	var kv []string
+	if err = gedis.Scan(res, &kv); err != nil {
+		return "", "", err
+	}
+
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("gedis: unexpected %s reply: %#v", cmd, res)
+	}
+
+	return kv[0], kv[1], nil
+}
+
+// Move an element from the from side (LEFT or RIGHT) of the source
+// list to the to side of the destination list, waiting up to timeout
+// for one to be available; zero waits forever
+//
+// Returns gedis.ErrNil if the timeout expires.
+func (c *Client) BLMove(ctx context.Context, source, destination, from, to string, timeout time.Duration) (string, error) {
+	res, err := c.blocking(ctx, timeout, "BLMOVE", source, destination, from, to, seconds(timeout))
+	if err != nil {
+		return "", err
+	}
+
+	var value string
+	err = gedis.Scan(res, &value)
+
+	return value, err
+}
+
+// Pop the member with the lowest score from the first non-empty
+// sorted set, waiting up to timeout for one to be available; zero
+// waits forever
+//
+// Returns gedis.ErrNil if the timeout expires.
+func (c *Client) BZPopMin(ctx context.Context, timeout time.Duration, keys ...string) (key, member string, score float64, err error) {
+	res, err := c.blocking(ctx, timeout, blockingArgs("BZPOPMIN", keys, seconds(timeout))...)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	arr, ok := res.([]interface{})
+	if !ok || len(arr) != 3 {
+		return "", "", 0, fmt.Errorf("gedis: unexpected BZPOPMIN reply: %#v", res)
+	}
+
+	if err = gedis.Scan(arr[0], &key); err != nil {
+		return
+	}
+	if err = gedis.Scan(arr[1], &member); err != nil {
+		return
+	}
+	err = gedis.Scan(arr[2], &score)
+
+	return
+}
+
+// Read entries with an ID greater than the given ones from one or
+// more streams, waiting up to block for any to be available; zero
+// waits forever
+//
+// streams holds the stream keys followed by their IDs, like in XREAD,
+// i.e. "a", "b", "0", "$". If count is greater than zero, at most
+// count entries are returned per stream.
+//
+// Returns gedis.ErrNil if the block timeout expires.
+func (c *Client) XReadBlock(ctx context.Context, block time.Duration, count int, streams ...string) ([]XStream, error) {
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		return nil, fmt.Errorf("gedis: XReadBlock needs a key and an ID per stream")
+	}
+
+	args := []interface{}{"XREAD"}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	args = append(args, "BLOCK", block.Milliseconds(), "STREAMS")
+	for _, s := range streams {
+		args = append(args, s)
+	}
+
+	res, err := c.blocking(ctx, block, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseXStreams(res)
+}
+
+// Read entries from one or more streams as consumer of a consumer
+// group, waiting up to block for any to be available; zero waits
+// forever
+//
+// streams holds the stream keys followed by their IDs, like in
+// XREADGROUP, where the ID > returns entries never delivered to any
+// consumer, and any other ID returns the entries pending for this
+// consumer after that ID. If count is greater than zero, at most count
+// entries are returned per stream.
+//
+// Returns gedis.ErrNil if the block timeout expires.
+func (c *Client) XReadGroup(ctx context.Context, group, consumer string, block time.Duration, count int, streams ...string) ([]XStream, error) {
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		return nil, fmt.Errorf("gedis: XReadGroup needs a key and an ID per stream")
+	}
+
+	args := []interface{}{"XREADGROUP", "GROUP", group, consumer}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	args = append(args, "BLOCK", block.Milliseconds(), "STREAMS")
+	for _, s := range streams {
+		args = append(args, s)
+	}
+
+	res, err := c.blocking(ctx, block, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseXStreams(res)
+}
+
+// Parse the reply of XREAD and XREADGROUP
+func ParseXStreams(reply interface{}) ([]XStream, error) {
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("gedis: unexpected stream reply: %#v", reply)
+	}
+
+	streams := make([]XStream, len(arr))
+
+	for i, s := range arr {
+		pair, ok := s.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("gedis: unexpected stream reply: %#v", s)
+		}
+
+		if err := gedis.Scan(pair[0], &streams[i].Stream); err != nil {
+			return nil, err
+		}
+
+		msgs, err := ParseXMessages(pair[1])
+		if err != nil {
+			return nil, err
+		}
+
+		streams[i].Messages = msgs
+	}
+
+	return streams, nil
+}
+
+// Parse a list of stream entries, as returned by XRANGE or
+// XAUTOCLAIM
+func ParseXMessages(reply interface{}) ([]XMessage, error) {
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("gedis: unexpected stream entries: %#v", reply)
+	}
+
+	msgs := make([]XMessage, 0, len(arr))
+
+	for _, m := range arr {
+		entry, ok := m.([]interface{})
+		if !ok || len(entry) != 2 {
+			return nil, fmt.Errorf("gedis: unexpected stream entry: %#v", m)
+		}
+
+		var msg XMessage
+
+		if err := gedis.Scan(entry[0], &msg.ID); err != nil {
+			return nil, err
+		}
+
+		// Entries deleted while pending have nil values
+		if entry[1] != nil {
+			if err := gedis.Scan(entry[1], &msg.Values); err != nil {
+				return nil, err
+			}
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/internal/redistest"
+	"github.com/inkel/gedis/server"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_BLPop(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	// The block timeout is longer than the read timeout
+	c.SetTimeouts(50*time.Millisecond, 0)
+
+	_, _, err = c.BLPop(context.Background(), 200*time.Millisecond, "list")
+	if err != gedis.ErrNil {
+		t.Fatalf("Expected ErrNil, got %#v", err)
+	}
+
+	_, err = c.Send("RPUSH", "list", "lorem")
+	notErr(t, err)
+
+	k, v, err := c.BLPop(context.Background(), time.Second, "other", "list")
+	notErr(t, err)
+	if k != "list" || v != "lorem" {
+		t.Fatalf("Unexpected: %q %q", k, v)
+	}
+}
+
+func TestClient_BLPop_cancel(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, _, err = c.BLPop(ctx, 0, "list")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %#v", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("BLPop wasn't cancelled: %v", d)
+	}
+
+	if _, err = c.Send("PING"); err == nil {
+		t.Fatal("The connection should be closed after cancelling")
+	}
+}
+
+func TestClient_BZPopMin(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	_, err = c.Send("ZADD", "zset", 1.5, "lorem", 2, "ipsum")
+	notErr(t, err)
+
+	k, m, score, err := c.BZPopMin(context.Background(), time.Second, "zset")
+	notErr(t, err)
+	if k != "zset" || m != "lorem" || score != 1.5 {
+		t.Fatalf("Unexpected: %q %q %v", k, m, score)
+	}
+}
+
+func TestClient_XReadBlock(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+
+	s := redistest.NewServerWith(t, func(s *redistest.Server) {
+		s.Handle("XREAD", func(c *server.Client, args [][]byte) error {
+			mu.Lock()
+			got = nil
+			for _, arg := range args {
+				got = append(got, string(arg))
+			}
+			mu.Unlock()
+			_, err := c.Write([]byte("*1\r\n*2\r\n$6\r\nstream\r\n" +
+				"*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$5\r\nfield\r\n$5\r\nvalue\r\n"))
+			return err
+		})
+	})
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	streams, err := c.XReadBlock(context.Background(), 100*time.Millisecond, 10, "stream", "$")
+	notErr(t, err)
+
+	expected := []XStream{
+		{"stream", []XMessage{{"1-0", map[string]string{"field": "value"}}}},
+	}
+
+	if !reflect.DeepEqual(expected, streams) {
+		t.Fatalf("\nexpected %#v\nreturned %#v", expected, streams)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	args := []string{"COUNT", "10", "BLOCK", "100", "STREAMS", "stream", "$"}
+	if !reflect.DeepEqual(args, got) {
+		t.Fatalf("\nexpected %q\nreturned %q", args, got)
+	}
+}
+
+func TestMuxClient_Blocking(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	for i := 0; i < 3; i++ {
+		err = m.Blocking(func(c *Client) error {
+			_, _, err := c.BLPop(context.Background(), 10*time.Millisecond, "list")
+			return err
+		})
+		if err != gedis.ErrNil {
+			t.Fatalf("Expected ErrNil, got %#v", err)
+		}
+	}
+
+	// The shared connection plus a single dedicated connection
+	if n := s.Clients(); n != 2 {
+		t.Fatalf("Expected 2 connections, got %d", n)
+	}
+}
@@ -74,14 +74,28 @@ Example
 package client
 
 import (
+	"bufio"
+	"context"
 	"github.com/inkel/gedis"
 	"net"
+	"time"
 )
 
+// Anything that sends commands to Redis and returns their replies,
+// like Client, MuxClient, ReplicaClient or Ring
+type Sender interface {
+	Send(args ...interface{}) (interface{}, error)
+}
+
 // A wrapper to net.Conn that handles writing/reading to a Redis
 // server
 type Client struct {
-	conn net.Conn
+	conn  net.Conn
+	r     *bufio.Reader
+	hooks hooks
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
 // Connect to a Redis server on address, using the named network
@@ -90,6 +104,9 @@ type Client struct {
 // networks.
 func Dial(network, address string) (c Client, err error) {
 	c.conn, err = net.Dial(network, address)
+	if err == nil {
+		c.r = bufio.NewReader(c.conn)
+	}
 	return
 }
 
@@ -98,18 +115,116 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// Set how long to wait for a command to be written and for its reply
+// to be read
+//
+// Zero, the default, means no timeout. Blocking commands sent with
+// methods like BLPop wait for their block timeout on top of the read
+// timeout.
+func (c *Client) SetTimeouts(read, write time.Duration) {
+	c.readTimeout = read
+	c.writeTimeout = write
+}
+
 // Send a command to the Redis server and receive its reply
+//
+// Arguments are always sent as bulk strings; see gedis.AppendArg for
+// the supported types. Unsupported types return an error and nothing
+// is sent to the server.
 func (c *Client) Send(args ...interface{}) (interface{}, error) {
-	_, err := gedis.Write(c.conn, args...)
-	if err != nil {
+	return c.do(context.Background(), args, 0)
+}
+
+// Send a command like Send, passing ctx to the hooks
+//
+// If ctx is done before the reply arrives the connection is closed,
+// as the reply would otherwise be read by the next command, and the
+// Client can't be used anymore.
+func (c *Client) SendContext(ctx context.Context, args ...interface{}) (res interface{}, err error) {
+	ctxErr := c.watchContext(ctx, func() {
+		res, err = c.do(ctx, args, 0)
+	})
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
+	return
+}
+
+// Send a command through the hooks, if any
+func (c *Client) do(ctx context.Context, args []interface{}, block time.Duration) (interface{}, error) {
+	return c.hooks.send(ctx, args, func() (interface{}, error) {
+		return c.roundTrip(args, block)
+	})
+}
+
+// Run fn, closing the connection if ctx is done before it returns
+func (c *Client) watchContext(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.Close()
+	})
+
+	fn()
+
+	if !stop() {
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// Send a command whose reply might take block longer than the read
+// timeout to arrive; a negative block waits forever
+func (c *Client) roundTrip(args []interface{}, block time.Duration) (interface{}, error) {
+	if err := c.write(args); err != nil {
 		return nil, err
 	}
-	return c.Read()
+
+	c.setReadDeadline(block)
+
+	return gedis.Read(c.r)
+}
+
+// Send a command without waiting for its reply
+func (c *Client) write(args []interface{}) error {
+	bs, err := gedis.EncodeCommand(args...)
+	if err != nil {
+		return err
+	}
+
+	c.setWriteDeadline()
+
+	_, err = c.conn.Write(bs)
+	return err
+}
+
+func (c *Client) setWriteDeadline() {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+func (c *Client) setReadDeadline(block time.Duration) {
+	if c.readTimeout <= 0 {
+		return
+	}
+
+	if block < 0 {
+		c.conn.SetReadDeadline(time.Time{})
+	} else {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout + block))
+	}
 }
 
 // Reads from the client
 //
-// This is useful for cases like a monitor
+// This is useful for cases like a monitor, and so it waits forever
+// regardless of the read timeout. See Monitor for a parsed MONITOR
+// output.
 func (c *Client) Read() (interface{}, error) {
-	return gedis.Read(c.conn)
+	c.setReadDeadline(-1)
+	return gedis.Read(c.r)
 }
@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/internal/redistest"
 	"path"
 	"runtime"
 	"testing"
@@ -80,3 +81,34 @@ func TestClient(t *testing.T) {
 		t.Fatalf("Unexpected: %#v", res)
 	}
 }
+
+func TestClient_arguments(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	res, err := c.Send("SET", key, []byte("lorem"))
+	notErr(t, err)
+	if res != gedis.Status("OK") {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	_, err = c.Send("INCR", key+":n")
+	notErr(t, err)
+
+	res, err = c.Send("GET", key+":n")
+	notErr(t, err)
+	if res != "1" {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	if _, err = c.Send("SET", key, make(chan int)); err == nil {
+		t.Fatal("Expected error for unsupported argument")
+	}
+
+	// Nothing was sent, so the connection must still be usable
+	_, err = c.Send("PING")
+	notErr(t, err)
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// A command sent to the Redis server, along with its outcome
+type Cmd struct {
+	// Upper-cased name of the command
+	Name string
+	// All the arguments, including the command name
+	Args []interface{}
+
+	Reply    interface{}
+	Err      error
+	Duration time.Duration
+}
+
+// Callbacks invoked around every interaction of a client with the
+// Redis server
+//
+// Hooks can be added to a Client, a MuxClient, a ReplicaClient or a
+// Ring. The last three run the command hooks once per command given to
+// Send, however many connections it takes, and the dial hooks for
+// every connection they open.
+//
+// Before callbacks are called in the order the hooks were added, and
+// can return a new context to pass data, like a tracing span, to the
+// following hooks and to their After counterpart. After callbacks are
+// called in reverse order, so hooks nest like middleware.
+//
+// Embed NopHook to implement only some of the callbacks.
+type Hook interface {
+	BeforeDial(ctx context.Context, network, address string) context.Context
+	AfterDial(ctx context.Context, network, address string, err error, d time.Duration)
+
+	BeforeCommand(ctx context.Context, cmd *Cmd) context.Context
+	AfterCommand(ctx context.Context, cmd *Cmd)
+
+	BeforePipeline(ctx context.Context, cmds []*Cmd) context.Context
+	AfterPipeline(ctx context.Context, cmds []*Cmd, err error, d time.Duration)
+}
+
+// A Hook that does nothing
+type NopHook struct{}
+
+func (NopHook) BeforeDial(ctx context.Context, network, address string) context.Context {
+	return ctx
+}
+
+func (NopHook) AfterDial(ctx context.Context, network, address string, err error, d time.Duration) {
+}
+
+func (NopHook) BeforeCommand(ctx context.Context, cmd *Cmd) context.Context {
+	return ctx
+}
+
+func (NopHook) AfterCommand(ctx context.Context, cmd *Cmd) {
+}
+
+func (NopHook) BeforePipeline(ctx context.Context, cmds []*Cmd) context.Context {
+	return ctx
+}
+
+func (NopHook) AfterPipeline(ctx context.Context, cmds []*Cmd, err error, d time.Duration) {
+}
+
+// The hooks of a client, in the order they were added
+type hooks []Hook
+
+// Connect to a Redis server like Dial, running hooks around the dial
+// and every command sent afterwards
+func DialHooks(network, address string, hs ...Hook) (c Client, err error) {
+	return DialHooksContext(context.Background(), network, address, hs...)
+}
+
+// Like DialHooks, passing ctx to the dial hooks
+func DialHooksContext(ctx context.Context, network, address string, hs ...Hook) (c Client, err error) {
+	c, err = hooks(hs).dial(ctx, network, address)
+	c.hooks = hs
+	return
+}
+
+// Add a hook that runs around every command sent from now on
+func (c *Client) AddHook(h Hook) {
+	c.hooks = append(c.hooks, h)
+}
+
+// Dial through the dial hooks; the Client doesn't get the hooks
+func (hs hooks) dial(ctx context.Context, network, address string) (c Client, err error) {
+	for _, h := range hs {
+		ctx = h.BeforeDial(ctx, network, address)
+	}
+
+	start := time.Now()
+	c, err = Dial(network, address)
+	d := time.Since(start)
+
+	for i := len(hs) - 1; i >= 0; i-- {
+		hs[i].AfterDial(ctx, network, address, err, d)
+	}
+
+	return
+}
+
+// Send a command through the hooks, if any, calling fn to actually
+// send it
+func (hs hooks) send(ctx context.Context, args []interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	if len(hs) == 0 {
+		return fn()
+	}
+
+	cmd := &Cmd{Name: commandName(args), Args: args}
+
+	hs.runCommand(ctx, cmd, func() {
+		cmd.Reply, cmd.Err = fn()
+	})
+
+	return cmd.Reply, cmd.Err
+}
+
+// Run cmd through the hooks, calling fn to actually send it
+func (hs hooks) runCommand(ctx context.Context, cmd *Cmd, fn func()) {
+	for _, h := range hs {
+		ctx = h.BeforeCommand(ctx, cmd)
+	}
+
+	start := time.Now()
+	fn()
+	cmd.Duration = time.Since(start)
+
+	for i := len(hs) - 1; i >= 0; i-- {
+		hs[i].AfterCommand(ctx, cmd)
+	}
+}
+
+// Run a pipeline through the hooks, calling fn to actually send it
+func (hs hooks) runPipeline(ctx context.Context, cmds []*Cmd, fn func() error) error {
+	for _, h := range hs {
+		ctx = h.BeforePipeline(ctx, cmds)
+	}
+
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+
+	for i := len(hs) - 1; i >= 0; i-- {
+		hs[i].AfterPipeline(ctx, cmds, err, d)
+	}
+
+	return err
+}
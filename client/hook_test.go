@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/internal/redistest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type ctxKey struct{}
+
+// Hook that records every callback
+type recordingHook struct {
+	name  string
+	calls *[]string
+}
+
+func (h recordingHook) record(format string, args ...interface{}) {
+	*h.calls = append(*h.calls, h.name+":"+fmt.Sprintf(format, args...))
+}
+
+func (h recordingHook) BeforeDial(ctx context.Context, network, address string) context.Context {
+	h.record("before-dial")
+	return ctx
+}
+
+func (h recordingHook) AfterDial(ctx context.Context, network, address string, err error, d time.Duration) {
+	h.record("after-dial %v", err)
+}
+
+func (h recordingHook) BeforeCommand(ctx context.Context, cmd *Cmd) context.Context {
+	h.record("before %s", cmd.Name)
+	return context.WithValue(ctx, ctxKey{}, h.name)
+}
+
+func (h recordingHook) AfterCommand(ctx context.Context, cmd *Cmd) {
+	h.record("after %s %v %v %v", cmd.Name, cmd.Reply, cmd.Err, ctx.Value(ctxKey{}))
+}
+
+func (h recordingHook) BeforePipeline(ctx context.Context, cmds []*Cmd) context.Context {
+	h.record("before-pipeline %d", len(cmds))
+	return ctx
+}
+
+func (h recordingHook) AfterPipeline(ctx context.Context, cmds []*Cmd, err error, d time.Duration) {
+	h.record("after-pipeline %d %v", len(cmds), err)
+}
+
+func TestHooks(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	var calls []string
+
+	c, err := DialHooks("tcp", s.Addr(), recordingHook{"a", &calls}, recordingHook{"b", &calls})
+	notErr(t, err)
+	defer c.Close()
+
+	_, err = c.Send("PING")
+	notErr(t, err)
+
+	p := c.Pipeline()
+	p.Send("PING")
+	p.Send("ECHO", "lorem")
+	_, err = p.Exec()
+	notErr(t, err)
+
+	expected := []string{
+		"a:before-dial",
+		"b:before-dial",
+		"b:after-dial <nil>",
+		"a:after-dial <nil>",
+		"a:before PING",
+		"b:before PING",
+		"b:after PING PONG <nil> b",
+		"a:after PING PONG <nil> b",
+		"a:before-pipeline 2",
+		"b:before-pipeline 2",
+		"b:after-pipeline 2 <nil>",
+		"a:after-pipeline 2 <nil>",
+	}
+
+	if !reflect.DeepEqual(expected, calls) {
+		t.Fatalf("\nexpected %q\nreturned %q", expected, calls)
+	}
+}
+
+type countingHook struct {
+	NopHook
+	count int
+}
+
+func (h *countingHook) AfterCommand(ctx context.Context, cmd *Cmd) {
+	h.count++
+}
+
+func TestClient_AddHook(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	h := &countingHook{}
+	c.AddHook(h)
+
+	c.Send("PING")
+	c.Send("NOSUCHCOMMAND")
+
+	if h.count != 2 {
+		t.Fatalf("Expected 2 commands, got %d", h.count)
+	}
+}
+
+func TestHooks_clients(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	r, err := DialReplicas("tcp", s.Addr(), []string{s.Addr()}, RoundRobin, 0)
+	notErr(t, err)
+	defer r.Close()
+
+	ring, err := DialRing("tcp", []string{s.Addr()}, Ketama, 0)
+	notErr(t, err)
+	defer ring.Close()
+
+	for _, c := range []interface {
+		Sender
+		AddHook(Hook)
+	}{m, r, ring} {
+		var calls []string
+		c.AddHook(recordingHook{"a", &calls})
+
+		c.Send("SET", key, "lorem")
+		c.Send("MGET", key, "missing")
+
+		expected := []string{
+			"a:before SET",
+			"a:after SET OK <nil> a",
+			"a:before MGET",
+			"a:after MGET [lorem <nil>] <nil> a",
+		}
+
+		if !reflect.DeepEqual(expected, calls) {
+			t.Fatalf("%T:\nexpected %q\nreturned %q", c, expected, calls)
+		}
+	}
+
+	// Blocking commands run the hooks of a dedicated connection
+	h := &countingHook{}
+	m.AddHook(h)
+
+	m.Send("BLPOP", "list", "0.01")
+
+	if h.count != 1 {
+		t.Fatalf("Expected 1 command, got %d", h.count)
+	}
+}
+
+type ctxHook struct {
+	NopHook
+	values []interface{}
+}
+
+func (h *ctxHook) BeforeDial(ctx context.Context, network, address string) context.Context {
+	h.values = append(h.values, ctx.Value(ctxKey{}))
+	return ctx
+}
+
+func (h *ctxHook) BeforeCommand(ctx context.Context, cmd *Cmd) context.Context {
+	h.values = append(h.values, ctx.Value(ctxKey{}))
+	return ctx
+}
+
+func (h *ctxHook) BeforePipeline(ctx context.Context, cmds []*Cmd) context.Context {
+	h.values = append(h.values, ctx.Value(ctxKey{}))
+	return ctx
+}
+
+func TestHooks_context(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	h := &ctxHook{}
+
+	c, err := DialHooksContext(context.WithValue(context.Background(), ctxKey{}, "dial"), "tcp", s.Addr(), h)
+	notErr(t, err)
+	defer c.Close()
+
+	_, err = c.SendContext(context.WithValue(context.Background(), ctxKey{}, "send"), "PING")
+	notErr(t, err)
+
+	_, _, err = c.BLPop(context.WithValue(context.Background(), ctxKey{}, "blpop"), time.Millisecond, "nothing")
+	if err != gedis.ErrNil {
+		t.Fatalf("Expected gedis.ErrNil, got %v", err)
+	}
+
+	p := c.Pipeline()
+	p.Send("PING")
+	_, err = p.ExecContext(context.WithValue(context.Background(), ctxKey{}, "pipeline"))
+	notErr(t, err)
+
+	expected := []interface{}{"dial", "send", "blpop", "pipeline"}
+	if !reflect.DeepEqual(expected, h.values) {
+		t.Fatalf("\nexpected %q\nreturned %q", expected, h.values)
+	}
+}
+
+func TestClient_SendContext_canceled(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = c.SendContext(ctx, "PING"); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
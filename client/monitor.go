@@ -0,0 +1,211 @@
+package client
+
+import (
+	"fmt"
+	"github.com/inkel/gedis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A command processed by the server, as reported by MONITOR
+type MonitorEntry struct {
+	Time time.Time
+	DB   int
+	// Address of the client that sent the command, "lua" for commands
+	// run by scripts, or "unix:PATH" for Unix sockets
+	Addr    string
+	Command string
+	Args    []string
+}
+
+// Receives the commands processed by a Redis server
+type Monitor struct {
+	c *Client
+}
+
+// Connect to a Redis server and start monitoring it
+//
+// MONITOR takes over the connection, so a new one is always dialed.
+func DialMonitor(network, address string) (*Monitor, error) {
+	c, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = c.Send("MONITOR"); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &Monitor{&c}, nil
+}
+
+// Wait for the next command processed by the server
+func (m *Monitor) Next() (MonitorEntry, error) {
+	res, err := m.c.Read()
+	if err != nil {
+		return MonitorEntry{}, err
+	}
+
+	line, ok := res.(gedis.Status)
+	if !ok {
+		return MonitorEntry{}, fmt.Errorf("gedis: unexpected MONITOR reply: %#v", res)
+	}
+
+	return ParseMonitorLine(string(line))
+}
+
+// Stop monitoring and close the connection
+func (m *Monitor) Close() error {
+	return m.c.Close()
+}
+
+// Parse a line of MONITOR output, like
+//
+//     1339518083.107412 [0 127.0.0.1:60866] "set" "key" "value"
+func ParseMonitorLine(line string) (e MonitorEntry, err error) {
+	sp := strings.IndexByte(line, ' ')
+	if sp < 0 {
+		return e, fmt.Errorf("gedis: invalid MONITOR line %q", line)
+	}
+
+	if e.Time, err = parseMonitorTime(line[:sp]); err != nil {
+		return e, err
+	}
+
+	rest := line[sp+1:]
+
+	// The address may have brackets, as in [0 [::1]:6379], so the client
+	// ends at the last one before the quoted command
+	end := strings.IndexByte(rest, '"')
+	if end < 0 {
+		end = len(rest)
+	}
+	end = strings.LastIndexByte(rest[:end], ']')
+	if len(rest) == 0 || rest[0] != '[' || end < 0 {
+		return e, fmt.Errorf("gedis: invalid MONITOR line %q", line)
+	}
+
+	client := strings.SplitN(rest[1:end], " ", 2)
+	if len(client) != 2 {
+		return e, fmt.Errorf("gedis: invalid MONITOR line %q", line)
+	}
+
+	if e.DB, err = strconv.Atoi(client[0]); err != nil {
+		return e, fmt.Errorf("gedis: invalid MONITOR line %q", line)
+	}
+	e.Addr = client[1]
+
+	args, err := unquoteArgs(rest[end+1:])
+	if err != nil {
+		return e, err
+	}
+
+	if len(args) == 0 {
+		return e, fmt.Errorf("gedis: invalid MONITOR line %q", line)
+	}
+
+	e.Command, e.Args = args[0], args[1:]
+
+	return e, nil
+}
+
+// Parse a timestamp in seconds with microseconds, like
+// 1339518083.107412
+func parseMonitorTime(s string) (time.Time, error) {
+	sec, usec := s, "0"
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		sec, usec = s[:dot], s[dot+1:]
+	}
+
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("gedis: invalid MONITOR timestamp %q", s)
+	}
+
+	// Pad or truncate the fraction to microseconds
+	usec = (usec + "000000")[:6]
+
+	usecs, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("gedis: invalid MONITOR timestamp %q", s)
+	}
+
+	return time.Unix(secs, usecs*int64(time.Microsecond)), nil
+}
+
+// Split the quoted arguments of a MONITOR line, undoing the escaping
+// done by Redis
+func unquoteArgs(s string) ([]string, error) {
+	var args []string
+
+	for i := 0; i < len(s); {
+		if s[i] == ' ' {
+			i++
+			continue
+		}
+
+		if s[i] != '"' {
+			return nil, fmt.Errorf("gedis: invalid MONITOR argument in %q", s)
+		}
+
+		var arg []byte
+		i++
+
+		for {
+			if i >= len(s) {
+				return nil, fmt.Errorf("gedis: unterminated MONITOR argument in %q", s)
+			}
+
+			c := s[i]
+
+			if c == '"' {
+				i++
+				break
+			}
+
+			if c != '\\' {
+				arg = append(arg, c)
+				i++
+				continue
+			}
+
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("gedis: unterminated MONITOR argument in %q", s)
+			}
+
+			switch s[i+1] {
+			case 'n':
+				arg = append(arg, '\n')
+			case 'r':
+				arg = append(arg, '\r')
+			case 't':
+				arg = append(arg, '\t')
+			case 'a':
+				arg = append(arg, '\a')
+			case 'b':
+				arg = append(arg, '\b')
+			case 'x':
+				if i+3 >= len(s) {
+					return nil, fmt.Errorf("gedis: invalid MONITOR escape in %q", s)
+				}
+				b, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("gedis: invalid MONITOR escape in %q", s)
+				}
+				arg = append(arg, byte(b))
+				i += 2
+			default:
+				// \\ and \"
+				arg = append(arg, s[i+1])
+			}
+
+			i += 2
+		}
+
+		args = append(args, string(arg))
+	}
+
+	return args, nil
+}
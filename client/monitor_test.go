@@ -0,0 +1,78 @@
+package client
+
+import (
+	"github.com/inkel/gedis/internal/redistest"
+	"github.com/inkel/gedis/server"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	s := redistest.NewServerWith(t, func(s *redistest.Server) {
+		s.Handle("MONITOR", func(c *server.Client, args [][]byte) error {
+			_, err := c.Write([]byte("+OK\r\n" +
+				"+1339518083.107412 [0 127.0.0.1:60866] \"set\" \"key\" \"lorem \\\"ipsum\\\"\"\r\n" +
+				"+1339518087.877697 [2 lua] \"get\" \"a\\r\\nb\\x00\"\r\n"))
+			return err
+		})
+	})
+
+	m, err := DialMonitor("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	e, err := m.Next()
+	notErr(t, err)
+
+	if !e.Time.Equal(time.Unix(1339518083, 107412000)) {
+		t.Fatalf("Unexpected time: %v", e.Time)
+	}
+	if e.DB != 0 || e.Addr != "127.0.0.1:60866" || e.Command != "set" {
+		t.Fatalf("Unexpected entry: %#v", e)
+	}
+	if len(e.Args) != 2 || e.Args[0] != "key" || e.Args[1] != `lorem "ipsum"` {
+		t.Fatalf("Unexpected arguments: %q", e.Args)
+	}
+
+	e, err = m.Next()
+	notErr(t, err)
+
+	if e.DB != 2 || e.Addr != "lua" || e.Command != "get" {
+		t.Fatalf("Unexpected entry: %#v", e)
+	}
+	if len(e.Args) != 1 || e.Args[0] != "a\r\nb\x00" {
+		t.Fatalf("Unexpected arguments: %q", e.Args)
+	}
+}
+
+func TestParseMonitorLine(t *testing.T) {
+	e, err := ParseMonitorLine(`1339518083.1 [10 unix:/tmp/redis.sock] "ping"`)
+	notErr(t, err)
+
+	if e.Time.Nanosecond() != 100000000 || e.DB != 10 || e.Addr != "unix:/tmp/redis.sock" || e.Command != "ping" || len(e.Args) != 0 {
+		t.Fatalf("Unexpected entry: %#v", e)
+	}
+
+	e, err = ParseMonitorLine(`1339518083.107412 [0 [::1]:6379] "get" "[a]"`)
+	notErr(t, err)
+
+	if e.DB != 0 || e.Addr != "[::1]:6379" || e.Command != "get" || len(e.Args) != 1 || e.Args[0] != "[a]" {
+		t.Fatalf("Unexpected entry: %#v", e)
+	}
+
+	for _, line := range []string{
+		"",
+		"OK",
+		`x [0 lua] "ping"`,
+		`1339518083.1 "ping"`,
+		`1339518083.1 [a lua] "ping"`,
+		`1339518083.1 [0 lua]`,
+		`1339518083.1 [0 lua] ping`,
+		`1339518083.1 [0 lua] "ping`,
+		`1339518083.1 [0 lua] "\xZZ"`,
+	} {
+		if _, err = ParseMonitorLine(line); err == nil {
+			t.Fatalf("Expected an error for %q", line)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/inkel/gedis"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Returned by MuxClient.Send once the client has been closed
+var ErrClosed = errors.New("gedis: client closed")
+
+// Returned by MuxClient.Send, ReplicaClient.Send and Ring.Send for
+// commands that change the state of the connection and therefore can't
+// share it with other callers
+//
+// Use MuxClient.Watch for transactions and MuxClient.Subscribe for
+// subscriptions, which run on connections of their own, or send those
+// commands through a Client obtained with MuxClient.Dedicated.
+var ErrStateful = errors.New("gedis: command needs a dedicated connection")
+
+// Maximum number of commands coalesced in a single write
+const muxBatchSize = 128
+
+// Maximum number of idle dedicated connections kept for blocking
+// commands
+const muxMaxIdle = 8
+
+// Commands that block the connection until a reply is available
+var blockingCommands = map[string]bool{
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BRPOPLPUSH": true,
+	"BLMOVE":     true,
+	"BLMPOP":     true,
+	"BZPOPMIN":   true,
+	"BZPOPMAX":   true,
+	"BZMPOP":     true,
+	"WAIT":       true,
+}
+
+// Commands that alter the state of the connection they're sent on
+var statefulCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"WATCH":        true,
+	"UNWATCH":      true,
+	"MULTI":        true,
+	"EXEC":         true,
+	"DISCARD":      true,
+	"MONITOR":      true,
+	"SELECT":       true,
+	"AUTH":         true,
+	"HELLO":        true,
+	"RESET":        true,
+	"QUIT":         true,
+}
+
+// A command waiting for its reply
+type call struct {
+	req   []byte
+	reply interface{}
+	err   error
+	done  chan struct{}
+}
+
+// A client that multiplexes commands sent concurrently from many
+// goroutines over a single connection
+//
+// Commands are coalesced into as few writes as possible by a writer
+// goroutine, and a reader goroutine hands each reply to its caller in
+// the same order the commands were written, which is the order in
+// which Redis replies.
+//
+// Blocking commands like BLPOP are sent through a dedicated
+// connection, taken from a pool of idle connections, so they don't
+// hold the replies of everyone else; see Blocking. Commands that
+// change the state of the connection, like WATCH or SUBSCRIBE, return
+// ErrStateful; use Watch and Subscribe instead, which also run on
+// dedicated connections.
+type MuxClient struct {
+	network string
+	address string
+	conn    net.Conn
+
+	queue   chan *call
+	pending chan *call
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	once sync.Once
+	err  error
+
+	mu     sync.Mutex
+	idle   []*Client
+	closed bool
+
+	hooks hooks
+}
+
+// Connect to a Redis server on address, using the named network, and
+// start multiplexing commands over that connection
+func DialMux(network, address string) (*MuxClient, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MuxClient{
+		network: network,
+		address: address,
+		conn:    conn,
+		queue:   make(chan *call),
+		pending: make(chan *call, 1024),
+		done:    make(chan struct{}),
+	}
+
+	m.wg.Add(2)
+	go m.writeLoop()
+	go m.readLoop()
+
+	return m, nil
+}
+
+// Add a hook that runs around every command sent from now on, and
+// around the dials of dedicated connections
+//
+// Commands sent on dedicated connections, like blocking ones or those
+// of Watch, run the hooks of their Client. AddHook must not be called
+// while other goroutines use the MuxClient.
+func (m *MuxClient) AddHook(h Hook) {
+	m.hooks = append(m.hooks, h)
+}
+
+// Close the connection to the Redis server
+//
+// Commands waiting for a reply fail with ErrClosed.
+func (m *MuxClient) Close() error {
+	m.fail(ErrClosed)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for _, c := range m.idle {
+		c.Close()
+	}
+	m.idle = nil
+
+	return nil
+}
+
+// Run fn with a Client on a dedicated connection, so it can send
+// blocking commands without holding the rest of the commands
+//
+// Connections are taken from a pool of idle connections, or dialed
+// if there are none, and go back to the pool afterwards unless fn
+// returns an error other than a Redis error reply or gedis.ErrNil.
+//
+//	err := m.Blocking(func(c *client.Client) error {
+//		key, value, err = c.BLPop(ctx, time.Second, "jobs")
+//		return err
+//	})
+func (m *MuxClient) Blocking(fn func(c *Client) error) error {
+	c, err := m.getIdle()
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+	m.release(c, err)
+
+	return err
+}
+
+// Run fn with a Client on a dedicated connection, after watching keys,
+// so it can run a transaction with MULTI and EXEC
+//
+// The connection comes from the same pool as Blocking, and leaves any
+// transaction fn didn't finish, and the keys it watched, before going
+// back to it.
+//
+//	err := m.Watch(func(c *client.Client) error {
+//		balance, err := c.Send("GET", "balance")
+//		...
+//		c.Send("MULTI")
+//		c.Send("SET", "balance", newBalance)
+//		res, err = c.Send("EXEC")
+//		return err
+//	}, "balance")
+//
+// EXEC replies nil, and runs nothing, if a watched key was modified.
+func (m *MuxClient) Watch(fn func(c *Client) error, keys ...string) error {
+	c, err := m.getIdle()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		if _, err = c.Send(blockingArgs("WATCH", keys)...); err != nil {
+			m.release(c, err)
+			return err
+		}
+	}
+
+	err = fn(c)
+
+	if resetErr := resetTx(c); resetErr != nil {
+		c.Close()
+	} else {
+		m.release(c, err)
+	}
+
+	return err
+}
+
+// Leave the transaction of c, if any, and forget its watched keys
+func resetTx(c *Client) error {
+	res, err := c.Send("UNWATCH")
+	if err != nil {
+		return err
+	}
+
+	// Queued, as in a transaction started and not executed
+	if res == gedis.Status("QUEUED") {
+		_, err = c.Send("DISCARD")
+	}
+
+	return err
+}
+
+// Put c back in the pool, unless err says the connection is broken
+func (m *MuxClient) release(c *Client, err error) {
+	if _, ok := err.(gedis.Error); err == nil || ok || err == gedis.ErrNil {
+		m.putIdle(c)
+	} else {
+		c.Close()
+	}
+}
+
+func (m *MuxClient) getIdle() (*Client, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(m.idle); n > 0 {
+		c := m.idle[n-1]
+		m.idle = m.idle[:n-1]
+		m.mu.Unlock()
+		c.hooks = m.hooks
+		return c, nil
+	}
+	m.mu.Unlock()
+
+	c, err := m.Dedicated()
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (m *MuxClient) putIdle(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed || len(m.idle) >= muxMaxIdle {
+		c.Close()
+		return
+	}
+
+	m.idle = append(m.idle, c)
+}
+
+// Open a new connection to the same Redis server, with the hooks of
+// the MuxClient
+//
+// The returned Client isn't shared with anyone else, and it's the
+// caller's responsibility to close it. Use it for the commands Send
+// refuses with ErrStateful that Watch and Subscribe don't cover, or to
+// keep a transaction across calls:
+//
+//	c, err := m.Dedicated()
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	c.Send("WATCH", "balance")
+//	c.Send("MULTI")
+//	c.Send("DECRBY", "balance", 10)
+//	res, err := c.Send("EXEC")
+func (m *MuxClient) Dedicated() (Client, error) {
+	c, err := m.hooks.dial(context.Background(), m.network, m.address)
+	c.hooks = m.hooks
+	return c, err
+}
+
+// Send a command to the Redis server and receive its reply
+//
+// It is safe to call Send from multiple goroutines.
+func (m *MuxClient) Send(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Must write at least one argument")
+	}
+
+	cmd := commandName(args)
+
+	if statefulCommands[cmd] {
+		return nil, ErrStateful
+	}
+
+	if blockingCommands[cmd] || isBlockingRead(cmd, args) {
+		var res interface{}
+		err := m.Blocking(func(c *Client) (err error) {
+			res, err = c.Send(args...)
+			return
+		})
+		return res, err
+	}
+
+	return m.hooks.send(context.Background(), args, func() (interface{}, error) {
+		return m.send(args)
+	})
+}
+
+// Send a command over the shared connection
+func (m *MuxClient) send(args []interface{}) (interface{}, error) {
+	req, err := gedis.EncodeCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &call{req: req, done: make(chan struct{})}
+
+	select {
+	case m.queue <- c:
+	case <-m.done:
+		return nil, m.err
+	}
+
+	<-c.done
+
+	return c.reply, c.err
+}
+
+// Goroutine that coalesces queued commands into a single write
+func (m *MuxClient) writeLoop() {
+	defer m.wg.Done()
+
+	var buf []byte
+	batch := make([]*call, 0, muxBatchSize)
+
+	for {
+		select {
+		case c := <-m.queue:
+			batch = append(batch, c)
+		case <-m.done:
+			return
+		}
+
+	collect:
+		for len(batch) < muxBatchSize {
+			select {
+			case c := <-m.queue:
+				batch = append(batch, c)
+			default:
+				break collect
+			}
+		}
+
+		buf = buf[:0]
+		for i, c := range batch {
+			select {
+			case m.pending <- c:
+				buf = append(buf, c.req...)
+			case <-m.done:
+				for _, c := range batch[i:] {
+					c.finish(nil, m.err)
+				}
+				return
+			}
+		}
+		batch = batch[:0]
+
+		if _, err := m.conn.Write(buf); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// Goroutine that reads replies and hands them to their callers
+func (m *MuxClient) readLoop() {
+	defer m.wg.Done()
+
+	r := bufio.NewReader(m.conn)
+
+	for {
+		var c *call
+
+		select {
+		case c = <-m.pending:
+		case <-m.done:
+			return
+		}
+
+		reply, err := gedis.Read(r)
+		if _, ok := err.(gedis.Error); err != nil && !ok {
+			m.fail(err)
+			c.finish(nil, m.err)
+			return
+		}
+
+		c.finish(reply, err)
+	}
+}
+
+// Stop processing commands, making every pending call fail with err
+func (m *MuxClient) fail(err error) {
+	m.once.Do(func() {
+		m.err = err
+		close(m.done)
+		m.conn.Close()
+
+		go func() {
+			m.wg.Wait()
+			for {
+				select {
+				case c := <-m.pending:
+					c.finish(nil, m.err)
+				default:
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (c *call) finish(reply interface{}, err error) {
+	c.reply, c.err = reply, err
+	close(c.done)
+}
+
+// Returns the upper-cased name of the command
+func commandName(args []interface{}) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	switch cmd := args[0].(type) {
+	case string:
+		return strings.ToUpper(cmd)
+	case []byte:
+		return strings.ToUpper(string(cmd))
+	}
+	return ""
+}
+
+// Whether the command is an XREAD or XREADGROUP with the BLOCK option
+func isBlockingRead(cmd string, args []interface{}) bool {
+	if cmd != "XREAD" && cmd != "XREADGROUP" {
+		return false
+	}
+
+	for _, arg := range args[1:] {
+		if s, ok := arg.(string); ok && strings.EqualFold(s, "BLOCK") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,264 @@
+package client
+
+import (
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/internal/redistest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMuxClient_concurrent(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				msg := fmt.Sprintf("%d:%d", i, j)
+
+				res, err := m.Send("ECHO", msg)
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				if res != msg {
+					t.Errorf("Expected %q, got %#v", msg, res)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestMuxClient_errorReply(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	_, err = m.Send("NOSUCHCOMMAND")
+	if _, ok := err.(gedis.Error); !ok {
+		t.Fatalf("Expected a gedis.Error, got %#v", err)
+	}
+
+	// The connection must still be usable
+	res, err := m.Send("PING")
+	notErr(t, err)
+	if res != gedis.Status("PONG") {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+}
+
+func TestMuxClient_arguments(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	_, err = m.Send("SET", key, 3.5)
+	notErr(t, err)
+
+	res, err := m.Send("GET", key)
+	notErr(t, err)
+	if res != "3.5" {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	if _, err = m.Send("SET", key, struct{}{}); err == nil {
+		t.Fatal("Expected error for unsupported argument")
+	}
+}
+
+func TestMuxClient_blocking(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	blocked := make(chan error)
+
+	go func() {
+		_, err := m.Send("BLPOP", "list", "0.2")
+		blocked <- err
+	}()
+
+	// Give BLPOP the chance to be sent first
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	_, err = m.Send("PING")
+	notErr(t, err)
+
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("PING waited for BLPOP: %v", d)
+	}
+
+	notErr(t, <-blocked)
+}
+
+func TestMuxClient_stateful(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	if _, err = m.Send("watch", "key"); err != ErrStateful {
+		t.Fatalf("Expected ErrStateful, got %#v", err)
+	}
+
+	c, err := m.Dedicated()
+	notErr(t, err)
+	defer c.Close()
+
+	_, err = c.Send("PING")
+	notErr(t, err)
+}
+
+func TestMuxClient_Watch(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	incr := func(c *Client) (interface{}, error) {
+		c.Send("MULTI")
+		c.Send("INCRBY", "balance", 10)
+		return c.Send("EXEC")
+	}
+
+	err = m.Watch(func(c *Client) error {
+		res, err := incr(c)
+		if !reflect.DeepEqual(res, []interface{}{int64(10)}) {
+			t.Errorf("Unexpected %#v, %v", res, err)
+		}
+		return err
+	}, "balance")
+	notErr(t, err)
+
+	// A write from someone else aborts the transaction
+	err = m.Watch(func(c *Client) error {
+		if _, err := m.Send("SET", "balance", 0); err != nil {
+			return err
+		}
+		res, err := incr(c)
+		if res != nil {
+			t.Errorf("Expected the transaction to be aborted, got %#v", res)
+		}
+		return err
+	}, "balance")
+	notErr(t, err)
+
+	// An unfinished transaction doesn't stay on the connection
+	m.Watch(func(c *Client) error {
+		_, err := c.Send("MULTI")
+		return err
+	})
+
+	err = m.Watch(func(c *Client) error {
+		res, err := c.Send("GET", "balance")
+		if res != "0" {
+			t.Errorf("Unexpected %#v, %v", res, err)
+		}
+		return err
+	})
+	notErr(t, err)
+}
+
+func TestMuxClient_Subscribe(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+	defer m.Close()
+
+	sub, err := m.Subscribe("news")
+	notErr(t, err)
+	defer sub.Close()
+
+	if n := s.Publish("news", "lorem"); n != 1 {
+		t.Fatalf("Unexpected receivers: %d", n)
+	}
+
+	msg, err := sub.Receive()
+	notErr(t, err)
+	if msg != (Message{Channel: "news", Payload: "lorem"}) {
+		t.Fatalf("Unexpected message: %#v", msg)
+	}
+
+	notErr(t, sub.PSubscribe("sport.*"))
+
+	for i := 0; ; i++ {
+		res, err := m.Send("PUBSUB", "NUMPAT")
+		notErr(t, err)
+		if res == int64(1) {
+			break
+		}
+		if i == 100 {
+			t.Fatal("The pattern wasn't subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res, err := m.Send("PUBLISH", "sport.tennis", "ipsum"); res != int64(1) {
+		t.Fatalf("Unexpected %#v, %v", res, err)
+	}
+
+	msg, err = sub.Receive()
+	notErr(t, err)
+	if msg != (Message{"sport.*", "sport.tennis", "ipsum"}) {
+		t.Fatalf("Unexpected message: %#v", msg)
+	}
+
+	notErr(t, sub.Close())
+
+	if _, err = m.Subscribe(); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestMuxClient_Close(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	m, err := DialMux("tcp", s.Addr())
+	notErr(t, err)
+
+	m.Close()
+
+	if _, err = m.Send("PING"); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %#v", err)
+	}
+}
+
+func BenchmarkMuxClient(b *testing.B) {
+	s := redistest.NewServer(b)
+
+	m, err := DialMux("tcp", s.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.Send("PING")
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"github.com/inkel/gedis"
+	"time"
+)
+
+// A sequence of commands sent to the Redis server in a single write
+//
+// Replies are read once all the commands have been written, saving a
+// round trip per command.
+type Pipeline struct {
+	c    *Client
+	cmds []*Cmd
+}
+
+// Start a new pipeline on the client
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Queue a command to be sent when the pipeline is executed
+//
+// The returned Cmd holds the reply once Exec returns.
+func (p *Pipeline) Send(args ...interface{}) *Cmd {
+	cmd := &Cmd{Name: commandName(args), Args: args}
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// Send all the queued commands and read their replies
+//
+// Error replies are stored in the Err field of their Cmd; the
+// returned error is only set when the commands couldn't be sent or
+// their replies couldn't be read. The pipeline is empty afterwards and
+// can be reused.
+func (p *Pipeline) Exec() ([]*Cmd, error) {
+	return p.exec(context.Background())
+}
+
+// Execute the pipeline like Exec, passing ctx to the hooks
+//
+// If ctx is done before every reply arrives the connection is closed,
+// and the Client can't be used anymore.
+func (p *Pipeline) ExecContext(ctx context.Context) (cmds []*Cmd, err error) {
+	ctxErr := p.c.watchContext(ctx, func() {
+		cmds, err = p.exec(ctx)
+	})
+	if ctxErr != nil {
+		return cmds, ctxErr
+	}
+	return
+}
+
+func (p *Pipeline) exec(ctx context.Context) ([]*Cmd, error) {
+	cmds := p.cmds
+	p.cmds = nil
+
+	if len(cmds) == 0 {
+		return cmds, nil
+	}
+
+	err := p.c.hooks.runPipeline(ctx, cmds, func() error {
+		return p.c.exec(cmds)
+	})
+
+	return cmds, err
+}
+
+func (c *Client) exec(cmds []*Cmd) error {
+	var buf []byte
+
+	for _, cmd := range cmds {
+		bs, err := gedis.EncodeCommand(cmd.Args...)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, bs...)
+	}
+
+	start := time.Now()
+
+	c.setWriteDeadline()
+
+	if _, err := c.conn.Write(buf); err != nil {
+		return err
+	}
+
+	c.setReadDeadline(0)
+
+	for _, cmd := range cmds {
+		cmd.Reply, cmd.Err = gedis.Read(c.r)
+		if _, ok := cmd.Err.(gedis.Error); cmd.Err != nil && !ok {
+			return cmd.Err
+		}
+		cmd.Duration = time.Since(start)
+	}
+
+	return nil
+}
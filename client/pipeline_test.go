@@ -0,0 +1,52 @@
+package client
+
+import (
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/internal/redistest"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	p := c.Pipeline()
+	set := p.Send("SET", key, "lorem")
+	get := p.Send("GET", key)
+	bad := p.Send("NOSUCHCOMMAND")
+	incr := p.Send("INCR", key+":n")
+
+	cmds, err := p.Exec()
+	notErr(t, err)
+
+	if len(cmds) != 4 {
+		t.Fatalf("Expected 4 commands, got %d", len(cmds))
+	}
+
+	if set.Reply != gedis.Status("OK") || set.Err != nil {
+		t.Fatalf("Unexpected: %#v", set)
+	}
+
+	if get.Reply != "lorem" || get.Name != "GET" {
+		t.Fatalf("Unexpected: %#v", get)
+	}
+
+	if _, ok := bad.Err.(gedis.Error); !ok {
+		t.Fatalf("Unexpected: %#v", bad)
+	}
+
+	if incr.Reply != int64(1) {
+		t.Fatalf("Unexpected: %#v", incr)
+	}
+
+	// The pipeline can be reused
+	p.Send("PING")
+	cmds, err = p.Exec()
+	notErr(t, err)
+	if len(cmds) != 1 || cmds[0].Reply != gedis.Status("PONG") {
+		t.Fatalf("Unexpected: %#v", cmds)
+	}
+}
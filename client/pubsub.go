@@ -0,0 +1,119 @@
+package client
+
+import (
+	"fmt"
+	"github.com/inkel/gedis"
+)
+
+// A message published to a channel
+type Message struct {
+	// Pattern the channel matched, for messages received through
+	// PSubscribe
+	Pattern string
+	Channel string
+	Payload string
+}
+
+// Receives the messages published to the channels and patterns it's
+// subscribed to
+//
+// A subscription takes over its connection, so it's never shared
+// with other commands. Receive must be called from a single goroutine,
+// but the subscriptions can be changed from any other one.
+type Subscription struct {
+	c *Client
+}
+
+// Subscribe to channels on a connection of its own
+func (m *MuxClient) Subscribe(channels ...string) (*Subscription, error) {
+	return m.subscribe("SUBSCRIBE", channels)
+}
+
+// Subscribe to the channels matching patterns on a connection of its
+// own
+func (m *MuxClient) PSubscribe(patterns ...string) (*Subscription, error) {
+	return m.subscribe("PSUBSCRIBE", patterns)
+}
+
+func (m *MuxClient) subscribe(cmd string, names []string) (*Subscription, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("gedis: %s needs at least one channel", cmd)
+	}
+
+	c, err := m.Dedicated()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.write(blockingArgs(cmd, names)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Nothing is published to the connection before every subscription
+	// is confirmed
+	c.setReadDeadline(0)
+	for range names {
+		if _, err = gedis.Read(c.r); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return &Subscription{&c}, nil
+}
+
+// Subscribe to more channels
+func (s *Subscription) Subscribe(channels ...string) error {
+	return s.c.write(blockingArgs("SUBSCRIBE", channels))
+}
+
+// Subscribe to more patterns
+func (s *Subscription) PSubscribe(patterns ...string) error {
+	return s.c.write(blockingArgs("PSUBSCRIBE", patterns))
+}
+
+// Unsubscribe from channels, or from all of them if none is given
+func (s *Subscription) Unsubscribe(channels ...string) error {
+	return s.c.write(blockingArgs("UNSUBSCRIBE", channels))
+}
+
+// Unsubscribe from patterns, or from all of them if none is given
+func (s *Subscription) PUnsubscribe(patterns ...string) error {
+	return s.c.write(blockingArgs("PUNSUBSCRIBE", patterns))
+}
+
+// Wait for the next message
+//
+// Confirmations of changes to the subscriptions are skipped.
+func (s *Subscription) Receive() (Message, error) {
+	for {
+		res, err := s.c.Read()
+		if err != nil {
+			return Message{}, err
+		}
+
+		msg, ok := res.([]interface{})
+		if !ok || len(msg) < 3 {
+			return Message{}, fmt.Errorf("gedis: unexpected pub/sub reply: %#v", res)
+		}
+
+		switch kind, _ := msg[0].(string); {
+		case kind == "message":
+			channel, _ := msg[1].(string)
+			payload, _ := msg[2].(string)
+			return Message{Channel: channel, Payload: payload}, nil
+
+		case kind == "pmessage" && len(msg) == 4:
+			pattern, _ := msg[1].(string)
+			channel, _ := msg[2].(string)
+			payload, _ := msg[3].(string)
+			return Message{pattern, channel, payload}, nil
+		}
+	}
+}
+
+// Close the connection, and with it every subscription
+func (s *Subscription) Close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,455 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/inkel/gedis"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy used by a ReplicaClient to choose which replica serves a
+// read-only command
+type ReadPolicy int
+
+const (
+	// Cycle through the healthy replicas
+	RoundRobin ReadPolicy = iota
+	// Use the healthy replica that answered the last health check the
+	// fastest
+	LowestLatency
+	// Pick a healthy replica at random
+	RandomReplica
+)
+
+// Commands known to be read-only, used until the command table is
+// loaded from the server with LoadCommands
+var readOnlyCommands = map[string]bool{
+	"BITCOUNT":         true,
+	"BITPOS":           true,
+	"DBSIZE":           true,
+	"DUMP":             true,
+	"EXISTS":           true,
+	"GEODIST":          true,
+	"GEOHASH":          true,
+	"GEOPOS":           true,
+	"GEOSEARCH":        true,
+	"GET":              true,
+	"GETBIT":           true,
+	"GETRANGE":         true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"HRANDFIELD":       true,
+	"HSCAN":            true,
+	"HSTRLEN":          true,
+	"HVALS":            true,
+	"KEYS":             true,
+	"LINDEX":           true,
+	"LLEN":             true,
+	"LPOS":             true,
+	"LRANGE":           true,
+	"MGET":             true,
+	"PTTL":             true,
+	"RANDOMKEY":        true,
+	"SCAN":             true,
+	"SCARD":            true,
+	"SDIFF":            true,
+	"SINTER":           true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"SMISMEMBER":       true,
+	"SRANDMEMBER":      true,
+	"SSCAN":            true,
+	"STRLEN":           true,
+	"SUNION":           true,
+	"TTL":              true,
+	"TYPE":             true,
+	"XLEN":             true,
+	"XRANGE":           true,
+	"XREVRANGE":        true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZLEXCOUNT":        true,
+	"ZMSCORE":          true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCAN":            true,
+	"ZSCORE":           true,
+}
+
+// Maximum number of idle connections kept to each server of a
+// ReplicaClient or a Ring
+const nodeMaxIdle = 8
+
+// The connections to a single server of a ReplicaClient or a Ring
+type node struct {
+	network string
+	address string
+
+	mu     sync.Mutex
+	idle   []*Client
+	closed bool
+	// Run around the dials of new connections
+	hooks hooks
+
+	down int32
+	// Latency of the last health check, in nanoseconds
+	latency int64
+}
+
+// Send a command on an idle connection, dialing a new one if there
+// are none
+//
+// The lock is only held to take the connection and to put it back,
+// so commands sent concurrently don't wait for each other's round
+// trip. Network errors close the connection and mark the node as
+// down.
+//
+// Commands that change the state of the connection return ErrStateful,
+// as that state would stay with the connection once back in the pool.
+func (n *node) send(args []interface{}) (interface{}, error) {
+	if statefulCommands[commandName(args)] {
+		return nil, ErrStateful
+	}
+
+	c, err := n.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Send(args...)
+	if _, ok := err.(gedis.Error); err != nil && !ok {
+		c.Close()
+		atomic.StoreInt32(&n.down, 1)
+	} else {
+		n.put(c)
+	}
+
+	return res, err
+}
+
+func (n *node) get() (*Client, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if k := len(n.idle); k > 0 {
+		c := n.idle[k-1]
+		n.idle = n.idle[:k-1]
+		n.mu.Unlock()
+		return c, nil
+	}
+	hs := n.hooks
+	n.mu.Unlock()
+
+	c, err := hs.dial(context.Background(), n.network, n.address)
+	if err != nil {
+		atomic.StoreInt32(&n.down, 1)
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (n *node) put(c *Client) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed || len(n.idle) >= nodeMaxIdle {
+		c.Close()
+		return
+	}
+
+	n.idle = append(n.idle, c)
+}
+
+func (n *node) setHooks(hs hooks) {
+	n.mu.Lock()
+	n.hooks = hs
+	n.mu.Unlock()
+}
+
+func (n *node) healthy() bool {
+	return atomic.LoadInt32(&n.down) == 0
+}
+
+// Send a PING, updating the health and latency of the node
+func (n *node) check() bool {
+	start := time.Now()
+	if _, err := n.send([]interface{}{"PING"}); err != nil {
+		return false
+	}
+	atomic.StoreInt64(&n.latency, int64(time.Since(start)))
+	atomic.StoreInt32(&n.down, 0)
+	return true
+}
+
+func (n *node) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.closed = true
+	for _, c := range n.idle {
+		c.Close()
+	}
+	n.idle = nil
+}
+
+// A client that sends write commands to a primary server and
+// read-only commands to its replicas
+//
+// Replicas are chosen according to a ReadPolicy among those that
+// are healthy. A replica that fails is marked as down until it
+// answers a health check; when no replica is healthy, reads are sent
+// to the primary.
+//
+// It is safe to call Send from multiple goroutines.
+type ReplicaClient struct {
+	primary  *node
+	replicas []*node
+	policy   ReadPolicy
+
+	next uint32
+
+	mu       sync.RWMutex
+	readOnly map[string]bool
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	hooks hooks
+}
+
+// Connect to a primary Redis server and its replicas
+//
+// Only the primary has to be reachable; replicas that can't be dialed
+// are marked as down. If interval is greater than zero, every replica
+// is health checked with PING at that interval.
+func DialReplicas(network, primary string, replicas []string, policy ReadPolicy, interval time.Duration) (*ReplicaClient, error) {
+	r := &ReplicaClient{
+		primary:  &node{network: network, address: primary},
+		policy:   policy,
+		readOnly: readOnlyCommands,
+		done:     make(chan struct{}),
+	}
+
+	c, err := Dial(network, primary)
+	if err != nil {
+		return nil, err
+	}
+	r.primary.idle = []*Client{&c}
+
+	for _, address := range replicas {
+		n := &node{network: network, address: address}
+		n.check()
+		r.replicas = append(r.replicas, n)
+	}
+
+	if interval > 0 {
+		r.wg.Add(1)
+		go r.healthLoop(interval)
+	}
+
+	return r, nil
+}
+
+// Close the connections to all the servers
+//
+// Commands sent afterwards fail with ErrClosed. Calling Close more
+// than once has no effect.
+func (r *ReplicaClient) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+
+		r.primary.close()
+		for _, n := range r.replicas {
+			n.close()
+		}
+	})
+
+	return nil
+}
+
+// Add a hook that runs around every command sent from now on, and
+// around the dials of new connections
+//
+// A read retried on the primary runs the command hooks once. AddHook
+// must not be called while other goroutines use the ReplicaClient.
+func (r *ReplicaClient) AddHook(h Hook) {
+	r.hooks = append(r.hooks, h)
+
+	r.primary.setHooks(r.hooks)
+	for _, n := range r.replicas {
+		n.setHooks(r.hooks)
+	}
+}
+
+// Send a command to the primary or one of the replicas, depending on
+// whether the command is read-only
+//
+// A read that fails because of a network error is retried on the
+// primary. Commands that change the state of the connection, like
+// MULTI or SELECT, return ErrStateful; send them through a Client
+// obtained with Dedicated.
+func (r *ReplicaClient) Send(args ...interface{}) (interface{}, error) {
+	return r.hooks.send(context.Background(), args, func() (interface{}, error) {
+		return r.send(args)
+	})
+}
+
+func (r *ReplicaClient) send(args []interface{}) (interface{}, error) {
+	if !r.IsReadOnly(commandName(args)) {
+		return r.primary.send(args)
+	}
+
+	if n := r.pick(); n != nil {
+		res, err := n.send(args)
+		if _, ok := err.(gedis.Error); err == nil || ok {
+			return res, err
+		}
+	}
+
+	return r.primary.send(args)
+}
+
+// Open a new connection to the primary server, with the hooks of the
+// ReplicaClient
+//
+// The returned Client isn't shared with anyone else, and it's the
+// caller's responsibility to close it.
+func (r *ReplicaClient) Dedicated() (Client, error) {
+	c, err := r.hooks.dial(context.Background(), r.primary.network, r.primary.address)
+	c.hooks = r.hooks
+	return c, err
+}
+
+// Whether the command can be sent to a replica
+func (r *ReplicaClient) IsReadOnly(cmd string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.readOnly[strings.ToUpper(cmd)]
+}
+
+// Replace the built-in command table with the one reported by the
+// primary server with COMMAND
+//
+// Commands flagged as readonly are sent to replicas.
+func (r *ReplicaClient) LoadCommands() error {
+	res, err := r.primary.send([]interface{}{"COMMAND"})
+	if err != nil {
+		return err
+	}
+
+	infos, ok := res.([]interface{})
+	if !ok {
+		return errors.New("gedis: unexpected COMMAND reply")
+	}
+
+	readOnly := make(map[string]bool)
+
+	for _, info := range infos {
+		info, ok := info.([]interface{})
+		if !ok || len(info) < 3 {
+			continue
+		}
+
+		name, ok := info[0].(string)
+		if !ok {
+			continue
+		}
+
+		flags, _ := info[2].([]interface{})
+		for _, flag := range flags {
+			if flag == gedis.Status("readonly") || flag == "readonly" {
+				readOnly[strings.ToUpper(name)] = true
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.readOnly = readOnly
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Health check every replica
+//
+// This is done periodically when an interval is given to
+// DialReplicas.
+func (r *ReplicaClient) CheckHealth() {
+	var wg sync.WaitGroup
+
+	for _, n := range r.replicas {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			n.check()
+		}(n)
+	}
+
+	wg.Wait()
+}
+
+func (r *ReplicaClient) healthLoop(interval time.Duration) {
+	defer r.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.CheckHealth()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Choose a healthy replica according to the policy, or nil if there
+// are none
+func (r *ReplicaClient) pick() *node {
+	var healthy []*node
+	for _, n := range r.replicas {
+		if n.healthy() {
+			healthy = append(healthy, n)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch r.policy {
+	case LowestLatency:
+		best := healthy[0]
+		for _, n := range healthy[1:] {
+			if atomic.LoadInt64(&n.latency) < atomic.LoadInt64(&best.latency) {
+				best = n
+			}
+		}
+		return best
+	case RandomReplica:
+		return healthy[rand.Intn(len(healthy))]
+	}
+
+	i := atomic.AddUint32(&r.next, 1)
+	return healthy[int(i)%len(healthy)]
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/internal/redistest"
+	"github.com/inkel/gedis/server"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplicaClient(t *testing.T) {
+	primary := redistest.NewServer(t)
+	replica := redistest.NewServer(t)
+
+	replica.Set(key, "replica")
+
+	r, err := DialReplicas("tcp", primary.Addr(), []string{replica.Addr()}, RoundRobin, 0)
+	notErr(t, err)
+	defer r.Close()
+
+	_, err = r.Send("SET", key, "primary")
+	notErr(t, err)
+
+	if v, _ := primary.Get(key); v != "primary" {
+		t.Fatalf("SET wasn't sent to the primary: %#v", v)
+	}
+
+	res, err := r.Send("get", key)
+	notErr(t, err)
+	if res != "replica" {
+		t.Fatalf("GET wasn't sent to the replica: %#v", res)
+	}
+
+	// Reads fall back to the primary when the replica is down
+	replica.Close()
+
+	res, err = r.Send("GET", key)
+	notErr(t, err)
+	if res != "primary" {
+		t.Fatalf("GET wasn't sent to the primary: %#v", res)
+	}
+
+	res, err = r.Send("GET", key)
+	notErr(t, err)
+	if res != "primary" {
+		t.Fatalf("GET wasn't sent to the primary: %#v", res)
+	}
+}
+
+func TestReplicaClient_policies(t *testing.T) {
+	primary := redistest.NewServer(t)
+	a := redistest.NewServer(t)
+	b := redistest.NewServer(t)
+
+	a.Set(key, "a")
+	b.Set(key, "b")
+
+	replicas := []string{a.Addr(), b.Addr()}
+
+	r, err := DialReplicas("tcp", primary.Addr(), replicas, RoundRobin, 0)
+	notErr(t, err)
+	defer r.Close()
+
+	seen := make(map[interface{}]bool)
+	for i := 0; i < 4; i++ {
+		res, err := r.Send("GET", key)
+		notErr(t, err)
+		seen[res] = true
+	}
+
+	if !seen["a"] || !seen["b"] {
+		t.Fatalf("Round robin didn't use every replica: %v", seen)
+	}
+
+	l, err := DialReplicas("tcp", primary.Addr(), replicas, LowestLatency, 0)
+	notErr(t, err)
+	defer l.Close()
+
+	// Fake the latencies measured by the health check
+	l.replicas[0].latency = 10
+	l.replicas[1].latency = 5
+
+	res, err := l.Send("GET", key)
+	notErr(t, err)
+	if res != "b" {
+		t.Fatalf("Expected the fastest replica, got %#v", res)
+	}
+}
+
+func TestReplicaClient_LoadCommands(t *testing.T) {
+	primary := redistest.NewServerWith(t, func(s *redistest.Server) {
+		s.Handle("COMMAND", func(c *server.Client, args [][]byte) error {
+			_, err := c.Write([]byte("*2\r\n" +
+				"*6\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n" +
+				"*6\r\n$3\r\nset\r\n:-3\r\n*1\r\n+write\r\n:1\r\n:1\r\n:1\r\n"))
+			return err
+		})
+	})
+
+	r, err := DialReplicas("tcp", primary.Addr(), nil, RoundRobin, 0)
+	notErr(t, err)
+	defer r.Close()
+
+	if !r.IsReadOnly("GETRANGE") {
+		t.Fatal("GETRANGE should be read-only before loading the command table")
+	}
+
+	notErr(t, r.LoadCommands())
+
+	if !r.IsReadOnly("get") {
+		t.Fatal("GET should be read-only")
+	}
+
+	if r.IsReadOnly("SET") || r.IsReadOnly("GETRANGE") {
+		t.Fatal("Only commands flagged as readonly should be read-only")
+	}
+}
+
+func TestReplicaClient_concurrent(t *testing.T) {
+	primary := redistest.NewServer(t)
+
+	r, err := DialReplicas("tcp", primary.Addr(), nil, RoundRobin, 0)
+	notErr(t, err)
+	defer r.Close()
+
+	blocked := make(chan error)
+	go func() {
+		_, err := r.Send("BLPOP", "nothing", "0.2")
+		blocked <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	_, err = r.Send("PING")
+	notErr(t, err)
+
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("PING waited for BLPOP: %v", d)
+	}
+
+	notErr(t, <-blocked)
+}
+
+func TestReplicaClient_stateful(t *testing.T) {
+	primary := redistest.NewServer(t)
+
+	r, err := DialReplicas("tcp", primary.Addr(), nil, RoundRobin, 0)
+	notErr(t, err)
+	defer r.Close()
+
+	for _, cmd := range [][]interface{}{{"MULTI"}, {"watch", key}, {"SELECT", 1}, {"SUBSCRIBE", "news"}} {
+		if _, err = r.Send(cmd...); err != ErrStateful {
+			t.Fatalf("%v: expected ErrStateful, got %#v", cmd, err)
+		}
+	}
+
+	// Nothing was left on the pooled connection
+	res, err := r.Send("SET", key, "lorem")
+	notErr(t, err)
+	if res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	c, err := r.Dedicated()
+	notErr(t, err)
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("GET", key)
+	res, err = c.Send("EXEC")
+	notErr(t, err)
+	if !reflect.DeepEqual(res, []interface{}{"lorem"}) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
+
+func TestReplicaClient_Close(t *testing.T) {
+	primary := redistest.NewServer(t)
+
+	r, err := DialReplicas("tcp", primary.Addr(), nil, RoundRobin, time.Millisecond)
+	notErr(t, err)
+
+	notErr(t, r.Close())
+	notErr(t, r.Close())
+
+	if _, err = r.Send("PING"); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,578 @@
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by Ring.Send when every shard is down
+var ErrNoShards = errors.New("gedis: no shards available")
+
+// Returned by Ring.Send for commands without keys, which don't belong
+// to any shard
+var ErrNoKey = errors.New("gedis: command has no keys to choose a shard")
+
+// Returned by Ring.Send for scripts and other commands whose keys
+// belong to different shards
+var ErrCrossShard = errors.New("gedis: keys of the command belong to different shards")
+
+// Commands without keys
+var keylessCommands = map[string]bool{
+	"BGSAVE":    true,
+	"CLIENT":    true,
+	"COMMAND":   true,
+	"CONFIG":    true,
+	"DBSIZE":    true,
+	"ECHO":      true,
+	"FLUSHALL":  true,
+	"FLUSHDB":   true,
+	"FUNCTION":  true,
+	"INFO":      true,
+	"KEYS":      true,
+	"LASTSAVE":  true,
+	"PING":      true,
+	"PUBLISH":   true,
+	"PUBSUB":    true,
+	"RANDOMKEY": true,
+	"SAVE":      true,
+	"SCAN":      true,
+	"SCRIPT":    true,
+	"SLOWLOG":   true,
+	"TIME":      true,
+	"WAIT":      true,
+}
+
+// Position of the number of keys of commands that take it before
+// their keys
+var numKeysPositions = map[string]int{
+	"BLMPOP":     2,
+	"BZMPOP":     2,
+	"EVAL":       2,
+	"EVALSHA":    2,
+	"EVALSHA_RO": 2,
+	"EVAL_RO":    2,
+	"FCALL":      2,
+	"FCALL_RO":   2,
+	"LMPOP":      1,
+	"SINTERCARD": 1,
+	"ZDIFF":      1,
+	"ZINTER":     1,
+	"ZINTERCARD": 1,
+	"ZMPOP":      1,
+	"ZUNION":     1,
+}
+
+// Commands with a subcommand or an operation before their first key
+var secondArgKeyCommands = map[string]bool{
+	"BITOP":  true,
+	"MEMORY": true,
+	"OBJECT": true,
+	"XGROUP": true,
+	"XINFO":  true,
+}
+
+// Algorithm used by a Ring to distribute keys among its shards
+type HashFunc int
+
+const (
+	// Consistent hashing with 160 virtual nodes per shard, in the
+	// style of libketama
+	Ketama HashFunc = iota
+	// Highest random weight hashing
+	Rendezvous
+)
+
+// Number of points each shard has in a Ketama ring
+const ketamaPoints = 160
+
+// Number of consecutive failed health checks after which a shard is
+// taken out of the ring
+const ringMaxFailures = 3
+
+// A point of a Ketama ring
+type ringPoint struct {
+	hash uint32
+	node *node
+}
+
+// A client that distributes keys among independent Redis servers using
+// consistent hashing
+//
+// Only the part of a key between the first { and the following } is
+// hashed, if there is such a part and it's not empty, so related keys
+// like {user:1}:name and {user:1}:email end up in the same shard.
+//
+// Shards that fail ringMaxFailures consecutive health checks are taken
+// out of the ring, and their keys are redistributed among the
+// remaining shards until they pass a health check again.
+//
+// MGET, MSET, DEL, UNLINK, EXISTS and TOUCH are split per shard and
+// their replies merged. Any other command is sent to the shard of its
+// keys, which must all be in the same one: usually its first argument
+// after the command name, the keys given to EVAL and EVALSHA, or the
+// streams of XREAD and XREADGROUP. Commands without keys, like PING or
+// EVAL with no keys, return ErrNoKey.
+//
+// It is safe to call Send from multiple goroutines.
+type Ring struct {
+	hash   HashFunc
+	shards []*node
+
+	mu       sync.RWMutex
+	failures map[*node]int
+	live     []*node
+	points   []ringPoint
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	hooks hooks
+}
+
+// Connect to a set of Redis servers and distribute keys among them
+//
+// Servers that can't be dialed start out of the ring. If interval is
+// greater than zero, every shard is health checked with PING at that
+// interval.
+func DialRing(network string, addresses []string, hash HashFunc, interval time.Duration) (*Ring, error) {
+	if len(addresses) == 0 {
+		return nil, ErrNoShards
+	}
+
+	r := &Ring{
+		hash:     hash,
+		failures: make(map[*node]int),
+		done:     make(chan struct{}),
+	}
+
+	for _, address := range addresses {
+		r.shards = append(r.shards, &node{network: network, address: address})
+	}
+
+	// Shards that fail to dial are out from the start
+	for _, n := range r.shards {
+		if !n.check() {
+			r.failures[n] = ringMaxFailures
+		}
+	}
+	r.rebalance()
+
+	if interval > 0 {
+		r.wg.Add(1)
+		go r.healthLoop(interval)
+	}
+
+	return r, nil
+}
+
+// Close the connections to all the shards
+//
+// Commands sent afterwards fail with ErrClosed. Calling Close more
+// than once has no effect.
+func (r *Ring) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+
+		for _, n := range r.shards {
+			n.close()
+		}
+	})
+
+	return nil
+}
+
+// Returns the address of the shard that holds key, or an empty string
+// if every shard is down
+func (r *Ring) Shard(key string) string {
+	if n := r.nodeFor(key); n != nil {
+		return n.address
+	}
+	return ""
+}
+
+// Add a hook that runs around every command sent from now on, and
+// around the dials of new connections
+//
+// Commands split per shard run the command hooks once. AddHook must
+// not be called while other goroutines use the Ring.
+func (r *Ring) AddHook(h Hook) {
+	r.hooks = append(r.hooks, h)
+
+	for _, n := range r.shards {
+		n.setHooks(r.hooks)
+	}
+}
+
+// Send a command to the shard, or shards, holding its keys
+func (r *Ring) Send(args ...interface{}) (interface{}, error) {
+	return r.hooks.send(context.Background(), args, func() (interface{}, error) {
+		return r.send(args)
+	})
+}
+
+func (r *Ring) send(args []interface{}) (interface{}, error) {
+	cmd := commandName(args)
+
+	switch cmd {
+	case "MGET":
+		return r.mget(args)
+	case "MSET":
+		return r.mset(args)
+	case "DEL", "UNLINK", "EXISTS", "TOUCH":
+		return r.count(args)
+	}
+
+	if statefulCommands[cmd] {
+		return nil, ErrStateful
+	}
+
+	keys := keyPositions(cmd, args)
+	if len(keys) == 0 {
+		return nil, ErrNoKey
+	}
+
+	n := r.nodeFor(argString(args[keys[0]]))
+	if n == nil {
+		return nil, ErrNoShards
+	}
+
+	for _, i := range keys[1:] {
+		if r.nodeFor(argString(args[i])) != n {
+			return nil, ErrCrossShard
+		}
+	}
+
+	return n.send(args)
+}
+
+// Returns the positions of the keys of a command in args
+func keyPositions(cmd string, args []interface{}) []int {
+	if keylessCommands[cmd] {
+		return nil
+	}
+
+	if p, ok := numKeysPositions[cmd]; ok {
+		if p >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(argString(args[p]))
+		if err != nil || n < 1 || p+n >= len(args) {
+			return nil
+		}
+		return positions(p+1, n)
+	}
+
+	switch {
+	case cmd == "XREAD" || cmd == "XREADGROUP":
+		// Streams come after STREAMS, followed by as many IDs
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(argString(args[i]), "STREAMS") {
+				return positions(i+1, (len(args)-i-1)/2)
+			}
+		}
+		return nil
+
+	case secondArgKeyCommands[cmd]:
+		if len(args) > 2 {
+			return []int{2}
+		}
+		return nil
+	}
+
+	if len(args) > 1 {
+		return []int{1}
+	}
+	return nil
+}
+
+// Returns n consecutive positions starting at first
+func positions(first, n int) []int {
+	pos := make([]int, n)
+	for i := range pos {
+		pos[i] = first + i
+	}
+	return pos
+}
+
+// Health check every shard, rebalancing the ring if a shard went down
+// or came back
+//
+// This is done periodically when an interval is given to DialRing.
+func (r *Ring) CheckHealth() {
+	results := make([]bool, len(r.shards))
+
+	var wg sync.WaitGroup
+
+	for i, n := range r.shards {
+		wg.Add(1)
+		go func(i int, n *node) {
+			defer wg.Done()
+			results[i] = n.check()
+		}(i, n)
+	}
+
+	wg.Wait()
+
+	r.mu.Lock()
+	changed := false
+	for i, n := range r.shards {
+		before := r.failures[n] < ringMaxFailures
+		if results[i] {
+			r.failures[n] = 0
+		} else if r.failures[n] < ringMaxFailures {
+			r.failures[n]++
+		}
+		if before != (r.failures[n] < ringMaxFailures) {
+			changed = true
+		}
+	}
+	r.mu.Unlock()
+
+	if changed {
+		r.rebalance()
+	}
+}
+
+func (r *Ring) healthLoop(interval time.Duration) {
+	defer r.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.CheckHealth()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Rebuild the ring with the shards that are up
+func (r *Ring) rebalance() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.live = r.live[:0]
+	for _, n := range r.shards {
+		if r.failures[n] < ringMaxFailures {
+			r.live = append(r.live, n)
+		}
+	}
+
+	r.points = r.points[:0]
+	if r.hash != Ketama {
+		return
+	}
+
+	for _, n := range r.live {
+		for i := 0; i < ketamaPoints/4; i++ {
+			digest := md5.Sum([]byte(n.address + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				h := binary.LittleEndian.Uint32(digest[j*4:])
+				r.points = append(r.points, ringPoint{h, n})
+			}
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+func (r *Ring) nodeFor(key string) *node {
+	key = hashTag(key)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.live) == 0 {
+		return nil
+	}
+
+	if r.hash == Rendezvous {
+		var best *node
+		var max uint64
+		for _, n := range r.live {
+			h := fnv.New64a()
+			h.Write([]byte(n.address))
+			h.Write([]byte(key))
+			if w := mix64(h.Sum64()); best == nil || w > max {
+				best, max = n, w
+			}
+		}
+		return best
+	}
+
+	digest := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(digest[:4])
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].node
+}
+
+// Finalizer of MurmurHash3, so weights of similar keys aren't
+// correlated
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Returns the part of key that must be hashed
+func hashTag(key string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+1+e]
+		}
+	}
+	return key
+}
+
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	}
+	return fmt.Sprint(arg)
+}
+
+// Positions of the keys of a multi-key command sent to a shard
+type shardKeys struct {
+	node *node
+	pos  []int
+}
+
+// Group the keys of a command per shard
+//
+// Keys start at args[1] and are step arguments apart.
+func (r *Ring) group(args []interface{}, step int) ([]*shardKeys, error) {
+	var groups []*shardKeys
+	byNode := make(map[*node]*shardKeys)
+
+	for i := 1; i < len(args); i += step {
+		n := r.nodeFor(argString(args[i]))
+		if n == nil {
+			return nil, ErrNoShards
+		}
+
+		g, ok := byNode[n]
+		if !ok {
+			g = &shardKeys{node: n}
+			byNode[n] = g
+			groups = append(groups, g)
+		}
+
+		g.pos = append(g.pos, i)
+	}
+
+	return groups, nil
+}
+
+// Send the part of a multi-key command that belongs to each shard,
+// concurrently, calling merge with each reply
+func (r *Ring) fanOut(args []interface{}, step int, merge func(g *shardKeys, res interface{})) error {
+	groups, err := r.group(args, step)
+	if err != nil {
+		return err
+	}
+
+	replies := make([]interface{}, len(groups))
+	errs := make([]error, len(groups))
+
+	var wg sync.WaitGroup
+
+	for i, g := range groups {
+		sub := []interface{}{args[0]}
+		for _, pos := range g.pos {
+			sub = append(sub, args[pos:pos+step]...)
+		}
+
+		wg.Add(1)
+		go func(i int, g *shardKeys) {
+			defer wg.Done()
+			replies[i], errs[i] = g.node.send(sub)
+		}(i, g)
+	}
+
+	wg.Wait()
+
+	for i, g := range groups {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		merge(g, replies[i])
+	}
+
+	return nil
+}
+
+func (r *Ring) mget(args []interface{}) (interface{}, error) {
+	res := make([]interface{}, len(args)-1)
+
+	err := r.fanOut(args, 1, func(g *shardKeys, reply interface{}) {
+		values, _ := reply.([]interface{})
+		for i, pos := range g.pos {
+			if i < len(values) {
+				res[pos-1] = values[i]
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (r *Ring) mset(args []interface{}) (interface{}, error) {
+	if len(args)%2 == 0 {
+		return nil, gedis.Error("ERR wrong number of arguments for 'mset' command")
+	}
+
+	err := r.fanOut(args, 2, func(g *shardKeys, reply interface{}) {})
+	if err != nil {
+		return nil, err
+	}
+
+	return gedis.Status("OK"), nil
+}
+
+func (r *Ring) count(args []interface{}) (interface{}, error) {
+	var total int64
+
+	err := r.fanOut(args, 1, func(g *shardKeys, reply interface{}) {
+		if n, ok := reply.(int64); ok {
+			total += n
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return total, nil
+}
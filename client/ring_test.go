@@ -0,0 +1,191 @@
+package client
+
+import (
+	"fmt"
+	"github.com/inkel/gedis/internal/redistest"
+	"testing"
+)
+
+func newRing(t *testing.T, hash HashFunc, n int) (*Ring, map[string]*redistest.Server) {
+	servers := make(map[string]*redistest.Server)
+	var addresses []string
+
+	for i := 0; i < n; i++ {
+		s := redistest.NewServer(t)
+		servers[s.Addr()] = s
+		addresses = append(addresses, s.Addr())
+	}
+
+	r, err := DialRing("tcp", addresses, hash, 0)
+	notErr(t, err)
+	t.Cleanup(func() { r.Close() })
+
+	return r, servers
+}
+
+func testRing(t *testing.T, hash HashFunc) {
+	r, servers := newRing(t, hash, 3)
+
+	used := make(map[string]bool)
+
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key:%d", i)
+
+		_, err := r.Send("SET", k, i)
+		notErr(t, err)
+
+		shard := r.Shard(k)
+		used[shard] = true
+
+		for address, s := range servers {
+			if s.Exists(k) != (address == shard) {
+				t.Fatalf("%s isn't only in shard %s", k, shard)
+			}
+		}
+
+		res, err := r.Send("GET", k)
+		notErr(t, err)
+		if res != fmt.Sprint(i) {
+			t.Fatalf("Unexpected: %#v", res)
+		}
+	}
+
+	if len(used) != 3 {
+		t.Fatalf("Keys weren't distributed among every shard: %v", used)
+	}
+
+	if r.Shard("{user:1}:name") != r.Shard("{user:1}:email") {
+		t.Fatal("Keys with the same hashtag are in different shards")
+	}
+}
+
+func TestRing_ketama(t *testing.T) {
+	testRing(t, Ketama)
+}
+
+func TestRing_rendezvous(t *testing.T) {
+	testRing(t, Rendezvous)
+}
+
+func TestRing_multiKey(t *testing.T) {
+	r, _ := newRing(t, Ketama, 3)
+
+	res, err := r.Send("MSET", "a", "1", "b", "2", "c", "3", "d", "4")
+	notErr(t, err)
+	if fmt.Sprint(res) != "OK" {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	res, err = r.Send("MGET", "d", "missing", "a", "c", "b")
+	notErr(t, err)
+
+	expected := []interface{}{"4", nil, "1", "3", "2"}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("\nexpected %#v\nreturned %#v", expected, res)
+	}
+
+	res, err = r.Send("DEL", "a", "b", "missing", "c")
+	notErr(t, err)
+	if res != int64(3) {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+}
+
+func TestRing_keys(t *testing.T) {
+	r, servers := newRing(t, Ketama, 3)
+
+	script := NewScript("redis.call('SET', KEYS[1], ARGV[1]) return redis.call('GET', KEYS[2])")
+
+	// Keys in a shard other than the one of the script itself
+	var k string
+	for i := 0; k == "" || r.Shard(k) == r.Shard(script.Hash()); i++ {
+		k = fmt.Sprintf("{key:%d}", i)
+	}
+
+	res, err := script.Run(r, []string{k + ":a", k + ":b"}, "lorem")
+	notErr(t, err)
+	if res != nil {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	if v, _ := servers[r.Shard(k)].Get(k + ":a"); v != "lorem" {
+		t.Fatalf("The script didn't run in the shard of its keys")
+	}
+
+	// Now with EVALSHA
+	res, err = script.Run(r, []string{k + ":b", k + ":a"}, "ipsum")
+	notErr(t, err)
+	if res != "lorem" {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	var other string
+	for i := 0; other == "" || r.Shard(other) == r.Shard(k); i++ {
+		other = fmt.Sprintf("other:%d", i)
+	}
+
+	if _, err = script.Run(r, []string{k, other}, "lorem"); err != ErrCrossShard {
+		t.Fatalf("Expected ErrCrossShard, got %v", err)
+	}
+
+	// Streams come after the group and the options
+	_, err = r.Send("XGROUP", "CREATE", k, "group", "$", "MKSTREAM")
+	notErr(t, err)
+	_, err = r.Send("XADD", k, "*", "n", 1)
+	notErr(t, err)
+
+	res, err = r.Send("XREADGROUP", "GROUP", "group", "consumer", "COUNT", 1, "STREAMS", k, ">")
+	notErr(t, err)
+	if streams, ok := res.([]interface{}); !ok || len(streams) != 1 {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	for _, cmd := range [][]interface{}{{"PING"}, {"EVAL", "return 1", 0}} {
+		if _, err = r.Send(cmd...); err != ErrNoKey {
+			t.Fatalf("%v: expected ErrNoKey, got %v", cmd, err)
+		}
+	}
+
+	if _, err = r.Send("MULTI"); err != ErrStateful {
+		t.Fatalf("Expected ErrStateful, got %v", err)
+	}
+}
+
+func TestRing_rebalance(t *testing.T) {
+	r, servers := newRing(t, Rendezvous, 3)
+
+	var down string
+	for address, s := range servers {
+		down = address
+		s.Close()
+		break
+	}
+
+	// Find a key that belongs to the shard that went down
+	var k string
+	for i := 0; r.Shard(k) != down; i++ {
+		k = fmt.Sprintf("key:%d", i)
+	}
+
+	for i := 0; i < ringMaxFailures; i++ {
+		r.CheckHealth()
+	}
+
+	if shard := r.Shard(k); shard == down || shard == "" {
+		t.Fatalf("%s wasn't moved from the shard that went down: %q", k, shard)
+	}
+
+	_, err := r.Send("SET", k, "lorem")
+	notErr(t, err)
+}
+
+func TestRing_Close(t *testing.T) {
+	r, _ := newRing(t, Ketama, 2)
+
+	notErr(t, r.Close())
+	notErr(t, r.Close())
+
+	if _, err := r.Send("GET", "lorem"); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// A Lua script run on the server with EVALSHA, which only sends the
+// script itself the first time it's run
+type Script struct {
+	src string
+	sha string
+}
+
+// Create a new script from its Lua source
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// Returns the SHA1 digest of the script, as known by the server
+func (s *Script) Hash() string {
+	return s.sha
+}
+
+// Run the script with EVALSHA, falling back to EVAL if the server
+// doesn't have it cached yet
+func (s *Script) Run(c Sender, keys []string, args ...interface{}) (interface{}, error) {
+	res, err := c.Send(s.args("EVALSHA", s.sha, keys, args)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return c.Send(s.args("EVAL", s.src, keys, args)...)
+	}
+	return res, err
+}
+
+func (s *Script) args(cmd, script string, keys []string, args []interface{}) []interface{} {
+	all := make([]interface{}, 0, 3+len(keys)+len(args))
+	all = append(all, cmd, script, len(keys))
+	for _, k := range keys {
+		all = append(all, k)
+	}
+	return append(all, args...)
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"github.com/inkel/gedis/internal/redistest"
+	"reflect"
+	"testing"
+)
+
+func TestScript(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	script := NewScript("return ARGV[1]")
+
+	c, err := Dial("tcp", s.Addr())
+	notErr(t, err)
+	defer c.Close()
+
+	for _, arg := range []string{"lorem", "ipsum"} {
+		res, err := script.Run(&c, []string{key}, arg)
+		notErr(t, err)
+		if res != arg {
+			t.Fatalf("Unexpected: %#v", res)
+		}
+	}
+
+	// The first run falls back to EVAL, which loads the script
+	res, err := c.Send("SCRIPT", "EXISTS", script.Hash())
+	notErr(t, err)
+	if !reflect.DeepEqual(res, []interface{}{int64(1)}) {
+		t.Fatal("The script should have been sent with EVAL")
+	}
+
+	if h := script.Hash(); h != "098e0f0d1448c0a81dafe820f66d460eb09263da" {
+		t.Fatalf("Unexpected hash: %q", h)
+	}
+}
@@ -194,3 +194,13 @@ type Reader interface {
 
 // Type for status replies
 type Status string
+
+// Type for error replies
+//
+// Errors sent by the server are returned as this type, which allows
+// to tell them apart from network or parsing errors.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
@@ -0,0 +1,188 @@
+package redistest
+
+import (
+	"github.com/inkel/gedis"
+	"sort"
+	"strconv"
+)
+
+func init() {
+	addCommands(map[string]command{
+		"HSET":    {fn: hset, arity: -4, write: true},
+		"HMSET":   {fn: hset, arity: -4, write: true},
+		"HGET":    {fn: hget, arity: 3},
+		"HMGET":   {fn: hmget, arity: -3},
+		"HGETALL": {fn: hgetAll, arity: 2},
+		"HKEYS":   {fn: hkeys, arity: 2},
+		"HDEL":    {fn: hdel, arity: -3, write: true},
+		"HEXISTS": {fn: hexists, arity: 3},
+		"HLEN":    {fn: hlen, arity: 2},
+		"HINCRBY": {fn: hincrBy, arity: 4, write: true},
+	})
+}
+
+// Returns the hash stored at key, creating it if asked to
+func (s *Server) hash(key string, create bool) (map[string]string, gedis.Error) {
+	e := s.lookup(key)
+	if e == nil {
+		if !create {
+			return nil, ""
+		}
+		h := make(map[string]string)
+		s.keys[key] = &entry{value: h}
+		return h, ""
+	}
+
+	h, ok := e.value.(map[string]string)
+	if !ok {
+		return nil, errWrongType
+	}
+	return h, ""
+}
+
+func hset(s *Server, args []string) interface{} {
+	if len(args)%2 != 1 {
+		return wrongArity("hset")
+	}
+
+	h, err := s.hash(args[0], true)
+	if err != "" {
+		return err
+	}
+
+	var n int64
+	for i := 1; i < len(args); i += 2 {
+		if _, ok := h[args[i]]; !ok {
+			n++
+		}
+		h[args[i]] = args[i+1]
+	}
+
+	return n
+}
+
+func hget(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+	if v, ok := h[args[1]]; ok {
+		return v
+	}
+	return nil
+}
+
+func hmget(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+
+	res := make([]interface{}, len(args)-1)
+	for i, field := range args[1:] {
+		if v, ok := h[field]; ok {
+			res[i] = v
+		}
+	}
+	return res
+}
+
+// Returns the fields of a hash, sorted so replies are stable
+func sortedFields(h map[string]string) []string {
+	fields := make([]string, 0, len(h))
+	for f := range h {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func hgetAll(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+
+	res := make([]interface{}, 0, 2*len(h))
+	for _, f := range sortedFields(h) {
+		res = append(res, f, h[f])
+	}
+	return res
+}
+
+func hkeys(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+
+	res := make([]interface{}, 0, len(h))
+	for _, f := range sortedFields(h) {
+		res = append(res, f)
+	}
+	return res
+}
+
+func hdel(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+
+	var n int64
+	for _, f := range args[1:] {
+		if _, ok := h[f]; ok {
+			delete(h, f)
+			n++
+		}
+	}
+
+	if h != nil {
+		s.cleanup(args[0], len(h))
+	}
+
+	return n
+}
+
+func hexists(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+	if _, ok := h[args[1]]; ok {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func hlen(s *Server, args []string) interface{} {
+	h, err := s.hash(args[0], false)
+	if err != "" {
+		return err
+	}
+	return int64(len(h))
+}
+
+func hincrBy(s *Server, args []string) interface{} {
+	by, valid := parseInt(args[2])
+	if !valid {
+		return errNotInteger
+	}
+
+	h, err := s.hash(args[0], true)
+	if err != "" {
+		return err
+	}
+
+	var n int64
+	if v, ok := h[args[1]]; ok {
+		if n, valid = parseInt(v); !valid {
+			return gedis.Error("ERR hash value is not an integer")
+		}
+	}
+
+	n += by
+	h[args[1]] = strconv.FormatInt(n, 10)
+
+	return n
+}
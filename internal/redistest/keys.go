@@ -0,0 +1,405 @@
+package redistest
+
+import (
+	"github.com/inkel/gedis"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errSyntax     = gedis.Error("ERR syntax error")
+	errNotInteger = gedis.Error("ERR value is not an integer or out of range")
+	errNotFloat   = gedis.Error("ERR value is not a valid float")
+	statusOK      = gedis.Status("OK")
+)
+
+func init() {
+	addCommands(map[string]command{
+		"PING":     {fn: ping, arity: -1},
+		"ECHO":     {fn: echo, arity: 2},
+		"TIME":     {fn: timeCommand, arity: 1},
+		"SELECT":   {fn: selectDB, arity: 2},
+		"CONFIG":   {fn: config, arity: -2},
+		"FLUSHALL": {fn: flushAll, arity: -1, write: true},
+		"FLUSHDB":  {fn: flushAll, arity: -1, write: true},
+		"DBSIZE":   {fn: dbSize, arity: 1},
+		"DEL":      {fn: del, arity: -2, write: true},
+		"UNLINK":   {fn: del, arity: -2, write: true},
+		"EXISTS":   {fn: exists, arity: -2},
+		"TYPE":     {fn: typeCommand, arity: 2},
+		"EXPIRE":   {fn: expire(time.Second), arity: 3, write: true},
+		"PEXPIRE":  {fn: expire(time.Millisecond), arity: 3, write: true},
+		"PERSIST":  {fn: persist, arity: 2, write: true},
+		"TTL":      {fn: ttl(time.Second), arity: 2},
+		"PTTL":     {fn: ttl(time.Millisecond), arity: 2},
+		"GET":      {fn: get, arity: 2},
+		"GETDEL":   {fn: getDel, arity: 2, write: true},
+		"SET":      {fn: set, arity: -3, write: true},
+		"MGET":     {fn: mget, arity: -2},
+		"MSET":     {fn: mset, arity: -3, write: true},
+		"INCR":     {fn: incrBy(1, 1), arity: 2, write: true},
+		"DECR":     {fn: incrBy(1, -1), arity: 2, write: true},
+		"INCRBY":   {fn: incrBy(0, 1), arity: 3, write: true},
+		"DECRBY":   {fn: incrBy(0, -1), arity: 3, write: true},
+	})
+}
+
+func parseInt(arg string) (int64, bool) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	return n, err == nil
+}
+
+func parseFloat(arg string) (float64, bool) {
+	switch strings.ToLower(arg) {
+	case "+inf", "inf":
+		return math.Inf(1), true
+	case "-inf":
+		return math.Inf(-1), true
+	}
+	f, err := strconv.ParseFloat(arg, 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// Formats a float like Redis does in its replies
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case f == math.Trunc(f) && math.Abs(f) < 1e17:
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Returns the string value of a key
+func (s *Server) str(key string) (string, bool, gedis.Error) {
+	e := s.lookup(key)
+	if e == nil {
+		return "", false, ""
+	}
+	v, ok := e.value.(string)
+	if !ok {
+		return "", false, errWrongType
+	}
+	return v, true, ""
+}
+
+// Remove the key if the collection it holds is empty
+func (s *Server) cleanup(key string, n int) {
+	if n == 0 {
+		delete(s.keys, key)
+	}
+}
+
+func ping(s *Server, args []string) interface{} {
+	switch len(args) {
+	case 0:
+		return gedis.Status("PONG")
+	case 1:
+		return args[0]
+	}
+	return wrongArity("ping")
+}
+
+func echo(s *Server, args []string) interface{} {
+	return args[0]
+}
+
+func timeCommand(s *Server, args []string) interface{} {
+	now := s.now()
+	return []interface{}{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(int64(now.Nanosecond()/1000), 10),
+	}
+}
+
+func selectDB(s *Server, args []string) interface{} {
+	if args[0] != "0" {
+		return gedis.Error("ERR DB index is out of range")
+	}
+	return statusOK
+}
+
+// CONFIG SET parameter value and CONFIG GET parameter, without
+// patterns
+func config(s *Server, args []string) interface{} {
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "SET" && len(args) == 3:
+		s.config[strings.ToLower(args[1])] = args[2]
+		return statusOK
+	case sub == "GET" && len(args) == 2:
+		name := strings.ToLower(args[1])
+		if v, ok := s.config[name]; ok {
+			return []interface{}{name, v}
+		}
+		return []interface{}{}
+	}
+	return gedis.Error("ERR unknown subcommand or wrong number of arguments for '" + args[0] + "'")
+}
+
+func flushAll(s *Server, args []string) interface{} {
+	for key := range s.keys {
+		s.touch(key)
+	}
+	s.keys = make(map[string]*entry)
+	return statusOK
+}
+
+func dbSize(s *Server, args []string) interface{} {
+	var n int64
+	for key := range s.keys {
+		if s.lookup(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func del(s *Server, args []string) interface{} {
+	var n int64
+	for _, key := range args {
+		if s.lookup(key) != nil {
+			delete(s.keys, key)
+			n++
+		}
+	}
+	return n
+}
+
+func exists(s *Server, args []string) interface{} {
+	var n int64
+	for _, key := range args {
+		if s.lookup(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func typeCommand(s *Server, args []string) interface{} {
+	e := s.lookup(args[0])
+	if e == nil {
+		return gedis.Status("none")
+	}
+
+	switch e.value.(type) {
+	case string:
+		return gedis.Status("string")
+	case map[string]string:
+		return gedis.Status("hash")
+	case *list:
+		return gedis.Status("list")
+	case *zset:
+		return gedis.Status("zset")
+	case *stream:
+		return gedis.Status("stream")
+	}
+
+	return gedis.Status("none")
+}
+
+func expire(unit time.Duration) func(s *Server, args []string) interface{} {
+	return func(s *Server, args []string) interface{} {
+		n, valid := parseInt(args[1])
+		if !valid {
+			return errNotInteger
+		}
+
+		e := s.lookup(args[0])
+		if e == nil {
+			return int64(0)
+		}
+
+		if n <= 0 {
+			delete(s.keys, args[0])
+		} else {
+			e.expires = s.now().Add(time.Duration(n) * unit)
+		}
+
+		return int64(1)
+	}
+}
+
+func persist(s *Server, args []string) interface{} {
+	e := s.lookup(args[0])
+	if e == nil || e.expires.IsZero() {
+		return int64(0)
+	}
+	e.expires = time.Time{}
+	return int64(1)
+}
+
+func ttl(unit time.Duration) func(s *Server, args []string) interface{} {
+	return func(s *Server, args []string) interface{} {
+		e := s.lookup(args[0])
+		switch {
+		case e == nil:
+			return int64(-2)
+		case e.expires.IsZero():
+			return int64(-1)
+		}
+
+		ms := int64(e.expires.Sub(s.now()) / time.Millisecond)
+		if unit == time.Second {
+			return (ms + 500) / 1000
+		}
+		return ms
+	}
+}
+
+func get(s *Server, args []string) interface{} {
+	v, found, err := s.str(args[0])
+	if err != "" {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	return v
+}
+
+func getDel(s *Server, args []string) interface{} {
+	res := get(s, args)
+	if _, ok := res.(string); ok {
+		delete(s.keys, args[0])
+	}
+	return res
+}
+
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|KEEPTTL]
+func set(s *Server, args []string) interface{} {
+	key, value := args[0], args[1]
+
+	var (
+		nx, xx, keepTTL, withGet bool
+		expires                  time.Time
+	)
+
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			withGet = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) || !expires.IsZero() {
+				return errSyntax
+			}
+			i++
+			n, valid := parseInt(args[i])
+			if !valid {
+				return errNotInteger
+			}
+			if n <= 0 {
+				return gedis.Error("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			expires = s.now().Add(time.Duration(n) * unit)
+		default:
+			return errSyntax
+		}
+	}
+
+	if (nx && xx) || (keepTTL && !expires.IsZero()) {
+		return errSyntax
+	}
+
+	old, found, err := s.str(key)
+	if withGet && err != "" {
+		return err
+	}
+
+	if (nx && s.lookup(key) != nil) || (xx && s.lookup(key) == nil) {
+		if withGet && found {
+			return old
+		}
+		return nil
+	}
+
+	if keepTTL {
+		if e := s.lookup(key); e != nil {
+			expires = e.expires
+		}
+	}
+
+	s.keys[key] = &entry{value: value, expires: expires}
+
+	if withGet {
+		if found {
+			return old
+		}
+		return nil
+	}
+
+	return statusOK
+}
+
+func mget(s *Server, args []string) interface{} {
+	res := make([]interface{}, len(args))
+	for i, key := range args {
+		if v, found, _ := s.str(key); found {
+			res[i] = v
+		}
+	}
+	return res
+}
+
+func mset(s *Server, args []string) interface{} {
+	if len(args)%2 != 0 {
+		return wrongArity("mset")
+	}
+	for i := 0; i < len(args); i += 2 {
+		s.keys[args[i]] = &entry{value: args[i+1]}
+	}
+	return statusOK
+}
+
+// INCR and DECR with a fixed increment, or INCRBY and DECRBY when by
+// is zero; sign is -1 for the DECR variants
+func incrBy(by, sign int64) func(s *Server, args []string) interface{} {
+	return func(s *Server, args []string) interface{} {
+		incr := by
+		if incr == 0 {
+			n, valid := parseInt(args[1])
+			if !valid {
+				return errNotInteger
+			}
+			incr = n
+		}
+		incr *= sign
+
+		v, found, err := s.str(args[0])
+		if err != "" {
+			return err
+		}
+
+		var n int64
+		if found {
+			var valid bool
+			if n, valid = parseInt(v); !valid {
+				return errNotInteger
+			}
+		}
+
+		n += incr
+
+		if e := s.lookup(args[0]); e != nil {
+			e.value = strconv.FormatInt(n, 10)
+		} else {
+			s.keys[args[0]] = &entry{value: strconv.FormatInt(n, 10)}
+		}
+
+		return n
+	}
+}
@@ -0,0 +1,355 @@
+package redistest
+
+import (
+	"github.com/inkel/gedis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type list struct {
+	items []string
+}
+
+func init() {
+	addCommands(map[string]command{
+		"LPUSH":      {fn: push(true), arity: -3, write: true},
+		"RPUSH":      {fn: push(false), arity: -3, write: true},
+		"LPOP":       {fn: pop(true), arity: -2, write: true},
+		"RPOP":       {fn: pop(false), arity: -2, write: true},
+		"LLEN":       {fn: llen, arity: 2},
+		"LINDEX":     {fn: lindex, arity: 3},
+		"LRANGE":     {fn: lrange, arity: 4},
+		"LREM":       {fn: lrem, arity: 4, write: true},
+		"LMOVE":      {fn: lmove, arity: 5, write: true},
+		"RPOPLPUSH":  {fn: rpoplpush, arity: 3, write: true},
+		"BLPOP":      {fn: bpop(true), arity: -3, write: true, block: lastTimeout},
+		"BRPOP":      {fn: bpop(false), arity: -3, write: true, block: lastTimeout},
+		"BLMOVE":     {fn: blmove, arity: 6, write: true, block: lastTimeout},
+		"BRPOPLPUSH": {fn: brpoplpush, arity: 4, write: true, block: lastTimeout},
+	})
+}
+
+// Timeout of the blocking commands that take it as their last
+// argument, in seconds
+func lastTimeout(args []string) (time.Duration, bool, error) {
+	secs, valid := parseFloat(args[len(args)-1])
+	if !valid || secs < 0 {
+		return 0, false, gedis.Error("ERR timeout is not a float or out of range")
+	}
+	return time.Duration(secs * float64(time.Second)), true, nil
+}
+
+// Returns the list stored at key, creating it if asked to
+func (s *Server) list(key string, create bool) (*list, gedis.Error) {
+	e := s.lookup(key)
+	if e == nil {
+		if !create {
+			return nil, ""
+		}
+		l := &list{}
+		s.keys[key] = &entry{value: l}
+		return l, ""
+	}
+
+	l, ok := e.value.(*list)
+	if !ok {
+		return nil, errWrongType
+	}
+	return l, ""
+}
+
+func push(left bool) func(s *Server, args []string) interface{} {
+	return func(s *Server, args []string) interface{} {
+		l, err := s.list(args[0], true)
+		if err != "" {
+			return err
+		}
+
+		for _, v := range args[1:] {
+			if left {
+				l.items = append([]string{v}, l.items...)
+			} else {
+				l.items = append(l.items, v)
+			}
+		}
+
+		return int64(len(l.items))
+	}
+}
+
+// Remove an element from one end of the list at key
+func (s *Server) popFrom(key string, left bool) (string, bool) {
+	l, _ := s.list(key, false)
+	if l == nil || len(l.items) == 0 {
+		return "", false
+	}
+
+	var v string
+	if left {
+		v, l.items = l.items[0], l.items[1:]
+	} else {
+		v, l.items = l.items[len(l.items)-1], l.items[:len(l.items)-1]
+	}
+
+	s.cleanup(key, len(l.items))
+
+	return v, true
+}
+
+func pop(left bool) func(s *Server, args []string) interface{} {
+	return func(s *Server, args []string) interface{} {
+		if len(args) > 2 {
+			return errSyntax
+		}
+
+		if _, err := s.list(args[0], false); err != "" {
+			return err
+		}
+
+		if len(args) == 1 {
+			if v, ok := s.popFrom(args[0], left); ok {
+				return v
+			}
+			return nil
+		}
+
+		count, valid := parseInt(args[1])
+		if !valid || count < 0 {
+			return gedis.Error("ERR value is out of range, must be positive")
+		}
+
+		if s.lookup(args[0]) == nil {
+			return nullArray{}
+		}
+
+		res := []interface{}{}
+		for i := int64(0); i < count; i++ {
+			v, ok := s.popFrom(args[0], left)
+			if !ok {
+				break
+			}
+			res = append(res, v)
+		}
+		return res
+	}
+}
+
+func llen(s *Server, args []string) interface{} {
+	l, err := s.list(args[0], false)
+	if err != "" {
+		return err
+	}
+	if l == nil {
+		return int64(0)
+	}
+	return int64(len(l.items))
+}
+
+// Converts a start and stop index, which may be negative, to a range
+// of n elements; ok is false for an empty range
+func indexRange(start, stop int64, n int) (int, int, bool) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= int64(n) {
+		stop = int64(n) - 1
+	}
+	if start > stop || start >= int64(n) {
+		return 0, 0, false
+	}
+	return int(start), int(stop), true
+}
+
+func lindex(s *Server, args []string) interface{} {
+	i, valid := parseInt(args[1])
+	if !valid {
+		return errNotInteger
+	}
+
+	l, err := s.list(args[0], false)
+	if err != "" {
+		return err
+	}
+	if l == nil {
+		return nil
+	}
+
+	if i < 0 {
+		i += int64(len(l.items))
+	}
+	if i < 0 || i >= int64(len(l.items)) {
+		return nil
+	}
+	return l.items[i]
+}
+
+func lrange(s *Server, args []string) interface{} {
+	start, valid1 := parseInt(args[1])
+	stop, valid2 := parseInt(args[2])
+	if !valid1 || !valid2 {
+		return errNotInteger
+	}
+
+	l, err := s.list(args[0], false)
+	if err != "" {
+		return err
+	}
+
+	res := []interface{}{}
+	if l == nil {
+		return res
+	}
+
+	if from, to, ok := indexRange(start, stop, len(l.items)); ok {
+		for _, v := range l.items[from : to+1] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func lrem(s *Server, args []string) interface{} {
+	count, valid := parseInt(args[1])
+	if !valid {
+		return errNotInteger
+	}
+
+	l, err := s.list(args[0], false)
+	if err != "" {
+		return err
+	}
+	if l == nil {
+		return int64(0)
+	}
+
+	var removed int64
+	n := len(l.items)
+	keep := make([]bool, n)
+	for i := range keep {
+		keep[i] = true
+	}
+
+	// A negative count removes from the tail
+	for k := 0; k < n; k++ {
+		i := k
+		if count < 0 {
+			i = n - 1 - k
+		}
+		if l.items[i] != args[2] {
+			continue
+		}
+		if count != 0 && removed == abs(count) {
+			break
+		}
+		keep[i] = false
+		removed++
+	}
+
+	items := l.items[:0]
+	for i, v := range l.items {
+		if keep[i] {
+			items = append(items, v)
+		}
+	}
+	l.items = items
+
+	s.cleanup(args[0], len(l.items))
+
+	return removed
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func parseWhere(arg string) (bool, bool) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// Move an element between lists, returning nil if the source is empty
+func (s *Server) move(source, destination string, fromLeft, toLeft bool) interface{} {
+	if _, err := s.list(source, false); err != "" {
+		return err
+	}
+	if _, err := s.list(destination, false); err != "" {
+		return err
+	}
+
+	v, ok := s.popFrom(source, fromLeft)
+	if !ok {
+		return nil
+	}
+
+	push(toLeft)(s, []string{destination, v})
+
+	return v
+}
+
+func lmove(s *Server, args []string) interface{} {
+	from, ok1 := parseWhere(args[2])
+	to, ok2 := parseWhere(args[3])
+	if !ok1 || !ok2 {
+		return errSyntax
+	}
+	return s.move(args[0], args[1], from, to)
+}
+
+func rpoplpush(s *Server, args []string) interface{} {
+	return s.move(args[0], args[1], false, true)
+}
+
+// BLPOP and BRPOP, returning a null array when every list is empty so
+// the caller blocks
+func bpop(left bool) func(s *Server, args []string) interface{} {
+	return func(s *Server, args []string) interface{} {
+		for _, key := range args[:len(args)-1] {
+			if _, err := s.list(key, false); err != "" {
+				return err
+			}
+			if v, ok := s.popFrom(key, left); ok {
+				return []interface{}{key, v}
+			}
+		}
+		return nullArray{}
+	}
+}
+
+func blmove(s *Server, args []string) interface{} {
+	from, ok1 := parseWhere(args[2])
+	to, ok2 := parseWhere(args[3])
+	if !ok1 || !ok2 {
+		return errSyntax
+	}
+	if res := s.move(args[0], args[1], from, to); res != nil {
+		return res
+	}
+	return nullArray{}
+}
+
+func brpoplpush(s *Server, args []string) interface{} {
+	if res := s.move(args[0], args[1], false, true); res != nil {
+		return res
+	}
+	return nullArray{}
+}
+
+// Formats an integer as a bulk string
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
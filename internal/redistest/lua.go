@@ -0,0 +1,1413 @@
+package redistest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A small interpreter for the subset of Lua 5.1 used by Redis scripts
+//
+// It supports local variables, assignments, if, while, repeat, numeric
+// and generic for loops, tables, the arithmetic, comparison, logical,
+// length and concatenation operators, and calls to the builtins set up
+// by the server, like redis.call or tonumber. Scripts can't define
+// functions.
+//
+// The scripts are what most packages are about, so their tests have to
+// run them, and not skip them when there's no Redis around. A complete
+// Lua in Go would be the only dependency outside the standard library.
+
+// A Lua value: nil, bool, float64, string, *table or builtin
+type value interface{}
+
+type builtin func(args []value) []value
+
+type table struct {
+	arr  []value
+	hash map[value]value
+}
+
+func newTable(items ...value) *table {
+	return &table{arr: items}
+}
+
+func (t *table) get(k value) value {
+	if n, ok := k.(float64); ok && n == math.Trunc(n) && n >= 1 && n <= float64(len(t.arr)) {
+		return t.arr[int(n)-1]
+	}
+	if t.hash == nil {
+		return nil
+	}
+	return t.hash[k]
+}
+
+func (t *table) set(k, v value) {
+	if n, ok := k.(float64); ok && n == math.Trunc(n) && n >= 1 {
+		i := int(n)
+		switch {
+		case i <= len(t.arr):
+			t.arr[i-1] = v
+			if v == nil && i == len(t.arr) {
+				for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+					t.arr = t.arr[:len(t.arr)-1]
+				}
+			}
+			return
+		case i == len(t.arr)+1:
+			if v == nil {
+				delete(t.hash, k)
+				return
+			}
+			t.arr = append(t.arr, v)
+			// Move the following keys from the hash part
+			for {
+				next := float64(len(t.arr) + 1)
+				nv, ok := t.hash[next]
+				if !ok {
+					break
+				}
+				t.arr = append(t.arr, nv)
+				delete(t.hash, next)
+			}
+			return
+		}
+	}
+
+	if v == nil {
+		delete(t.hash, k)
+		return
+	}
+	if t.hash == nil {
+		t.hash = make(map[value]value)
+	}
+	t.hash[k] = v
+}
+
+// A runtime error raised by a script
+type luaError struct {
+	line  int
+	msg   string
+	reply interface{}
+}
+
+func (e *luaError) Error() string {
+	return fmt.Sprintf("user_script:%d: %s", e.line, e.msg)
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) {
+	panic(&luaError{line: l.line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *lexer) tokens() []token {
+	var toks []token
+	for {
+		t := l.next()
+		toks = append(toks, t)
+		if t.kind == tokEOF {
+			return toks
+		}
+	}
+}
+
+func (l *lexer) next() token {
+	l.skip()
+
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}
+	}
+
+	c := l.src[l.pos]
+	start := l.pos
+
+	switch {
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if keywords[word] {
+			return token{kind: tokOp, text: word, line: l.line}
+		}
+		return token{kind: tokName, text: word, line: l.line}
+
+	case isDigit(c) || (c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+		return l.number()
+
+	case c == '"' || c == '\'':
+		return token{kind: tokString, text: l.quoted(c), line: l.line}
+
+	case c == '[' && l.longBracket() >= 0:
+		return token{kind: tokString, text: l.long(), line: l.line}
+	}
+
+	for _, op := range []string{"...", "..", "==", "~=", "<=", ">="} {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, line: l.line}
+		}
+	}
+
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", c) >= 0 {
+		l.pos++
+		return token{kind: tokOp, text: string(c), line: l.line}
+	}
+
+	l.errorf("unexpected symbol near '%c'", c)
+	return token{}
+}
+
+// Skip spaces and comments
+func (l *lexer) skip() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if l.pos < len(l.src) && l.src[l.pos] == '[' && l.longBracket() >= 0 {
+				l.long()
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Returns the level of the long bracket at the current position, or -1
+func (l *lexer) longBracket() int {
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1
+	}
+	return -1
+}
+
+func (l *lexer) long() string {
+	level := l.longBracket()
+	l.pos += level + 2
+	if l.pos < len(l.src) && l.src[l.pos] == '\n' {
+		l.line++
+		l.pos++
+	}
+
+	end := "]" + strings.Repeat("=", level) + "]"
+	i := strings.Index(l.src[l.pos:], end)
+	if i < 0 {
+		l.errorf("unfinished long string")
+	}
+
+	s := l.src[l.pos : l.pos+i]
+	l.line += strings.Count(s, "\n")
+	l.pos += i + len(end)
+	return s
+}
+
+func (l *lexer) quoted(quote byte) string {
+	var buf []byte
+	l.pos++
+
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			l.errorf("unfinished string")
+		}
+
+		c := l.src[l.pos]
+		l.pos++
+
+		if c == quote {
+			return string(buf)
+		}
+		if c != '\\' {
+			buf = append(buf, c)
+			continue
+		}
+
+		if l.pos >= len(l.src) {
+			l.errorf("unfinished string")
+		}
+
+		c = l.src[l.pos]
+		l.pos++
+
+		switch c {
+		case 'n':
+			buf = append(buf, '\n')
+		case 't':
+			buf = append(buf, '\t')
+		case 'r':
+			buf = append(buf, '\r')
+		case 'a':
+			buf = append(buf, '\a')
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'v':
+			buf = append(buf, '\v')
+		case '\n':
+			l.line++
+			buf = append(buf, '\n')
+		default:
+			if !isDigit(c) {
+				buf = append(buf, c)
+				continue
+			}
+			n := int(c - '0')
+			for i := 0; i < 2 && l.pos < len(l.src) && isDigit(l.src[l.pos]); i++ {
+				n = n*10 + int(l.src[l.pos]-'0')
+				l.pos++
+			}
+			if n > 255 {
+				l.errorf("escape sequence too large")
+			}
+			buf = append(buf, byte(n))
+		}
+	}
+}
+
+func (l *lexer) number() token {
+	start := l.pos
+
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && isHex(l.src[l.pos]) {
+			l.pos++
+		}
+	} else {
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if isDigit(c) || c == '.' {
+				l.pos++
+			} else if (c == 'e' || c == 'E') && l.pos+1 < len(l.src) {
+				l.pos++
+				if l.src[l.pos] == '+' || l.src[l.pos] == '-' {
+					l.pos++
+				}
+			} else {
+				break
+			}
+		}
+	}
+
+	text := l.src[start:l.pos]
+	n, ok := parseNumber(text)
+	if !ok {
+		l.errorf("malformed number near '%s'", text)
+	}
+
+	return token{kind: tokNumber, num: n, text: text, line: l.line}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Converts a string to a number the way Lua does
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+
+	neg := false
+	hex := s
+	if hex[0] == '-' {
+		neg = true
+		hex = hex[1:]
+	}
+	if strings.HasPrefix(hex, "0x") || strings.HasPrefix(hex, "0X") {
+		n, err := strconv.ParseUint(hex[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+
+	// Go accepts forms Lua doesn't, like underscores or "inf"
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !isDigit(c) && strings.IndexByte(".eE+-", c) < 0 {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Syntax tree
+
+type expr interface{}
+
+type (
+	constExpr struct{ v value }
+	nameExpr  struct{ name string }
+	indexExpr struct{ obj, key expr }
+	callExpr  struct {
+		fn   expr
+		args []expr
+	}
+	parenExpr struct{ e expr }
+	tableExpr struct {
+		items []expr
+		keys  []expr
+		vals  []expr
+	}
+	binaryExpr struct {
+		op          string
+		left, right expr
+	}
+	unaryExpr struct {
+		op string
+		e  expr
+	}
+)
+
+type stmt interface{}
+
+type (
+	localStmt struct {
+		line  int
+		names []string
+		exprs []expr
+	}
+	assignStmt struct {
+		line    int
+		targets []expr
+		exprs   []expr
+	}
+	callStmt struct {
+		line int
+		call *callExpr
+	}
+	ifStmt struct {
+		line   int
+		conds  []expr
+		blocks [][]stmt
+		orElse []stmt
+	}
+	whileStmt struct {
+		line int
+		cond expr
+		body []stmt
+	}
+	repeatStmt struct {
+		line int
+		body []stmt
+		cond expr
+	}
+	numForStmt struct {
+		line              int
+		name              string
+		start, stop, step expr
+		body              []stmt
+	}
+	genForStmt struct {
+		line  int
+		names []string
+		exprs []expr
+		body  []stmt
+	}
+	doStmt struct {
+		line int
+		body []stmt
+	}
+	returnStmt struct {
+		line  int
+		exprs []expr
+	}
+	breakStmt struct {
+		line int
+	}
+)
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// Parse a script into its statements
+func parseLua(src string) (body []stmt, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	l := &lexer{src: src, line: 1}
+	p := &parser{toks: l.tokens()}
+
+	body = p.block()
+	if t := p.peek(); t.kind != tokEOF {
+		p.errorf("'<eof>' expected near '%s'", t.text)
+	}
+
+	return body, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) {
+	panic(&luaError{line: p.peek().line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) advance() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) accept(op string) bool {
+	if p.isOp(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) {
+	if !p.accept(op) {
+		p.errorf("'%s' expected near '%s'", op, p.peek().text)
+	}
+}
+
+func (p *parser) name() string {
+	t := p.advance()
+	if t.kind != tokName {
+		p.pos--
+		p.errorf("<name> expected near '%s'", t.text)
+	}
+	return t.text
+}
+
+// Whether the next token ends a block
+func (p *parser) blockEnd() bool {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return true
+	}
+	if t.kind != tokOp {
+		return false
+	}
+	switch t.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *parser) block() []stmt {
+	var body []stmt
+
+	for !p.blockEnd() {
+		if p.accept(";") {
+			continue
+		}
+
+		s := p.statement()
+		body = append(body, s)
+
+		switch s.(type) {
+		case *returnStmt, *breakStmt:
+			p.accept(";")
+			if !p.blockEnd() {
+				p.errorf("'end' expected near '%s'", p.peek().text)
+			}
+			return body
+		}
+	}
+
+	return body
+}
+
+func (p *parser) statement() stmt {
+	line := p.peek().line
+
+	switch {
+	case p.accept("local"):
+		if p.isOp("function") {
+			p.errorf("functions are not supported")
+		}
+		s := &localStmt{line: line, names: []string{p.name()}}
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+		if p.accept("=") {
+			s.exprs = p.exprList()
+		}
+		return s
+
+	case p.accept("if"):
+		s := &ifStmt{line: line}
+		s.conds = append(s.conds, p.expr())
+		p.expect("then")
+		s.blocks = append(s.blocks, p.block())
+		for {
+			if p.accept("elseif") {
+				s.conds = append(s.conds, p.expr())
+				p.expect("then")
+				s.blocks = append(s.blocks, p.block())
+				continue
+			}
+			if p.accept("else") {
+				s.orElse = p.block()
+			}
+			p.expect("end")
+			return s
+		}
+
+	case p.accept("while"):
+		s := &whileStmt{line: line, cond: p.expr()}
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+
+	case p.accept("repeat"):
+		s := &repeatStmt{line: line, body: p.block()}
+		p.expect("until")
+		s.cond = p.expr()
+		return s
+
+	case p.accept("for"):
+		name := p.name()
+		if p.accept("=") {
+			s := &numForStmt{line: line, name: name, start: p.expr()}
+			p.expect(",")
+			s.stop = p.expr()
+			if p.accept(",") {
+				s.step = p.expr()
+			}
+			p.expect("do")
+			s.body = p.block()
+			p.expect("end")
+			return s
+		}
+		s := &genForStmt{line: line, names: []string{name}}
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+		p.expect("in")
+		s.exprs = p.exprList()
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+
+	case p.accept("do"):
+		s := &doStmt{line: line, body: p.block()}
+		p.expect("end")
+		return s
+
+	case p.accept("return"):
+		s := &returnStmt{line: line}
+		if !p.blockEnd() && !p.isOp(";") {
+			s.exprs = p.exprList()
+		}
+		return s
+
+	case p.accept("break"):
+		return &breakStmt{line: line}
+
+	case p.isOp("function"):
+		p.errorf("functions are not supported")
+	}
+
+	e := p.suffixed()
+
+	if call, ok := e.(*callExpr); ok && !p.isOp("=") && !p.isOp(",") {
+		return &callStmt{line: line, call: call}
+	}
+
+	s := &assignStmt{line: line, targets: []expr{e}}
+	for p.accept(",") {
+		s.targets = append(s.targets, p.suffixed())
+	}
+	for _, t := range s.targets {
+		switch t.(type) {
+		case *nameExpr, *indexExpr:
+		default:
+			p.errorf("syntax error near '%s'", p.peek().text)
+		}
+	}
+	p.expect("=")
+	s.exprs = p.exprList()
+
+	return s
+}
+
+func (p *parser) exprList() []expr {
+	list := []expr{p.expr()}
+	for p.accept(",") {
+		list = append(list, p.expr())
+	}
+	return list
+}
+
+// Left and right priorities of the binary operators
+var binaryPriority = map[string][2]int{
+	"or":  {1, 1},
+	"and": {2, 2},
+	"<":   {3, 3},
+	">":   {3, 3},
+	"<=":  {3, 3},
+	">=":  {3, 3},
+	"~=":  {3, 3},
+	"==":  {3, 3},
+	"..":  {5, 4},
+	"+":   {6, 6},
+	"-":   {6, 6},
+	"*":   {7, 7},
+	"/":   {7, 7},
+	"%":   {7, 7},
+	"^":   {10, 9},
+}
+
+const unaryPriority = 8
+
+func (p *parser) expr() expr {
+	return p.subExpr(0)
+}
+
+func (p *parser) subExpr(limit int) expr {
+	var e expr
+
+	if t := p.peek(); t.kind == tokOp && (t.text == "not" || t.text == "-" || t.text == "#") {
+		p.advance()
+		e = &unaryExpr{op: t.text, e: p.subExpr(unaryPriority)}
+	} else {
+		e = p.simple()
+	}
+
+	for {
+		t := p.peek()
+		prio, ok := binaryPriority[t.text]
+		if t.kind != tokOp || !ok || prio[0] <= limit {
+			return e
+		}
+		p.advance()
+		e = &binaryExpr{op: t.text, left: e, right: p.subExpr(prio[1])}
+	}
+}
+
+func (p *parser) simple() expr {
+	t := p.peek()
+
+	switch t.kind {
+	case tokNumber:
+		p.advance()
+		return &constExpr{t.num}
+	case tokString:
+		p.advance()
+		return &constExpr{t.text}
+	case tokOp:
+		switch t.text {
+		case "nil":
+			p.advance()
+			return &constExpr{nil}
+		case "true":
+			p.advance()
+			return &constExpr{true}
+		case "false":
+			p.advance()
+			return &constExpr{false}
+		case "{":
+			return p.tableConstructor()
+		case "function":
+			p.errorf("functions are not supported")
+		case "...":
+			p.errorf("varargs are not supported")
+		}
+	}
+
+	return p.suffixed()
+}
+
+func (p *parser) suffixed() expr {
+	var e expr
+
+	switch t := p.peek(); {
+	case t.kind == tokName:
+		p.advance()
+		e = &nameExpr{t.text}
+	case p.accept("("):
+		e = &parenExpr{p.expr()}
+		p.expect(")")
+	default:
+		p.errorf("unexpected symbol near '%s'", t.text)
+	}
+
+	for {
+		switch t := p.peek(); {
+		case p.accept("."):
+			e = &indexExpr{e, &constExpr{p.name()}}
+		case p.accept("["):
+			e = &indexExpr{e, p.expr()}
+			p.expect("]")
+		case p.accept(":"):
+			p.errorf("method calls are not supported")
+		case p.accept("("):
+			call := &callExpr{fn: e}
+			if !p.isOp(")") {
+				call.args = p.exprList()
+			}
+			p.expect(")")
+			e = call
+		case t.kind == tokString:
+			p.advance()
+			e = &callExpr{fn: e, args: []expr{&constExpr{t.text}}}
+		case p.isOp("{"):
+			e = &callExpr{fn: e, args: []expr{p.tableConstructor()}}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) tableConstructor() expr {
+	p.expect("{")
+
+	t := &tableExpr{}
+
+	for !p.isOp("}") {
+		switch {
+		case p.accept("["):
+			k := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.keys = append(t.keys, k)
+			t.vals = append(t.vals, p.expr())
+		case p.peek().kind == tokName && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].text == "=":
+			k := p.name()
+			p.expect("=")
+			t.keys = append(t.keys, &constExpr{k})
+			t.vals = append(t.vals, p.expr())
+		default:
+			t.items = append(t.items, p.expr())
+		}
+
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+
+	p.expect("}")
+
+	return t
+}
+
+// Evaluation
+
+type scope struct {
+	vars   map[string]value
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (*scope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+type interpreter struct {
+	globals map[string]value
+	line    int
+	steps   int
+}
+
+// Maximum number of statements a script can run, so a script stuck in
+// a loop fails the test instead of hanging it
+const maxSteps = 10000000
+
+type control int
+
+const (
+	ctrlNone control = iota
+	ctrlBreak
+	ctrlReturn
+)
+
+// Run a parsed script, returning the values it returned
+func (in *interpreter) run(body []stmt) (res []value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	_, res = in.block(body, &scope{vars: map[string]value{}})
+
+	return res, nil
+}
+
+func (in *interpreter) errorf(format string, args ...interface{}) {
+	panic(&luaError{line: in.line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (in *interpreter) block(body []stmt, parent *scope) (control, []value) {
+	sc := &scope{vars: map[string]value{}, parent: parent}
+
+	for _, s := range body {
+		if ctrl, res := in.stmt(s, sc); ctrl != ctrlNone {
+			return ctrl, res
+		}
+	}
+
+	return ctrlNone, nil
+}
+
+func (in *interpreter) stmt(s stmt, sc *scope) (control, []value) {
+	if in.steps++; in.steps > maxSteps {
+		in.errorf("script ran for too long")
+	}
+
+	switch s := s.(type) {
+	case *localStmt:
+		in.line = s.line
+		vals := in.exprList(s.exprs, sc, len(s.names))
+		for i, name := range s.names {
+			sc.vars[name] = vals[i]
+		}
+
+	case *assignStmt:
+		in.line = s.line
+		vals := in.exprList(s.exprs, sc, len(s.targets))
+		for i, t := range s.targets {
+			in.assign(t, vals[i], sc)
+		}
+
+	case *callStmt:
+		in.line = s.line
+		in.call(s.call, sc)
+
+	case *ifStmt:
+		in.line = s.line
+		for i, cond := range s.conds {
+			if truthy(in.eval(cond, sc)) {
+				return in.block(s.blocks[i], sc)
+			}
+		}
+		if s.orElse != nil {
+			return in.block(s.orElse, sc)
+		}
+
+	case *whileStmt:
+		for {
+			in.line = s.line
+			if !truthy(in.eval(s.cond, sc)) {
+				break
+			}
+			ctrl, res := in.block(s.body, sc)
+			if ctrl == ctrlReturn {
+				return ctrl, res
+			}
+			if ctrl == ctrlBreak {
+				break
+			}
+		}
+
+	case *repeatStmt:
+		for {
+			inner := &scope{vars: map[string]value{}, parent: sc}
+			ctrl, res := in.blockIn(s.body, inner)
+			if ctrl == ctrlReturn {
+				return ctrl, res
+			}
+			if ctrl == ctrlBreak {
+				break
+			}
+			in.line = s.line
+			if truthy(in.eval(s.cond, inner)) {
+				break
+			}
+		}
+
+	case *numForStmt:
+		return in.numFor(s, sc)
+
+	case *genForStmt:
+		return in.genFor(s, sc)
+
+	case *doStmt:
+		return in.block(s.body, sc)
+
+	case *returnStmt:
+		in.line = s.line
+		return ctrlReturn, in.exprList(s.exprs, sc, -1)
+
+	case *breakStmt:
+		return ctrlBreak, nil
+	}
+
+	return ctrlNone, nil
+}
+
+// Like block, but running in the given scope
+func (in *interpreter) blockIn(body []stmt, sc *scope) (control, []value) {
+	for _, s := range body {
+		if ctrl, res := in.stmt(s, sc); ctrl != ctrlNone {
+			return ctrl, res
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (in *interpreter) numFor(s *numForStmt, sc *scope) (control, []value) {
+	in.line = s.line
+
+	start, ok1 := toNumber(in.eval(s.start, sc))
+	stop, ok2 := toNumber(in.eval(s.stop, sc))
+	step, ok3 := 1.0, true
+	if s.step != nil {
+		step, ok3 = toNumber(in.eval(s.step, sc))
+	}
+
+	switch {
+	case !ok1:
+		in.errorf("'for' initial value must be a number")
+	case !ok2:
+		in.errorf("'for' limit must be a number")
+	case !ok3:
+		in.errorf("'for' step must be a number")
+	}
+
+	for i := start; (step > 0 && i <= stop) || (step <= 0 && i >= stop); i += step {
+		inner := &scope{vars: map[string]value{s.name: i}, parent: sc}
+		ctrl, res := in.blockIn(s.body, inner)
+		if ctrl == ctrlReturn {
+			return ctrl, res
+		}
+		if ctrl == ctrlBreak {
+			break
+		}
+	}
+
+	return ctrlNone, nil
+}
+
+func (in *interpreter) genFor(s *genForStmt, sc *scope) (control, []value) {
+	in.line = s.line
+
+	vals := in.exprList(s.exprs, sc, 3)
+	fn, ok := vals[0].(builtin)
+	if !ok {
+		in.errorf("attempt to call a %s value", typeName(vals[0]))
+	}
+	state, ctrl := vals[1], vals[2]
+
+	for {
+		res := fn([]value{state, ctrl})
+		if len(res) == 0 || res[0] == nil {
+			break
+		}
+		ctrl = res[0]
+
+		inner := &scope{vars: map[string]value{}, parent: sc}
+		for i, name := range s.names {
+			if i < len(res) {
+				inner.vars[name] = res[i]
+			} else {
+				inner.vars[name] = nil
+			}
+		}
+
+		c, ret := in.blockIn(s.body, inner)
+		if c == ctrlReturn {
+			return c, ret
+		}
+		if c == ctrlBreak {
+			break
+		}
+	}
+
+	return ctrlNone, nil
+}
+
+func (in *interpreter) assign(target expr, v value, sc *scope) {
+	switch t := target.(type) {
+	case *nameExpr:
+		if s, ok := sc.lookup(t.name); ok {
+			s.vars[t.name] = v
+			return
+		}
+		// Like Redis, which protects the global table
+		in.errorf("Script attempted to create global variable '%s'", t.name)
+	case *indexExpr:
+		obj := in.eval(t.obj, sc)
+		tbl, ok := obj.(*table)
+		if !ok {
+			in.errorf("attempt to index a %s value", typeName(obj))
+		}
+		k := in.eval(t.key, sc)
+		if k == nil {
+			in.errorf("table index is nil")
+		}
+		tbl.set(k, v)
+	}
+}
+
+// Evaluate a list of expressions, expanding the values returned by a
+// call in the last position; with n >= 0 the result is adjusted to n
+// values
+func (in *interpreter) exprList(exprs []expr, sc *scope, n int) []value {
+	var vals []value
+
+	for i, e := range exprs {
+		if call, ok := e.(*callExpr); ok && i == len(exprs)-1 {
+			vals = append(vals, in.call(call, sc)...)
+		} else {
+			vals = append(vals, in.eval(e, sc))
+		}
+	}
+
+	if n >= 0 {
+		for len(vals) < n {
+			vals = append(vals, nil)
+		}
+		vals = vals[:n]
+	}
+
+	return vals
+}
+
+func (in *interpreter) call(c *callExpr, sc *scope) []value {
+	fn := in.eval(c.fn, sc)
+	b, ok := fn.(builtin)
+	if !ok {
+		in.errorf("attempt to call a %s value", typeName(fn))
+	}
+	return b(in.exprList(c.args, sc, -1))
+}
+
+func (in *interpreter) eval(e expr, sc *scope) value {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.v
+
+	case *nameExpr:
+		if s, ok := sc.lookup(e.name); ok {
+			return s.vars[e.name]
+		}
+		return in.globals[e.name]
+
+	case *indexExpr:
+		obj := in.eval(e.obj, sc)
+		k := in.eval(e.key, sc)
+		switch obj := obj.(type) {
+		case *table:
+			return obj.get(k)
+		case string:
+			// Only the string library is reachable from strings
+			if lib, ok := in.globals["string"].(*table); ok {
+				return lib.get(k)
+			}
+		}
+		in.errorf("attempt to index a %s value", typeName(obj))
+
+	case *callExpr:
+		if res := in.call(e, sc); len(res) > 0 {
+			return res[0]
+		}
+		return nil
+
+	case *parenExpr:
+		return in.eval(e.e, sc)
+
+	case *tableExpr:
+		t := newTable()
+		for i, item := range e.items {
+			if call, ok := item.(*callExpr); ok && i == len(e.items)-1 {
+				for _, v := range in.call(call, sc) {
+					t.set(float64(len(t.arr)+1), v)
+				}
+			} else {
+				t.set(float64(i+1), in.eval(item, sc))
+			}
+		}
+		for i, k := range e.keys {
+			kv := in.eval(k, sc)
+			if kv == nil {
+				in.errorf("table index is nil")
+			}
+			t.set(kv, in.eval(e.vals[i], sc))
+		}
+		return t
+
+	case *unaryExpr:
+		v := in.eval(e.e, sc)
+		switch e.op {
+		case "not":
+			return !truthy(v)
+		case "-":
+			n, ok := toNumber(v)
+			if !ok {
+				in.errorf("attempt to perform arithmetic on a %s value", typeName(v))
+			}
+			return -n
+		case "#":
+			switch v := v.(type) {
+			case string:
+				return float64(len(v))
+			case *table:
+				return float64(len(v.arr))
+			}
+			in.errorf("attempt to get length of a %s value", typeName(v))
+		}
+
+	case *binaryExpr:
+		return in.binary(e, sc)
+	}
+
+	return nil
+}
+
+func (in *interpreter) binary(e *binaryExpr, sc *scope) value {
+	switch e.op {
+	case "and":
+		l := in.eval(e.left, sc)
+		if !truthy(l) {
+			return l
+		}
+		return in.eval(e.right, sc)
+	case "or":
+		l := in.eval(e.left, sc)
+		if truthy(l) {
+			return l
+		}
+		return in.eval(e.right, sc)
+	}
+
+	l := in.eval(e.left, sc)
+	r := in.eval(e.right, sc)
+
+	switch e.op {
+	case "==":
+		return equal(l, r)
+	case "~=":
+		return !equal(l, r)
+	case "<", "<=", ">", ">=":
+		return in.compare(e.op, l, r)
+	case "..":
+		ls, ok1 := toString(l)
+		rs, ok2 := toString(r)
+		if !ok1 || !ok2 {
+			bad := l
+			if ok1 {
+				bad = r
+			}
+			in.errorf("attempt to concatenate a %s value", typeName(bad))
+		}
+		return ls + rs
+	}
+
+	a, ok1 := toNumber(l)
+	b, ok2 := toNumber(r)
+	if !ok1 || !ok2 {
+		bad := l
+		if ok1 {
+			bad = r
+		}
+		in.errorf("attempt to perform arithmetic on a %s value", typeName(bad))
+	}
+
+	switch e.op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a - math.Floor(a/b)*b
+	case "^":
+		return math.Pow(a, b)
+	}
+
+	return nil
+}
+
+func (in *interpreter) compare(op string, l, r value) bool {
+	var c int
+
+	switch a := l.(type) {
+	case float64:
+		b, ok := r.(float64)
+		if !ok {
+			in.errorf("attempt to compare %s with %s", typeName(l), typeName(r))
+		}
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+	case string:
+		b, ok := r.(string)
+		if !ok {
+			in.errorf("attempt to compare %s with %s", typeName(l), typeName(r))
+		}
+		c = strings.Compare(a, b)
+	default:
+		in.errorf("attempt to compare %s with %s", typeName(l), typeName(r))
+	}
+
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func equal(l, r value) bool {
+	// Builtins aren't comparable in Go
+	if _, ok := l.(builtin); ok {
+		return false
+	}
+	if _, ok := r.(builtin); ok {
+		return false
+	}
+	return l == r
+}
+
+func truthy(v value) bool {
+	return v != nil && v != false
+}
+
+func typeName(v value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *table:
+		return "table"
+	case builtin:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Converts numbers and numeric strings to numbers, like Lua does in
+// arithmetic
+func toNumber(v value) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseNumber(v)
+	}
+	return 0, false
+}
+
+// Converts strings and numbers to strings, like Lua does when
+// concatenating
+func toString(v value) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return formatNumber(v), true
+	}
+	return "", false
+}
+
+// Formats a number like Lua 5.1 does, with 14 significant digits
+func formatNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return fmt.Sprintf("%.14g", n)
+}
@@ -0,0 +1,434 @@
+/*
+Package redistest provides an in-memory Redis server for the tests of
+the gedis packages.
+
+The server is built on top of gedis/server and implements the commands
+used by those packages on strings, hashes, lists, sorted sets and
+streams, key expiration, pub/sub, transactions, and Lua scripting
+with EVAL and
+EVALSHA, so the scripts of a package run for real in its tests. Its
+clock can be frozen and advanced, so tests don't have to sleep.
+
+	s := redistest.NewServer(t)
+	c, err := client.Dial("tcp", s.Addr())
+
+Like Redis, every command runs atomically, and so do scripts. Blocking
+commands like BLPOP or XREADGROUP with BLOCK wait for another client
+to write, for their timeout, or for the server to close.
+*/
+package redistest
+
+import (
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/server"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-memory Redis server
+type Server struct {
+	srv    *server.Server
+	pubsub *server.PubSub
+
+	mu      sync.Mutex
+	keys    map[string]*entry
+	scripts map[string]*script
+	config  map[string]string
+	frozen  time.Time
+	offset  time.Duration
+	failure string
+	// Versions of the keys watched by some client, see keyVersion
+	versions map[string]uint64
+	version  uint64
+	// Closed and replaced every time a command writes, to wake up
+	// blocked clients
+	changed chan struct{}
+}
+
+// A key and its value: a string, hash, *list, *zset or *stream
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Returned for keys holding the wrong kind of value
+var errWrongType = gedis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Start a server on a random local port, closed when the test ends
+func NewServer(t testing.TB) *Server {
+	return NewServerWith(t, nil)
+}
+
+// Start a server like NewServer, calling setup before it starts
+// accepting connections
+//
+// setup can override or add commands with Handle, which can't be
+// called once the server is running.
+func NewServerWith(t testing.TB, setup func(s *Server)) *Server {
+	srv, err := server.NewServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start server: %v", err)
+	}
+
+	s := &Server{
+		srv:     srv,
+		pubsub:  server.NewPubSub(),
+		keys:    make(map[string]*entry),
+		scripts: make(map[string]*script),
+		config:  make(map[string]string),
+		changed: make(chan struct{}),
+
+		versions: make(map[string]uint64),
+	}
+
+	for name, cmd := range commands {
+		s.register(name, cmd)
+	}
+
+	s.pubsub.Register(srv)
+
+	tx := server.NewTransactions()
+	tx.KeyVersion = s.keyVersion
+	tx.Register(srv)
+
+	srv.Use(s.fail)
+
+	if setup != nil {
+		setup(s)
+	}
+
+	go srv.Loop()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.srv.Addr().String()
+}
+
+// Close the server and the connections of every client
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Returns the number of connected clients
+func (s *Server) Clients() int {
+	return len(s.srv.Clients())
+}
+
+// Set the handler of a command; only valid from the setup function
+// given to NewServerWith
+func (s *Server) Handle(cmd string, handler server.Handler) {
+	s.srv.Handle(cmd, handler)
+}
+
+// Make every command fail with msg, as in "ERR down", until called
+// again with an empty message
+func (s *Server) SetFailure(msg string) {
+	s.mu.Lock()
+	s.failure = msg
+	s.mu.Unlock()
+}
+
+func (s *Server) fail(next server.Handler) server.Handler {
+	return func(c *server.Client, args [][]byte) error {
+		s.mu.Lock()
+		failure := s.failure
+		s.mu.Unlock()
+
+		if failure != "" {
+			_, err := c.Error(gedis.Error(failure))
+			return err
+		}
+
+		return next(c, args)
+	}
+}
+
+// Freeze the clock used for TIME and key expiration at t
+func (s *Server) SetTime(t time.Time) {
+	s.mu.Lock()
+	s.frozen = t
+	s.offset = 0
+	s.mu.Unlock()
+}
+
+// Move the clock forward by d
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	if s.frozen.IsZero() {
+		s.offset += d
+	} else {
+		s.frozen = s.frozen.Add(d)
+	}
+	s.mu.Unlock()
+}
+
+// Returns the time on the server clock
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now()
+}
+
+func (s *Server) now() time.Time {
+	if !s.frozen.IsZero() {
+		return s.frozen
+	}
+	return time.Now().Add(s.offset)
+}
+
+// Returns the string value of a key
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	if e == nil {
+		return "", false
+	}
+	v, ok := e.value.(string)
+	return v, ok
+}
+
+// Set the string value of a key, without expiration
+func (s *Server) Set(key, value string) {
+	s.mu.Lock()
+	s.keys[key] = &entry{value: value}
+	s.signal()
+	s.mu.Unlock()
+}
+
+// Returns whether a key exists
+func (s *Server) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(key) != nil
+}
+
+// Returns how long until a key expires, zero if it doesn't
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.lookup(key); e != nil && !e.expires.IsZero() {
+		return e.expires.Sub(s.now())
+	}
+	return 0
+}
+
+// Publish a message, returning the number of clients that got it
+func (s *Server) Publish(channel, message string) int {
+	return s.pubsub.Publish(channel, []byte(message))
+}
+
+// Returns the entry of key, removing it if it expired
+func (s *Server) lookup(key string) *entry {
+	e, ok := s.keys[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !s.now().Before(e.expires) {
+		delete(s.keys, key)
+		s.touch(key)
+		return nil
+	}
+	return e
+}
+
+// Returns the version of a key, for WATCH
+//
+// Versions change every time a key is an argument of a write command,
+// so a transaction can be aborted by a write that took its key as a
+// value, but never runs after one that modified it.
+func (s *Server) keyVersion(db int, key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lookup(key)
+
+	v, ok := s.versions[key]
+	if !ok {
+		v = s.version
+		s.versions[key] = v
+	}
+	return v
+}
+
+// Change the version of a key, if someone watched it
+func (s *Server) touch(key string) {
+	if _, ok := s.versions[key]; ok {
+		s.version++
+		s.versions[key] = s.version
+	}
+}
+
+// Wake up the clients blocked waiting for a change
+func (s *Server) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// A command of the server
+type command struct {
+	fn    func(s *Server, args []string) interface{}
+	arity int
+	// Whether the command may modify the keyspace
+	write bool
+	// For blocking commands, returns how long the command blocks,
+	// zero meaning forever, or false if it doesn't
+	block func(args []string) (time.Duration, bool, error)
+}
+
+// The commands of the server, added by the init function of the file
+// implementing them
+var commands = make(map[string]command)
+
+func addCommands(cmds map[string]command) {
+	for name, cmd := range cmds {
+		commands[name] = cmd
+	}
+}
+
+// Replies to a command that blocked for too long
+type nullArray struct{}
+
+// Run a command holding the lock, as done by scripts
+func (s *Server) call(args []string) interface{} {
+	cmd, ok := commands[strings.ToUpper(args[0])]
+	if !ok {
+		return gedis.Error("ERR unknown command '" + args[0] + "'")
+	}
+	if !validArity(cmd.arity, len(args)) {
+		return wrongArity(args[0])
+	}
+
+	res := cmd.fn(s, args[1:])
+
+	if cmd.write {
+		switch res.(type) {
+		case nullArray, gedis.Error:
+		default:
+			s.signal()
+			for _, arg := range args[1:] {
+				s.touch(arg)
+			}
+		}
+	}
+
+	return res
+}
+
+func validArity(arity, n int) bool {
+	if arity >= 0 {
+		return n == arity
+	}
+	return n >= -arity
+}
+
+func wrongArity(cmd string) gedis.Error {
+	return gedis.Error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+func (s *Server) register(name string, cmd command) {
+	var flags server.Flag
+	if cmd.block != nil {
+		flags = server.FlagBlocking
+	}
+
+	s.srv.Register(server.Command{
+		Name:  name,
+		Arity: cmd.arity,
+		Flags: flags,
+		Handler: func(c *server.Client, in [][]byte) error {
+			args := make([]string, len(in)+1)
+			args[0] = name
+			for i, arg := range in {
+				args[i+1] = string(arg)
+			}
+
+			if cmd.block == nil {
+				s.mu.Lock()
+				res := s.call(args)
+				s.mu.Unlock()
+				return writeReply(c, res)
+			}
+
+			timeout, block, err := cmd.block(args[1:])
+			if err != nil {
+				_, err = c.Error(err)
+				return err
+			}
+
+			return writeReply(c, s.blocking(c, args, timeout, block))
+		},
+	})
+}
+
+// Run a blocking command until it has a reply other than a null
+// array, it times out, or the client goes away
+func (s *Server) blocking(c *server.Client, args []string, timeout time.Duration, block bool) interface{} {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	for {
+		s.mu.Lock()
+		res := s.call(args)
+		changed := s.changed
+		s.mu.Unlock()
+
+		if _, ok := res.(nullArray); !ok || !block {
+			return res
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return res
+		case <-c.Context().Done():
+			return res
+		}
+	}
+}
+
+// Write a reply returned by a command
+func writeReply(c *server.Client, res interface{}) error {
+	var err error
+
+	switch res := res.(type) {
+	case nil:
+		err = c.WriteNull()
+	case nullArray:
+		err = c.WriteNullArray()
+	case gedis.Status:
+		_, err = c.Status(string(res))
+	case gedis.Error:
+		_, err = c.Error(res)
+	case int64:
+		err = c.WriteInt(res)
+	case string:
+		err = c.WriteBulkString(res)
+	case []interface{}:
+		if err = c.WriteArray(len(res)); err != nil {
+			return err
+		}
+		for _, r := range res {
+			if err = writeReply(c, r); err != nil {
+				return err
+			}
+		}
+	default:
+		panic("redistest: unexpected reply")
+	}
+
+	return err
+}
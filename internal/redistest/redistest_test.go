@@ -0,0 +1,286 @@
+package redistest
+
+import (
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func dial(t *testing.T, s *Server) *client.Client {
+	c, err := client.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Cannot connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &c
+}
+
+func send(t *testing.T, c *client.Client, args ...interface{}) interface{} {
+	res, err := c.Send(args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return res
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(t)
+	c := dial(t, s)
+
+	tests := []struct {
+		args []interface{}
+		res  interface{}
+	}{
+		{[]interface{}{"SET", "str", "lorem"}, gedis.Status("OK")},
+		{[]interface{}{"SET", "str", "ipsum", "NX"}, nil},
+		{[]interface{}{"GET", "str"}, "lorem"},
+		{[]interface{}{"INCRBY", "n", 5}, int64(5)},
+		{[]interface{}{"DECRBY", "n", 2}, int64(3)},
+		{[]interface{}{"HSET", "h", "a", 1, "b", 2}, int64(2)},
+		{[]interface{}{"HGETALL", "h"}, []interface{}{"a", "1", "b", "2"}},
+		{[]interface{}{"RPUSH", "l", "a", "b", "c", "b"}, int64(4)},
+		{[]interface{}{"LREM", "l", -1, "b"}, int64(1)},
+		{[]interface{}{"LRANGE", "l", 0, -1}, []interface{}{"a", "b", "c"}},
+		{[]interface{}{"LMOVE", "l", "m", "RIGHT", "LEFT"}, "c"},
+		{[]interface{}{"ZADD", "z", 2, "b", 1, "a", 3, "c"}, int64(3)},
+		{[]interface{}{"ZRANGEBYSCORE", "z", "(1", "+inf", "LIMIT", 0, 1}, []interface{}{"b"}},
+		{[]interface{}{"ZRANGE", "z", -1, -1, "WITHSCORES"}, []interface{}{"c", "3"}},
+		{[]interface{}{"ZREMRANGEBYSCORE", "z", "-inf", 2}, int64(2)},
+		{[]interface{}{"TYPE", "z"}, gedis.Status("zset")},
+		{[]interface{}{"GET", "h"}, gedis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		res, err := c.Send(tt.args...)
+		if e, ok := tt.res.(gedis.Error); ok {
+			if err == nil || err.Error() != string(e) {
+				t.Errorf("%v: expected error %q, got %v", tt.args, e, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+		} else if !reflect.DeepEqual(res, tt.res) {
+			t.Errorf("%v: expected %#v, got %#v", tt.args, tt.res, res)
+		}
+	}
+}
+
+func TestServer_expiration(t *testing.T) {
+	s := NewServer(t)
+	s.SetTime(time.Unix(1700000000, 0))
+	c := dial(t, s)
+
+	send(t, c, "SET", "key", "value", "PX", 1500)
+
+	if res := send(t, c, "PTTL", "key"); res != int64(1500) {
+		t.Fatalf("Unexpected PTTL: %#v", res)
+	}
+	if res := send(t, c, "TTL", "key"); res != int64(2) {
+		t.Fatalf("Unexpected TTL: %#v", res)
+	}
+
+	s.Advance(1500 * time.Millisecond)
+
+	if s.Exists("key") {
+		t.Fatal("The key should have expired")
+	}
+
+	if _, err := c.Send("SET", "key", "value", "PX", 0); err == nil {
+		t.Fatal("Expected an error for a zero expiration")
+	}
+}
+
+func TestServer_blocking(t *testing.T) {
+	s := NewServer(t)
+	c := dial(t, s)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.mu.Lock()
+		s.call([]string{"RPUSH", "list", "lorem"})
+		s.mu.Unlock()
+	}()
+
+	res := send(t, c, "BLPOP", "list", 0)
+	if !reflect.DeepEqual(res, []interface{}{"list", "lorem"}) {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	if res, err := c.Send("BLPOP", "list", 0.05); res != nil || err != nil {
+		t.Fatalf("Expected a timeout, got %#v, %v", res, err)
+	}
+}
+
+func TestServer_transactions(t *testing.T) {
+	s := NewServer(t)
+	c, other := dial(t, s), dial(t, s)
+
+	send(t, c, "WATCH", "balance")
+	send(t, c, "MULTI")
+	send(t, c, "INCRBY", "balance", 10)
+	if res := send(t, c, "EXEC"); !reflect.DeepEqual(res, []interface{}{int64(10)}) {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	// A write by someone else aborts the transaction
+	send(t, c, "WATCH", "balance")
+	send(t, other, "DECRBY", "balance", 5)
+	send(t, c, "MULTI")
+	send(t, c, "INCRBY", "balance", 10)
+	if res := send(t, c, "EXEC"); res != nil {
+		t.Fatalf("Expected the transaction to be aborted, got %#v", res)
+	}
+
+	if v, _ := s.Get("balance"); v != "5" {
+		t.Fatalf("Unexpected balance %q", v)
+	}
+}
+
+func TestServer_scripts(t *testing.T) {
+	s := NewServer(t)
+	c := dial(t, s)
+
+	tests := []struct {
+		script string
+		args   []interface{}
+		res    interface{}
+	}{
+		{"return 1 + 2 * 3 ^ 2", nil, int64(19)},
+		{"return 7 / 2", nil, int64(3)},
+		{"return 'a' .. 1 .. 2.5", nil, "a12.5"},
+		{"return {1, 'two', false, 3}", nil, []interface{}{int64(1), "two", nil, int64(3)}},
+		{"return {1, nil, 3}", nil, []interface{}{int64(1)}},
+		{"return redis.status_reply('FINE')", nil, gedis.Status("FINE")},
+		{"return redis.call('GET', KEYS[1])", []interface{}{1, "missing"}, nil},
+		{"local v = redis.call('GET', KEYS[1]) return v == false", []interface{}{1, "missing"}, int64(1)},
+		{"return redis.call('SET', KEYS[1], ARGV[1])['ok']", []interface{}{1, "k", "v"}, "OK"},
+		{"return tonumber(ARGV[1]) * 1000", []interface{}{0, "1.5"}, int64(1500)},
+		{"return string.format('%.0f', 1700000000123456)", nil, "1700000000123456"},
+		{"return math.floor(-1.5) .. ':' .. math.ceil(1.2)", nil, "-2:2"},
+		{
+			`local sum = 0
+			for i, v in ipairs({10, 20, 30}) do
+				if i == 2 then break end
+				sum = sum + v
+			end
+			local n = 0
+			while n < 3 do n = n + 1 end
+			repeat n = n - 2 until n < 0
+			return sum + n`, nil, int64(9),
+		},
+		{"local t = redis.call('TIME') return #t", nil, int64(2)},
+		{"return redis.pcall('INCR', KEYS[1])['err']", []interface{}{1, "k"}, "ERR value is not an integer or out of range"},
+		{"return string.sub('lorem', 2, -2)", nil, "ore"},
+	}
+
+	for _, tt := range tests {
+		args := append([]interface{}{"EVAL", tt.script}, tt.args...)
+		if tt.args == nil {
+			args = append(args, 0)
+		}
+
+		res, err := c.Send(args...)
+		if err != nil {
+			t.Errorf("%q: %v", tt.script, err)
+		} else if !reflect.DeepEqual(res, tt.res) {
+			t.Errorf("%q: expected %#v, got %#v", tt.script, tt.res, res)
+		}
+	}
+}
+
+func TestServer_scriptErrors(t *testing.T) {
+	s := NewServer(t)
+	c := dial(t, s)
+
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{"x = 1", "ERR user_script:1: Script attempted to create global variable 'x' script: "},
+		{"local t = {}\nreturn t.a + 1", "ERR user_script:2: attempt to perform arithmetic on a nil value script: "},
+		{"return redis.call('INCR', 'a', 'b')", "ERR wrong number of arguments for 'incr' command"},
+		{"return redis.error_reply('BAD thing')", "BAD thing"},
+		{"error({err = 'OOPS'})", "OOPS"},
+		{"return (", "ERR Error compiling script"},
+	}
+
+	for _, tt := range tests {
+		_, err := c.Send("EVAL", tt.script, 0)
+		if err == nil || len(err.Error()) < len(tt.err) || err.Error()[:len(tt.err)] != tt.err {
+			t.Errorf("%q: expected error %q, got %v", tt.script, tt.err, err)
+		}
+	}
+
+	sha := client.NewScript("return 1").Hash()
+	if _, err := c.Send("EVALSHA", sha, 0); err == nil || err.Error()[:8] != "NOSCRIPT" {
+		t.Fatalf("Expected NOSCRIPT, got %v", err)
+	}
+	if res := send(t, c, "SCRIPT", "LOAD", "return 1"); res != sha {
+		t.Fatalf("Unexpected SHA: %#v", res)
+	}
+	if res := send(t, c, "EVALSHA", sha, 0); res != int64(1) {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+}
+
+func TestServer_streams(t *testing.T) {
+	s := NewServer(t)
+	s.SetTime(time.Unix(1700000000, 0))
+	c := dial(t, s)
+
+	send(t, c, "XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+	if _, err := c.Send("XGROUP", "CREATE", "s", "g", "$"); err == nil || err.Error()[:9] != "BUSYGROUP" {
+		t.Fatalf("Expected BUSYGROUP, got %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		send(t, c, "XADD", "s", "*", "n", i)
+	}
+
+	res := send(t, c, "XREADGROUP", "GROUP", "g", "alice", "COUNT", 3, "STREAMS", "s", ">")
+	streams, err := client.ParseXStreams(res)
+	if err != nil || len(streams) != 1 || len(streams[0].Messages) != 3 {
+		t.Fatalf("Unexpected: %#v, %v", res, err)
+	}
+	if id := streams[0].Messages[2].ID; id != "1700000000000-2" {
+		t.Fatalf("Unexpected ID: %q", id)
+	}
+
+	send(t, c, "XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")
+	send(t, c, "XDEL", "s", "1700000000000-0")
+
+	s.Advance(time.Second)
+
+	// Two entries scanned per call, one of them deleted
+	var claimed, deleted int
+	cursor := "0-0"
+	for i := 0; ; i++ {
+		res := send(t, c, "XAUTOCLAIM", "s", "g", "carol", 500, cursor, "COUNT", 2)
+		arr := res.([]interface{})
+		cursor = arr[0].(string)
+		claimed += len(arr[1].([]interface{}))
+		deleted += len(arr[2].([]interface{}))
+		if cursor == "0-0" {
+			break
+		}
+		if i > 5 {
+			t.Fatalf("XAUTOCLAIM never finished: %#v", res)
+		}
+	}
+
+	if claimed != 4 || deleted != 1 {
+		t.Fatalf("Expected 4 claimed and 1 deleted, got %d and %d", claimed, deleted)
+	}
+
+	res = send(t, c, "XPENDING", "s", "g", "IDLE", 0, "(1700000000000-1", "+", 10, "carol")
+	if pending := res.([]interface{}); len(pending) != 3 || pending[0].([]interface{})[3] != int64(2) {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+
+	if res = send(t, c, "XACK", "s", "g", "1700000000000-1", "1700000000000-9"); res != int64(1) {
+		t.Fatalf("Unexpected: %#v", res)
+	}
+}
@@ -0,0 +1,600 @@
+package redistest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/inkel/gedis"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A script loaded with EVAL or SCRIPT LOAD
+type script struct {
+	sha  string
+	body []stmt
+}
+
+func init() {
+	addCommands(map[string]command{
+		"EVAL":    {fn: eval, arity: -3, write: true},
+		"EVALSHA": {fn: evalSHA, arity: -3, write: true},
+		"SCRIPT":  {fn: scriptCommand, arity: -2},
+	})
+}
+
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// Parse and cache a script
+func (s *Server) load(src string) (*script, gedis.Error) {
+	sha := scriptSHA(src)
+	if sc, ok := s.scripts[sha]; ok {
+		return sc, ""
+	}
+
+	body, err := parseLua(src)
+	if err != nil {
+		return nil, gedis.Error("ERR Error compiling script (new function): " + err.Error())
+	}
+
+	sc := &script{sha: sha, body: body}
+	s.scripts[sha] = sc
+
+	return sc, ""
+}
+
+func eval(s *Server, args []string) interface{} {
+	sc, err := s.load(args[0])
+	if err != "" {
+		return err
+	}
+	return s.runScript(sc, args[1:])
+}
+
+func evalSHA(s *Server, args []string) interface{} {
+	sc, ok := s.scripts[strings.ToLower(args[0])]
+	if !ok {
+		return gedis.Error("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return s.runScript(sc, args[1:])
+}
+
+// SCRIPT LOAD source, SCRIPT EXISTS sha [sha ...] and SCRIPT FLUSH
+func scriptCommand(s *Server, args []string) interface{} {
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "LOAD" && len(args) == 2:
+		sc, err := s.load(args[1])
+		if err != "" {
+			return err
+		}
+		return sc.sha
+
+	case sub == "EXISTS" && len(args) > 1:
+		res := make([]interface{}, len(args)-1)
+		for i, sha := range args[1:] {
+			res[i] = int64(0)
+			if _, ok := s.scripts[strings.ToLower(sha)]; ok {
+				res[i] = int64(1)
+			}
+		}
+		return res
+
+	case sub == "FLUSH" && len(args) <= 2:
+		s.scripts = make(map[string]*script)
+		return statusOK
+	}
+
+	return gedis.Error("ERR unknown subcommand or wrong number of arguments for '" + args[0] + "'")
+}
+
+// Run a script given the number of keys followed by the keys and the
+// arguments, as in EVAL
+func (s *Server) runScript(sc *script, args []string) interface{} {
+	numKeys, valid := parseInt(args[0])
+	if !valid {
+		return errNotInteger
+	}
+	if numKeys < 0 {
+		return gedis.Error("ERR Number of keys can't be negative")
+	}
+	if numKeys > int64(len(args)-1) {
+		return gedis.Error("ERR Number of keys can't be greater than number of args")
+	}
+
+	keys := newTable()
+	for _, k := range args[1 : 1+numKeys] {
+		keys.arr = append(keys.arr, k)
+	}
+	argv := newTable()
+	for _, a := range args[1+numKeys:] {
+		argv.arr = append(argv.arr, a)
+	}
+
+	in := &interpreter{}
+	in.globals = s.globals(in)
+	in.globals["KEYS"] = keys
+	in.globals["ARGV"] = argv
+
+	res, err := in.run(sc.body)
+	if err != nil {
+		e := err.(*luaError)
+		if e.reply != nil {
+			return e.reply
+		}
+		return gedis.Error(fmt.Sprintf("ERR %s script: %s, on @user_script:%d.", e.Error(), sc.sha, e.line))
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+	return fromLua(res[0])
+}
+
+// Converts a Redis reply to a Lua value, raising errors unless
+// protected, as done by redis.pcall
+func toLua(in *interpreter, res interface{}, protected bool) value {
+	switch res := res.(type) {
+	case nil, nullArray:
+		return false
+	case int64:
+		return float64(res)
+	case string:
+		return res
+	case gedis.Status:
+		t := newTable()
+		t.set("ok", string(res))
+		return t
+	case gedis.Error:
+		t := newTable()
+		t.set("err", string(res))
+		if !protected {
+			panic(&luaError{line: in.line, msg: string(res), reply: res})
+		}
+		return t
+	case []interface{}:
+		t := newTable()
+		for _, r := range res {
+			t.arr = append(t.arr, toLua(in, r, true))
+		}
+		return t
+	}
+
+	panic("redistest: unexpected reply")
+}
+
+// Converts the value returned by a script to a Redis reply
+func fromLua(v value) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		return v
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return nil
+	case *table:
+		if err, ok := v.get("err").(string); ok {
+			return gedis.Error(err)
+		}
+		if status, ok := v.get("ok").(string); ok {
+			return gedis.Status(status)
+		}
+		res := []interface{}{}
+		for _, item := range v.arr {
+			if item == nil {
+				break
+			}
+			res = append(res, fromLua(item))
+		}
+		return res
+	}
+	return nil
+}
+
+// Returns the global environment of a script
+func (s *Server) globals(in *interpreter) map[string]value {
+	arg := func(args []value, i int) value {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+
+	number := func(args []value, i int, fn string) float64 {
+		n, ok := toNumber(arg(args, i))
+		if !ok {
+			in.errorf("bad argument #%d to '%s' (number expected, got %s)", i+1, fn, typeName(arg(args, i)))
+		}
+		return n
+	}
+
+	str := func(args []value, i int, fn string) string {
+		v, ok := toString(arg(args, i))
+		if !ok {
+			in.errorf("bad argument #%d to '%s' (string expected, got %s)", i+1, fn, typeName(arg(args, i)))
+		}
+		return v
+	}
+
+	tbl := func(args []value, i int, fn string) *table {
+		t, ok := arg(args, i).(*table)
+		if !ok {
+			in.errorf("bad argument #%d to '%s' (table expected, got %s)", i+1, fn, typeName(arg(args, i)))
+		}
+		return t
+	}
+
+	call := func(protected bool) builtin {
+		return func(args []value) []value {
+			if len(args) == 0 {
+				in.errorf("Please specify at least one argument for this redis lib call")
+			}
+
+			cmd := make([]string, len(args))
+			for i, a := range args {
+				switch a := a.(type) {
+				case string:
+					cmd[i] = a
+				case float64:
+					cmd[i] = formatFloat(a)
+				default:
+					in.errorf("Lua redis lib command arguments must be strings or integers")
+				}
+			}
+
+			return []value{toLua(in, s.call(cmd), protected)}
+		}
+	}
+
+	reply := func(field string) builtin {
+		return func(args []value) []value {
+			t := newTable()
+			t.set(field, str(args, 0, field+"_reply"))
+			return []value{t}
+		}
+	}
+
+	redis := newTable()
+	redis.set("call", call(false))
+	redis.set("pcall", call(true))
+	redis.set("error_reply", reply("err"))
+	redis.set("status_reply", reply("ok"))
+	redis.set("log", builtin(func(args []value) []value { return nil }))
+	redis.set("LOG_DEBUG", float64(0))
+	redis.set("LOG_VERBOSE", float64(1))
+	redis.set("LOG_NOTICE", float64(2))
+	redis.set("LOG_WARNING", float64(3))
+
+	mathLib := newTable()
+	for name, fn := range map[string]func(float64) float64{
+		"floor": math.Floor,
+		"ceil":  math.Ceil,
+		"abs":   math.Abs,
+		"sqrt":  math.Sqrt,
+	} {
+		name, fn := name, fn
+		mathLib.set(name, builtin(func(args []value) []value {
+			return []value{fn(number(args, 0, name))}
+		}))
+	}
+	mathLib.set("pow", builtin(func(args []value) []value {
+		return []value{math.Pow(number(args, 0, "pow"), number(args, 1, "pow"))}
+	}))
+	mathLib.set("fmod", builtin(func(args []value) []value {
+		return []value{math.Mod(number(args, 0, "fmod"), number(args, 1, "fmod"))}
+	}))
+	for name, max := range map[string]bool{"max": true, "min": false} {
+		name, max := name, max
+		mathLib.set(name, builtin(func(args []value) []value {
+			res := number(args, 0, name)
+			for i := 1; i < len(args); i++ {
+				n := number(args, i, name)
+				if (max && n > res) || (!max && n < res) {
+					res = n
+				}
+			}
+			return []value{res}
+		}))
+	}
+	mathLib.set("huge", math.Inf(1))
+	mathLib.set("pi", math.Pi)
+
+	stringLib := newTable()
+	stringLib.set("format", builtin(func(args []value) []value {
+		return []value{in.format(str(args, 0, "format"), args[1:])}
+	}))
+	stringLib.set("len", builtin(func(args []value) []value {
+		return []value{float64(len(str(args, 0, "len")))}
+	}))
+	stringLib.set("sub", builtin(func(args []value) []value {
+		v := str(args, 0, "sub")
+		n := float64(len(v))
+		i, j := number(args, 1, "sub"), -1.0
+		if arg(args, 2) != nil {
+			j = number(args, 2, "sub")
+		}
+		if i < 0 {
+			i += n + 1
+		}
+		if j < 0 {
+			j += n + 1
+		}
+		if i < 1 {
+			i = 1
+		}
+		if j > n {
+			j = n
+		}
+		if i > j {
+			return []value{""}
+		}
+		return []value{v[int(i)-1 : int(j)]}
+	}))
+	stringLib.set("upper", builtin(func(args []value) []value {
+		return []value{strings.ToUpper(str(args, 0, "upper"))}
+	}))
+	stringLib.set("lower", builtin(func(args []value) []value {
+		return []value{strings.ToLower(str(args, 0, "lower"))}
+	}))
+	stringLib.set("rep", builtin(func(args []value) []value {
+		n := int(number(args, 1, "rep"))
+		if n < 0 {
+			n = 0
+		}
+		return []value{strings.Repeat(str(args, 0, "rep"), n)}
+	}))
+
+	tableLib := newTable()
+	tableLib.set("insert", builtin(func(args []value) []value {
+		t := tbl(args, 0, "insert")
+		switch len(args) {
+		case 2:
+			t.set(float64(len(t.arr)+1), args[1])
+		case 3:
+			pos := int(number(args, 1, "insert"))
+			if pos < 1 || pos > len(t.arr)+1 {
+				in.errorf("bad argument #2 to 'insert' (position out of bounds)")
+			}
+			t.arr = append(t.arr, nil)
+			copy(t.arr[pos:], t.arr[pos-1:])
+			t.arr[pos-1] = args[2]
+		default:
+			in.errorf("wrong number of arguments to 'insert'")
+		}
+		return nil
+	}))
+	tableLib.set("remove", builtin(func(args []value) []value {
+		t := tbl(args, 0, "remove")
+		if len(t.arr) == 0 {
+			return []value{nil}
+		}
+		pos := len(t.arr)
+		if len(args) > 1 {
+			pos = int(number(args, 1, "remove"))
+		}
+		if pos < 1 || pos > len(t.arr) {
+			return []value{nil}
+		}
+		v := t.arr[pos-1]
+		t.arr = append(t.arr[:pos-1], t.arr[pos:]...)
+		return []value{v}
+	}))
+	tableLib.set("concat", builtin(func(args []value) []value {
+		t := tbl(args, 0, "concat")
+		sep := ""
+		if arg(args, 1) != nil {
+			sep = str(args, 1, "concat")
+		}
+		parts := make([]string, len(t.arr))
+		for i, v := range t.arr {
+			s, ok := toString(v)
+			if !ok {
+				in.errorf("invalid value (at index %d) in table for 'concat'", i+1)
+			}
+			parts[i] = s
+		}
+		return []value{strings.Join(parts, sep)}
+	}))
+	tableLib.set("getn", builtin(func(args []value) []value {
+		return []value{float64(len(tbl(args, 0, "getn").arr))}
+	}))
+
+	unpack := builtin(func(args []value) []value {
+		return append([]value(nil), tbl(args, 0, "unpack").arr...)
+	})
+	tableLib.set("unpack", unpack)
+
+	return map[string]value{
+		"redis":  redis,
+		"math":   mathLib,
+		"string": stringLib,
+		"table":  tableLib,
+		"unpack": unpack,
+
+		"tonumber": builtin(func(args []value) []value {
+			base := 10
+			if arg(args, 1) != nil {
+				base = int(number(args, 1, "tonumber"))
+			}
+			switch v := arg(args, 0).(type) {
+			case float64:
+				return []value{v}
+			case string:
+				if base == 10 {
+					if n, ok := parseNumber(strings.TrimSpace(v)); ok {
+						return []value{n}
+					}
+					return []value{nil}
+				}
+				if n, err := strconv.ParseInt(strings.TrimSpace(v), base, 64); err == nil {
+					return []value{float64(n)}
+				}
+			}
+			return []value{nil}
+		}),
+
+		"tostring": builtin(func(args []value) []value {
+			switch v := arg(args, 0).(type) {
+			case nil:
+				return []value{"nil"}
+			case bool:
+				return []value{strconv.FormatBool(v)}
+			case float64, string:
+				s, _ := toString(v)
+				return []value{s}
+			}
+			return []value{fmt.Sprintf("%s: %p", typeName(args[0]), args[0])}
+		}),
+
+		"type": builtin(func(args []value) []value {
+			return []value{typeName(arg(args, 0))}
+		}),
+
+		"ipairs": builtin(func(args []value) []value {
+			t := tbl(args, 0, "ipairs")
+			next := builtin(func(args []value) []value {
+				i := args[1].(float64) + 1
+				v := t.get(i)
+				if v == nil {
+					return nil
+				}
+				return []value{i, v}
+			})
+			return []value{next, t, float64(0)}
+		}),
+
+		"pairs": builtin(func(args []value) []value {
+			t := tbl(args, 0, "pairs")
+			keys := t.keys()
+			i := 0
+			next := builtin(func(args []value) []value {
+				for ; i < len(keys); i++ {
+					if v := t.get(keys[i]); v != nil {
+						i++
+						return []value{keys[i-1], v}
+					}
+				}
+				return nil
+			})
+			return []value{next, t, nil}
+		}),
+
+		"error": builtin(func(args []value) []value {
+			v := arg(args, 0)
+			if t, ok := v.(*table); ok {
+				if msg, ok := t.get("err").(string); ok {
+					panic(&luaError{line: in.line, msg: msg, reply: gedis.Error(msg)})
+				}
+			}
+			msg, ok := toString(v)
+			if !ok {
+				msg = typeName(v)
+			}
+			in.errorf("%s", msg)
+			return nil
+		}),
+
+		"assert": builtin(func(args []value) []value {
+			if !truthy(arg(args, 0)) {
+				msg := "assertion failed!"
+				if s, ok := toString(arg(args, 1)); ok {
+					msg = s
+				}
+				in.errorf("%s", msg)
+			}
+			return args
+		}),
+	}
+}
+
+// Returns the keys of a table, the array part first and then the rest
+// sorted so iterating with pairs is stable
+func (t *table) keys() []value {
+	keys := make([]value, 0, len(t.arr)+len(t.hash))
+	for i := range t.arr {
+		keys = append(keys, float64(i+1))
+	}
+
+	var rest []value
+	for k := range t.hash {
+		rest = append(rest, k)
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return fmt.Sprint(rest[i]) < fmt.Sprint(rest[j])
+	})
+
+	return append(keys, rest...)
+}
+
+// string.format, supporting the %d, %i, %s, %f, %g, %e, %x, %X, %c, %q
+// and %% verbs with flags, width and precision
+func (in *interpreter) format(f string, args []value) string {
+	var b strings.Builder
+
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+
+		j := i + 1
+		for j < len(f) && strings.IndexByte("-+ #0123456789.", f[j]) >= 0 {
+			j++
+		}
+		if j >= len(f) {
+			in.errorf("invalid option '%%' to 'format'")
+		}
+
+		spec, verb := f[i:j], f[j]
+		i = j
+
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		if len(args) == 0 {
+			in.errorf("bad argument to 'format' (no value)")
+		}
+		arg := args[0]
+		args = args[1:]
+
+		switch verb {
+		case 'd', 'i', 'x', 'X', 'c':
+			n, ok := toNumber(arg)
+			if !ok {
+				in.errorf("bad argument to 'format' (number expected, got %s)", typeName(arg))
+			}
+			if verb == 'i' {
+				verb = 'd'
+			}
+			fmt.Fprintf(&b, spec+string(verb), int64(n))
+		case 'f', 'g', 'e', 'E', 'G':
+			n, ok := toNumber(arg)
+			if !ok {
+				in.errorf("bad argument to 'format' (number expected, got %s)", typeName(arg))
+			}
+			fmt.Fprintf(&b, spec+string(verb), n)
+		case 's':
+			s, ok := toString(arg)
+			if !ok {
+				in.errorf("bad argument to 'format' (string expected, got %s)", typeName(arg))
+			}
+			fmt.Fprintf(&b, spec+"s", s)
+		case 'q':
+			s, _ := toString(arg)
+			b.WriteString(strconv.Quote(s))
+		default:
+			in.errorf("invalid option '%%%c' to 'format'", verb)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,780 @@
+package redistest
+
+import (
+	"fmt"
+	"github.com/inkel/gedis"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ID of a stream entry
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// Parse an ID; a missing sequence number defaults to seq
+func parseStreamID(arg string, seq uint64) (streamID, bool) {
+	var id streamID
+	var err error
+
+	ms := arg
+	if i := strings.IndexByte(arg, '-'); i >= 0 {
+		ms = arg[:i]
+		if id.seq, err = strconv.ParseUint(arg[i+1:], 10, 64); err != nil {
+			return id, false
+		}
+	} else {
+		id.seq = seq
+	}
+
+	if id.ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, false
+	}
+
+	return id, true
+}
+
+var (
+	minStreamID = streamID{}
+	maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+	errStreamID = gedis.Error("ERR Invalid stream ID specified as stream command argument")
+)
+
+// Parse the start or end of a range, as in "-", "+" or "(1-0"
+func parseRangeID(arg string, end bool) (streamID, bool) {
+	switch arg {
+	case "-":
+		return minStreamID, true
+	case "+":
+		return maxStreamID, true
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+
+	var seq uint64
+	if end {
+		seq = math.MaxUint64
+	}
+
+	id, ok := parseStreamID(arg, seq)
+	if !ok || !exclusive {
+		return id, ok
+	}
+
+	// Exclusive bounds are the next or previous ID
+	switch {
+	case !end && id.seq < math.MaxUint64:
+		id.seq++
+	case !end && id.ms < math.MaxUint64:
+		id = streamID{id.ms + 1, 0}
+	case end && id.seq > 0:
+		id.seq--
+	case end && id.ms > 0:
+		id = streamID{id.ms - 1, math.MaxUint64}
+	default:
+		return id, false
+	}
+
+	return id, true
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+type stream struct {
+	entries []streamEntry
+	last    streamID
+	groups  map[string]*group
+}
+
+type group struct {
+	last streamID
+	pel  map[streamID]*pending
+}
+
+// An entry delivered to a consumer and not acknowledged yet
+type pending struct {
+	consumer  string
+	delivered time.Time
+	count     int64
+}
+
+func (st *stream) find(id streamID) (streamEntry, bool) {
+	i := sort.Search(len(st.entries), func(i int) bool { return !st.entries[i].id.less(id) })
+	if i < len(st.entries) && st.entries[i].id == id {
+		return st.entries[i], true
+	}
+	return streamEntry{}, false
+}
+
+// Returns the entries between start and end, at most count if greater
+// than zero
+func (st *stream) rangeOf(start, end streamID, count int64) []streamEntry {
+	var res []streamEntry
+	for _, e := range st.entries {
+		if e.id.less(start) || end.less(e.id) {
+			continue
+		}
+		if count > 0 && int64(len(res)) == count {
+			break
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// Returns the pending IDs of a group, sorted
+func (g *group) ids() []streamID {
+	ids := make([]streamID, 0, len(g.pel))
+	for id := range g.pel {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+func replyEntry(e streamEntry) interface{} {
+	fields := make([]interface{}, len(e.fields))
+	for i, f := range e.fields {
+		fields[i] = f
+	}
+	return []interface{}{e.id.String(), fields}
+}
+
+func replyEntries(entries []streamEntry) []interface{} {
+	res := []interface{}{}
+	for _, e := range entries {
+		res = append(res, replyEntry(e))
+	}
+	return res
+}
+
+func init() {
+	addCommands(map[string]command{
+		"XADD":       {fn: xadd, arity: -5, write: true},
+		"XLEN":       {fn: xlen, arity: 2},
+		"XDEL":       {fn: xdel, arity: -3, write: true},
+		"XRANGE":     {fn: xrange, arity: -4},
+		"XGROUP":     {fn: xgroup, arity: -2, write: true},
+		"XREADGROUP": {fn: xreadGroup, arity: -7, write: true, block: blockOption},
+		"XACK":       {fn: xack, arity: -4, write: true},
+		"XPENDING":   {fn: xpending, arity: -3},
+		"XCLAIM":     {fn: xclaim, arity: -6, write: true},
+		"XAUTOCLAIM": {fn: xautoclaim, arity: -6, write: true},
+	})
+}
+
+// Timeout of the commands taking a BLOCK milliseconds option
+func blockOption(args []string) (time.Duration, bool, error) {
+	for i := 0; i < len(args)-1; i++ {
+		switch strings.ToUpper(args[i]) {
+		case "STREAMS":
+			return 0, false, nil
+		case "BLOCK":
+			ms, valid := parseInt(args[i+1])
+			if !valid || ms < 0 {
+				return 0, false, gedis.Error("ERR timeout is not an integer or out of range")
+			}
+			return time.Duration(ms) * time.Millisecond, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Returns the stream stored at key, creating it if asked to
+func (s *Server) stream(key string, create bool) (*stream, gedis.Error) {
+	e := s.lookup(key)
+	if e == nil {
+		if !create {
+			return nil, ""
+		}
+		st := &stream{groups: make(map[string]*group)}
+		s.keys[key] = &entry{value: st}
+		return st, ""
+	}
+
+	st, ok := e.value.(*stream)
+	if !ok {
+		return nil, errWrongType
+	}
+	return st, ""
+}
+
+// Returns the group of a stream, or a NOGROUP error
+func (s *Server) group(key, name, cmd string) (*stream, *group, gedis.Error) {
+	st, err := s.stream(key, false)
+	if err != "" {
+		return nil, nil, err
+	}
+	if st != nil {
+		if g, ok := st.groups[name]; ok {
+			return st, g, ""
+		}
+	}
+	return nil, nil, gedis.Error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in %s command", key, name, cmd))
+}
+
+// XADD key [NOMKSTREAM] id|* field value [field value ...]
+func xadd(s *Server, args []string) interface{} {
+	key, args := args[0], args[1:]
+
+	create := true
+	if strings.ToUpper(args[0]) == "NOMKSTREAM" {
+		create = false
+		args = args[1:]
+	}
+
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArity("xadd")
+	}
+
+	st, err := s.stream(key, create)
+	if err != "" {
+		return err
+	}
+	if st == nil {
+		return nil
+	}
+
+	var id streamID
+	if args[0] == "*" {
+		ms := uint64(s.now().UnixNano() / int64(time.Millisecond))
+		if ms > st.last.ms {
+			id = streamID{ms, 0}
+		} else {
+			id = streamID{st.last.ms, st.last.seq + 1}
+		}
+	} else {
+		var ok bool
+		if id, ok = parseStreamID(args[0], 0); !ok {
+			return errStreamID
+		}
+		if !st.last.less(id) {
+			s.cleanup(key, len(st.entries)+len(st.groups))
+			return gedis.Error("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+
+	st.entries = append(st.entries, streamEntry{id, append([]string(nil), args[1:]...)})
+	st.last = id
+
+	return id.String()
+}
+
+func xlen(s *Server, args []string) interface{} {
+	st, err := s.stream(args[0], false)
+	if err != "" {
+		return err
+	}
+	if st == nil {
+		return int64(0)
+	}
+	return int64(len(st.entries))
+}
+
+func xdel(s *Server, args []string) interface{} {
+	ids := make(map[streamID]bool)
+	for _, arg := range args[1:] {
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			return errStreamID
+		}
+		ids[id] = true
+	}
+
+	st, err := s.stream(args[0], false)
+	if err != "" {
+		return err
+	}
+	if st == nil {
+		return int64(0)
+	}
+
+	var n int64
+	entries := st.entries[:0]
+	for _, e := range st.entries {
+		if ids[e.id] {
+			n++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	st.entries = entries
+
+	return n
+}
+
+// XRANGE key start end [COUNT count]
+func xrange(s *Server, args []string) interface{} {
+	start, ok1 := parseRangeID(args[1], false)
+	end, ok2 := parseRangeID(args[2], true)
+	if !ok1 || !ok2 {
+		return errStreamID
+	}
+
+	var count int64
+	switch {
+	case len(args) == 5 && strings.ToUpper(args[3]) == "COUNT":
+		var valid bool
+		if count, valid = parseInt(args[4]); !valid {
+			return errNotInteger
+		}
+		if count <= 0 {
+			return []interface{}{}
+		}
+	case len(args) != 3:
+		return errSyntax
+	}
+
+	st, err := s.stream(args[0], false)
+	if err != "" {
+		return err
+	}
+	if st == nil {
+		return []interface{}{}
+	}
+
+	return replyEntries(st.rangeOf(start, end, count))
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM], and XGROUP DESTROY key group
+func xgroup(s *Server, args []string) interface{} {
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "CREATE" && (len(args) == 4 || len(args) == 5):
+		mkstream := false
+		if len(args) == 5 {
+			if strings.ToUpper(args[4]) != "MKSTREAM" {
+				return errSyntax
+			}
+			mkstream = true
+		}
+
+		st, err := s.stream(args[1], mkstream)
+		if err != "" {
+			return err
+		}
+		if st == nil {
+			return gedis.Error("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+		}
+		if _, ok := st.groups[args[2]]; ok {
+			return gedis.Error("BUSYGROUP Consumer Group name already exists")
+		}
+
+		last := st.last
+		if args[3] != "$" {
+			var ok bool
+			if last, ok = parseStreamID(args[3], 0); !ok {
+				return errStreamID
+			}
+		}
+
+		st.groups[args[2]] = &group{last: last, pel: make(map[streamID]*pending)}
+
+		return statusOK
+
+	case sub == "DESTROY" && len(args) == 3:
+		st, err := s.stream(args[1], false)
+		if err != "" {
+			return err
+		}
+		if st == nil {
+			return int64(0)
+		}
+		if _, ok := st.groups[args[2]]; !ok {
+			return int64(0)
+		}
+		delete(st.groups, args[2])
+		return int64(1)
+	}
+
+	return gedis.Error("ERR unknown subcommand or wrong number of arguments for '" + args[0] + "'")
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] [NOACK]
+// STREAMS key [key ...] id [id ...]
+func xreadGroup(s *Server, args []string) interface{} {
+	if strings.ToUpper(args[0]) != "GROUP" {
+		return errSyntax
+	}
+	groupName, consumer := args[1], args[2]
+
+	var (
+		count int64
+		noack bool
+		keys  []string
+		ids   []string
+	)
+
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			var valid bool
+			if count, valid = parseInt(args[i]); !valid {
+				return errNotInteger
+			}
+		case "BLOCK":
+			i++
+		case "NOACK":
+			noack = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return gedis.Error("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+			}
+			keys, ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			i = len(args)
+		default:
+			return errSyntax
+		}
+	}
+
+	if keys == nil {
+		return errSyntax
+	}
+
+	now := s.now()
+	res := []interface{}{}
+	delivered := false
+
+	for i, key := range keys {
+		st, g, err := s.group(key, groupName, "XREADGROUP")
+		if err != "" {
+			return err
+		}
+
+		if ids[i] == ">" {
+			entries := st.rangeOf(streamID{g.last.ms, g.last.seq}, maxStreamID, 0)
+			if len(entries) > 0 && entries[0].id == g.last {
+				entries = entries[1:]
+			}
+			if count > 0 && int64(len(entries)) > count {
+				entries = entries[:count]
+			}
+			if len(entries) == 0 {
+				continue
+			}
+
+			for _, e := range entries {
+				if !noack {
+					g.pel[e.id] = &pending{consumer: consumer, delivered: now, count: 1}
+				}
+			}
+			g.last = entries[len(entries)-1].id
+
+			res = append(res, []interface{}{key, replyEntries(entries)})
+			delivered = true
+			continue
+		}
+
+		after, ok := parseStreamID(ids[i], 0)
+		if !ok {
+			return errStreamID
+		}
+
+		// The history of the consumer, with nil values for the
+		// entries deleted since
+		history := []interface{}{}
+		for _, id := range g.ids() {
+			p := g.pel[id]
+			if p.consumer != consumer || !after.less(id) {
+				continue
+			}
+			if count > 0 && int64(len(history)) == count {
+				break
+			}
+
+			p.delivered = now
+			p.count++
+
+			if e, ok := st.find(id); ok {
+				history = append(history, replyEntry(e))
+			} else {
+				history = append(history, []interface{}{id.String(), nil})
+			}
+		}
+
+		res = append(res, []interface{}{key, history})
+		delivered = true
+	}
+
+	if !delivered {
+		return nullArray{}
+	}
+	return res
+}
+
+func xack(s *Server, args []string) interface{} {
+	st, err := s.stream(args[0], false)
+	if err != "" {
+		return err
+	}
+	if st == nil {
+		return int64(0)
+	}
+
+	g, ok := st.groups[args[1]]
+	if !ok {
+		return int64(0)
+	}
+
+	var n int64
+	for _, arg := range args[2:] {
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			return errStreamID
+		}
+		if _, ok := g.pel[id]; ok {
+			delete(g.pel, id)
+			n++
+		}
+	}
+
+	return n
+}
+
+// XPENDING key group [[IDLE min-idle] start end count [consumer]]
+func xpending(s *Server, args []string) interface{} {
+	_, g, err := s.group(args[0], args[1], "XPENDING")
+	if err != "" {
+		return err
+	}
+
+	ids := g.ids()
+
+	if len(args) == 2 {
+		if len(ids) == 0 {
+			return []interface{}{int64(0), nil, nil, nil}
+		}
+
+		counts := make(map[string]int64)
+		for _, id := range ids {
+			counts[g.pel[id].consumer]++
+		}
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		consumers := []interface{}{}
+		for _, name := range names {
+			consumers = append(consumers, []interface{}{name, itoa(counts[name])})
+		}
+
+		return []interface{}{int64(len(ids)), ids[0].String(), ids[len(ids)-1].String(), consumers}
+	}
+
+	rest := args[2:]
+
+	var minIdle time.Duration
+	if strings.ToUpper(rest[0]) == "IDLE" {
+		if len(rest) < 2 {
+			return errSyntax
+		}
+		ms, valid := parseInt(rest[1])
+		if !valid {
+			return errNotInteger
+		}
+		minIdle = time.Duration(ms) * time.Millisecond
+		rest = rest[2:]
+	}
+
+	if len(rest) != 3 && len(rest) != 4 {
+		return errSyntax
+	}
+
+	start, ok1 := parseRangeID(rest[0], false)
+	end, ok2 := parseRangeID(rest[1], true)
+	if !ok1 || !ok2 {
+		return errStreamID
+	}
+	count, valid := parseInt(rest[2])
+	if !valid {
+		return errNotInteger
+	}
+
+	now := s.now()
+	res := []interface{}{}
+
+	for _, id := range ids {
+		if int64(len(res)) >= count {
+			break
+		}
+		if id.less(start) || end.less(id) {
+			continue
+		}
+
+		p := g.pel[id]
+		idle := now.Sub(p.delivered)
+		if idle < minIdle || (len(rest) == 4 && p.consumer != rest[3]) {
+			continue
+		}
+
+		res = append(res, []interface{}{id.String(), p.consumer, int64(idle / time.Millisecond), p.count})
+	}
+
+	return res
+}
+
+// XCLAIM key group consumer min-idle id [id ...] [JUSTID]
+func xclaim(s *Server, args []string) interface{} {
+	st, g, err := s.group(args[0], args[1], "XCLAIM")
+	if err != "" {
+		return err
+	}
+	consumer := args[2]
+
+	ms, valid := parseInt(args[3])
+	if !valid {
+		return errNotInteger
+	}
+	minIdle := time.Duration(ms) * time.Millisecond
+
+	var ids []streamID
+	justID := false
+
+	for _, arg := range args[4:] {
+		if strings.ToUpper(arg) == "JUSTID" {
+			justID = true
+			continue
+		}
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			return errStreamID
+		}
+		ids = append(ids, id)
+	}
+
+	now := s.now()
+	res := []interface{}{}
+
+	for _, id := range ids {
+		p, ok := g.pel[id]
+		if !ok || now.Sub(p.delivered) < minIdle {
+			continue
+		}
+
+		e, ok := st.find(id)
+		if !ok {
+			delete(g.pel, id)
+			continue
+		}
+
+		p.consumer = consumer
+		p.delivered = now
+		if !justID {
+			p.count++
+			res = append(res, replyEntry(e))
+		} else {
+			res = append(res, id.String())
+		}
+	}
+
+	return res
+}
+
+// XAUTOCLAIM key group consumer min-idle start [COUNT count] [JUSTID]
+//
+// Like Redis, it looks at up to ten times count pending entries, and
+// replies with the ID to continue from, or 0-0 once it scanned them
+// all, the claimed entries and the IDs of those no longer in the
+// stream, which are removed from the pending list.
+func xautoclaim(s *Server, args []string) interface{} {
+	st, g, err := s.group(args[0], args[1], "XAUTOCLAIM")
+	if err != "" {
+		return err
+	}
+	consumer := args[2]
+
+	ms, valid := parseInt(args[3])
+	if !valid {
+		return errNotInteger
+	}
+	minIdle := time.Duration(ms) * time.Millisecond
+
+	start, ok := parseRangeID(args[4], false)
+	if !ok {
+		return errStreamID
+	}
+
+	count := int64(100)
+	justID := false
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			if count, valid = parseInt(args[i]); !valid || count < 1 {
+				return gedis.Error("ERR COUNT must be > 0")
+			}
+		case "JUSTID":
+			justID = true
+		default:
+			return errSyntax
+		}
+	}
+
+	now := s.now()
+	attempts := count * 10
+	cursor := minStreamID
+	claimed := []interface{}{}
+	deleted := []interface{}{}
+
+	for _, id := range g.ids() {
+		if id.less(start) {
+			continue
+		}
+		if int64(len(claimed)) == count || attempts == 0 {
+			cursor = id
+			break
+		}
+		attempts--
+
+		p := g.pel[id]
+		if now.Sub(p.delivered) < minIdle {
+			continue
+		}
+
+		e, ok := st.find(id)
+		if !ok {
+			delete(g.pel, id)
+			deleted = append(deleted, id.String())
+			continue
+		}
+
+		p.consumer = consumer
+		p.delivered = now
+		if !justID {
+			p.count++
+			claimed = append(claimed, replyEntry(e))
+		} else {
+			claimed = append(claimed, id.String())
+		}
+	}
+
+	return []interface{}{cursor.String(), claimed, deleted}
+}
@@ -0,0 +1,408 @@
+package redistest
+
+import (
+	"github.com/inkel/gedis"
+	"sort"
+	"strings"
+)
+
+type zset struct {
+	scores map[string]float64
+}
+
+type member struct {
+	name  string
+	score float64
+}
+
+func init() {
+	addCommands(map[string]command{
+		"ZADD":             {fn: zadd, arity: -4, write: true},
+		"ZREM":             {fn: zrem, arity: -3, write: true},
+		"ZCARD":            {fn: zcard, arity: 2},
+		"ZSCORE":           {fn: zscore, arity: 3},
+		"ZCOUNT":           {fn: zcount, arity: 4},
+		"ZRANGE":           {fn: zrange, arity: -4},
+		"ZRANGEBYSCORE":    {fn: zrangeByScore, arity: -4},
+		"ZREMRANGEBYSCORE": {fn: zremRangeByScore, arity: 4, write: true},
+		"ZPOPMIN":          {fn: zpopMin, arity: -2, write: true},
+		"BZPOPMIN":         {fn: bzpopMin, arity: -3, write: true, block: lastTimeout},
+	})
+}
+
+// Returns the sorted set stored at key, creating it if asked to
+func (s *Server) zset(key string, create bool) (*zset, gedis.Error) {
+	e := s.lookup(key)
+	if e == nil {
+		if !create {
+			return nil, ""
+		}
+		z := &zset{scores: make(map[string]float64)}
+		s.keys[key] = &entry{value: z}
+		return z, ""
+	}
+
+	z, ok := e.value.(*zset)
+	if !ok {
+		return nil, errWrongType
+	}
+	return z, ""
+}
+
+// Returns the members sorted by score, and then by name
+func (z *zset) sorted() []member {
+	if z == nil {
+		return nil
+	}
+
+	members := make([]member, 0, len(z.scores))
+	for name, score := range z.scores {
+		members = append(members, member{name, score})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].name < members[j].name
+	})
+
+	return members
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] score member [score member ...]
+func zadd(s *Server, args []string) interface{} {
+	var nx, xx, gt, lt, ch bool
+
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errSyntax
+	}
+	if (nx && xx) || (gt && lt) || (nx && (gt || lt)) {
+		return gedis.Error("ERR XX and NX options at the same time are not compatible")
+	}
+
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		f, valid := parseFloat(pairs[2*j])
+		if !valid {
+			return errNotFloat
+		}
+		scores[j] = f
+	}
+
+	z, err := s.zset(args[0], !xx)
+	if err != "" {
+		return err
+	}
+	if z == nil {
+		return int64(0)
+	}
+
+	var added, changed int64
+	for j, score := range scores {
+		name := pairs[2*j+1]
+		old, found := z.scores[name]
+		switch {
+		case !found && xx, found && nx:
+			continue
+		case found && gt && score <= old, found && lt && score >= old:
+			continue
+		case !found:
+			added++
+		case old != score:
+			changed++
+		}
+		z.scores[name] = score
+	}
+
+	s.cleanup(args[0], len(z.scores))
+
+	if ch {
+		return added + changed
+	}
+	return added
+}
+
+func zrem(s *Server, args []string) interface{} {
+	z, err := s.zset(args[0], false)
+	if err != "" {
+		return err
+	}
+	if z == nil {
+		return int64(0)
+	}
+
+	var n int64
+	for _, name := range args[1:] {
+		if _, ok := z.scores[name]; ok {
+			delete(z.scores, name)
+			n++
+		}
+	}
+
+	s.cleanup(args[0], len(z.scores))
+
+	return n
+}
+
+func zcard(s *Server, args []string) interface{} {
+	z, err := s.zset(args[0], false)
+	if err != "" {
+		return err
+	}
+	if z == nil {
+		return int64(0)
+	}
+	return int64(len(z.scores))
+}
+
+func zscore(s *Server, args []string) interface{} {
+	z, err := s.zset(args[0], false)
+	if err != "" {
+		return err
+	}
+	if z == nil {
+		return nil
+	}
+	if score, ok := z.scores[args[1]]; ok {
+		return formatFloat(score)
+	}
+	return nil
+}
+
+// A score interval, as in "(1" or "-inf"
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseBound(arg string) (scoreBound, bool) {
+	var b scoreBound
+	if strings.HasPrefix(arg, "(") {
+		b.exclusive = true
+		arg = arg[1:]
+	}
+	f, valid := parseFloat(arg)
+	b.value = f
+	return b, valid
+}
+
+func (b scoreBound) above(score float64) bool {
+	if b.exclusive {
+		return score > b.value
+	}
+	return score >= b.value
+}
+
+func (b scoreBound) below(score float64) bool {
+	if b.exclusive {
+		return score < b.value
+	}
+	return score <= b.value
+}
+
+// Returns the members with scores between min and max
+func (s *Server) byScore(key, min, max string) ([]member, gedis.Error) {
+	lo, valid1 := parseBound(min)
+	hi, valid2 := parseBound(max)
+	if !valid1 || !valid2 {
+		return nil, gedis.Error("ERR min or max is not a float")
+	}
+
+	z, err := s.zset(key, false)
+	if err != "" {
+		return nil, err
+	}
+
+	var res []member
+	for _, m := range z.sorted() {
+		if lo.above(m.score) && hi.below(m.score) {
+			res = append(res, m)
+		}
+	}
+	return res, ""
+}
+
+func replyMembers(members []member, withScores bool) []interface{} {
+	res := []interface{}{}
+	for _, m := range members {
+		res = append(res, m.name)
+		if withScores {
+			res = append(res, formatFloat(m.score))
+		}
+	}
+	return res
+}
+
+func zcount(s *Server, args []string) interface{} {
+	members, err := s.byScore(args[0], args[1], args[2])
+	if err != "" {
+		return err
+	}
+	return int64(len(members))
+}
+
+// ZRANGE key start stop [WITHSCORES], by index only
+func zrange(s *Server, args []string) interface{} {
+	var withScores bool
+	for _, opt := range args[3:] {
+		if strings.ToUpper(opt) != "WITHSCORES" {
+			return errSyntax
+		}
+		withScores = true
+	}
+
+	start, valid1 := parseInt(args[1])
+	stop, valid2 := parseInt(args[2])
+	if !valid1 || !valid2 {
+		return errNotInteger
+	}
+
+	z, err := s.zset(args[0], false)
+	if err != "" {
+		return err
+	}
+
+	members := z.sorted()
+	from, to, ok := indexRange(start, stop, len(members))
+	if !ok {
+		return []interface{}{}
+	}
+	return replyMembers(members[from:to+1], withScores)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangeByScore(s *Server, args []string) interface{} {
+	var (
+		withScores bool
+		offset     int64
+		count      int64 = -1
+	)
+
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			var valid1, valid2 bool
+			offset, valid1 = parseInt(args[i+1])
+			count, valid2 = parseInt(args[i+2])
+			if !valid1 || !valid2 {
+				return errNotInteger
+			}
+			i += 2
+		default:
+			return errSyntax
+		}
+	}
+
+	members, err := s.byScore(args[0], args[1], args[2])
+	if err != "" {
+		return err
+	}
+
+	if offset < 0 || offset >= int64(len(members)) {
+		return []interface{}{}
+	}
+	members = members[offset:]
+	if count >= 0 && count < int64(len(members)) {
+		members = members[:count]
+	}
+
+	return replyMembers(members, withScores)
+}
+
+func zremRangeByScore(s *Server, args []string) interface{} {
+	members, err := s.byScore(args[0], args[1], args[2])
+	if err != "" {
+		return err
+	}
+	if len(members) == 0 {
+		return int64(0)
+	}
+
+	z, _ := s.zset(args[0], false)
+	for _, m := range members {
+		delete(z.scores, m.name)
+	}
+
+	s.cleanup(args[0], len(z.scores))
+
+	return int64(len(members))
+}
+
+// Remove the member with the lowest score
+func (s *Server) popMin(key string) (member, bool) {
+	z, _ := s.zset(key, false)
+	members := z.sorted()
+	if len(members) == 0 {
+		return member{}, false
+	}
+
+	delete(z.scores, members[0].name)
+	s.cleanup(key, len(z.scores))
+
+	return members[0], true
+}
+
+func zpopMin(s *Server, args []string) interface{} {
+	count := int64(1)
+	if len(args) > 2 {
+		return errSyntax
+	}
+	if len(args) == 2 {
+		var valid bool
+		if count, valid = parseInt(args[1]); !valid || count < 0 {
+			return gedis.Error("ERR value is out of range, must be positive")
+		}
+	}
+
+	if _, err := s.zset(args[0], false); err != "" {
+		return err
+	}
+
+	res := []interface{}{}
+	for i := int64(0); i < count; i++ {
+		m, ok := s.popMin(args[0])
+		if !ok {
+			break
+		}
+		res = append(res, m.name, formatFloat(m.score))
+	}
+	return res
+}
+
+func bzpopMin(s *Server, args []string) interface{} {
+	for _, key := range args[:len(args)-1] {
+		if _, err := s.zset(key, false); err != "" {
+			return err
+		}
+		if m, ok := s.popMin(key); ok {
+			return []interface{}{key, m.name, formatFloat(m.score)}
+		}
+	}
+	return nullArray{}
+}
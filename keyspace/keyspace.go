@@ -0,0 +1,317 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis keyspace - Redis keyspace notifications
+
+This package subscribes to the keyspace notifications published by a
+Redis server when keys are modified or expire, and delivers them as
+parsed events on a channel.
+
+Keyspace notifications: http://redis.io/topics/notifications
+
+Notifications are disabled by default; enable them in the server
+configuration or with Configure.
+
+Example
+
+    package main
+
+    import (
+    	"fmt"
+    	"github.com/inkel/gedis/client"
+    	"github.com/inkel/gedis/keyspace"
+    )
+
+    func main() {
+    	c, err := client.Dial("tcp", "localhost:6379")
+    	if err != nil {
+    		panic(err)
+    	}
+
+    	if err = keyspace.Configure(&c, "Ex"); err != nil {
+    		panic(err)
+    	}
+
+    	l, err := keyspace.ListenEvents(&c, 0, "expired")
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer l.Close()
+
+    	for e := range l.Events() {
+    		fmt.Println(e.Key, "expired")
+    	}
+    }
+*/
+package keyspace
+
+import (
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pass as the database to listen to the events of every database
+const AllDBs = -1
+
+// Number of events buffered before the listener stops reading from
+// the server
+const eventBuffer = 128
+
+// A change to a key
+type Event struct {
+	DB  int
+	Key string
+	// The type of event, i.e. set, del or expired
+	Event string
+}
+
+// Receives keyspace notifications on a dedicated connection
+type Listener struct {
+	c      *client.Client
+	events chan Event
+	done   chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// Enable keyspace notifications with CONFIG SET
+// notify-keyspace-events, using the flags described in the Redis
+// documentation, i.e. "KEA" for every event
+func Configure(s client.Sender, flags string) error {
+	_, err := s.Send("CONFIG", "SET", "notify-keyspace-events", flags)
+	return err
+}
+
+// Listen to the events on the keys matching pattern, through the
+// __keyspace@DB__ channels
+//
+// The client is used exclusively by the Listener from then on, and
+// closed along with it.
+func ListenKeys(c *client.Client, db int, pattern string) (*Listener, error) {
+	return listen(c, "__keyspace@"+dbString(db)+"__:"+pattern)
+}
+
+// Listen to the given types of events, i.e. "expired" or "del",
+// through the __keyevent@DB__ channels; with no events it listens to
+// all of them
+//
+// The client is used exclusively by the Listener from then on, and
+// closed along with it.
+func ListenEvents(c *client.Client, db int, events ...string) (*Listener, error) {
+	if len(events) == 0 {
+		events = []string{"*"}
+	}
+
+	patterns := make([]string, len(events))
+	for i, e := range events {
+		patterns[i] = "__keyevent@" + dbString(db) + "__:" + e
+	}
+
+	return listen(c, patterns...)
+}
+
+func dbString(db int) string {
+	if db < 0 {
+		return "*"
+	}
+	return strconv.Itoa(db)
+}
+
+func listen(c *client.Client, patterns ...string) (*Listener, error) {
+	args := []interface{}{"PSUBSCRIBE"}
+	for _, p := range patterns {
+		args = append(args, p)
+	}
+
+	// Each pattern is confirmed with its own reply
+	if _, err := c.Send(args...); err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(patterns); i++ {
+		if _, err := c.Read(); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Listener{
+		c:      c,
+		events: make(chan Event, eventBuffer),
+		done:   make(chan struct{}),
+	}
+
+	go l.loop()
+
+	return l, nil
+}
+
+// Returns the channel where events are delivered
+//
+// The channel is closed when the Listener is closed or the connection
+// fails. If events aren't received fast enough the Listener stops
+// reading from the server, which will eventually disconnect it.
+func (l *Listener) Events() <-chan Event {
+	return l.events
+}
+
+// Returns why the Listener stopped, or nil if it was closed
+func (l *Listener) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Stop listening and close the connection
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+	l.mu.Unlock()
+
+	return l.c.Close()
+}
+
+func (l *Listener) loop() {
+	defer close(l.events)
+
+	for {
+		res, err := l.c.Read()
+		if err != nil {
+			l.mu.Lock()
+			if !l.closed {
+				l.err = err
+			}
+			l.mu.Unlock()
+			return
+		}
+
+		var msg []string
+		if err = gedis.Scan(res, &msg); err != nil || len(msg) != 4 || msg[0] != "pmessage" {
+			continue
+		}
+
+		e, err := ParseEvent(msg[2], msg[3])
+		if err != nil {
+			continue
+		}
+
+		select {
+		case l.events <- e:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Parse a notification published on a __keyspace@DB__ or
+// __keyevent@DB__ channel
+func ParseEvent(channel, message string) (Event, error) {
+	var e Event
+
+	var kind string
+
+	switch {
+	case strings.HasPrefix(channel, "__keyspace@"):
+		kind = "keyspace"
+	case strings.HasPrefix(channel, "__keyevent@"):
+		kind = "keyevent"
+	default:
+		return e, fmt.Errorf("keyspace: unexpected channel %q", channel)
+	}
+
+	rest := channel[len(kind)+3:]
+
+	i := strings.Index(rest, "__:")
+	if i < 0 {
+		return e, fmt.Errorf("keyspace: unexpected channel %q", channel)
+	}
+
+	db, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return e, errors.New("keyspace: invalid database in " + channel)
+	}
+
+	e.DB = db
+
+	if kind == "keyspace" {
+		e.Key, e.Event = rest[i+3:], message
+	} else {
+		e.Key, e.Event = message, rest[i+3:]
+	}
+
+	return e, nil
+}
+
+// Returns a channel with only the events from in for which keep
+// returns true
+//
+// The returned channel is closed when in is closed.
+func Filter(in <-chan Event, keep func(e Event) bool) <-chan Event {
+	out := make(chan Event, eventBuffer)
+
+	go func() {
+		defer close(out)
+		for e := range in {
+			if keep(e) {
+				out <- e
+			}
+		}
+	}()
+
+	return out
+}
+
+// Keep the events of the given types
+func IsEvent(events ...string) func(e Event) bool {
+	return func(e Event) bool {
+		for _, name := range events {
+			if e.Event == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keep the events on keys starting with prefix
+func HasPrefix(prefix string) func(e Event) bool {
+	return func(e Event) bool {
+		return strings.HasPrefix(e.Key, prefix)
+	}
+}
+
+// Keep the events on the given database
+func InDB(db int) func(e Event) bool {
+	return func(e Event) bool {
+		return e.DB == db
+	}
+}
@@ -0,0 +1,136 @@
+package keyspace
+
+import (
+	"github.com/inkel/gedis/client"
+	"github.com/inkel/gedis/internal/redistest"
+	"testing"
+	"time"
+)
+
+func dial(t *testing.T, s *redistest.Server) *client.Client {
+	c, err := client.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &c
+}
+
+func publish(t *testing.T, s *redistest.Server, channel, message string) {
+	t.Helper()
+	if n := s.Publish(channel, message); n != 1 {
+		t.Fatalf("%s: expected 1 subscriber, got %d", channel, n)
+	}
+}
+
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("The events channel was closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for an event")
+	}
+
+	return Event{}
+}
+
+func TestListenKeys(t *testing.T) {
+	s := redistest.NewServer(t)
+	c := dial(t, s)
+
+	if err := Configure(c, "KEA"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	res, err := c.Send("CONFIG", "GET", "notify-keyspace-events")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if flags := res.([]interface{}); len(flags) != 2 || flags[1] != "KEA" {
+		t.Fatalf("Unexpected flags: %q", flags)
+	}
+
+	l, err := ListenKeys(c, 0, "user:*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	publish(t, s, "__keyspace@0__:user:1", "set")
+
+	e := next(t, l.Events())
+	if e != (Event{DB: 0, Key: "user:1", Event: "set"}) {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+}
+
+func TestListenEvents(t *testing.T) {
+	s := redistest.NewServer(t)
+
+	l, err := ListenEvents(dial(t, s), AllDBs, "expired", "del")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	events := Filter(l.Events(), HasPrefix("session:"))
+
+	// Only the events listened to are delivered
+	if n := s.Publish("__keyevent@3__:set", "session:1"); n != 0 {
+		t.Fatalf("Unexpected subscribers: %d", n)
+	}
+
+	publish(t, s, "__keyevent@3__:del", "user:1")
+	publish(t, s, "__keyevent@3__:expired", "session:1")
+
+	e := next(t, events)
+	if e != (Event{DB: 3, Key: "session:1", Event: "expired"}) {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+
+	l.Close()
+
+	if _, ok := <-events; ok {
+		t.Fatal("The events channel should be closed")
+	}
+
+	if err = l.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	e, err := ParseEvent("__keyspace@12__:a:b", "hset")
+	if err != nil || e != (Event{DB: 12, Key: "a:b", Event: "hset"}) {
+		t.Fatalf("Unexpected %+v, %v", e, err)
+	}
+
+	e, err = ParseEvent("__keyevent@0__:expire", "key")
+	if err != nil || e != (Event{DB: 0, Key: "key", Event: "expire"}) {
+		t.Fatalf("Unexpected %+v, %v", e, err)
+	}
+
+	for _, channel := range []string{"news", "__keyspace@x__:a", "__keyevent@0__"} {
+		if _, err = ParseEvent(channel, "set"); err == nil {
+			t.Fatalf("Expected an error for %q", channel)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	e := Event{DB: 1, Key: "user:1", Event: "del"}
+
+	if !IsEvent("set", "del")(e) || IsEvent("set")(e) {
+		t.Fatal("Unexpected IsEvent result")
+	}
+	if !HasPrefix("user:")(e) || HasPrefix("session:")(e) {
+		t.Fatal("Unexpected HasPrefix result")
+	}
+	if !InDB(1)(e) || InDB(0)(e) {
+		t.Fatal("Unexpected InDB result")
+	}
+}
@@ -0,0 +1,349 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis lock - Distributed locks on top of Redis
+
+This package implements mutual exclusion backed by one Redis server, or
+by several independent servers using the Redlock algorithm.
+
+Redlock: http://redis.io/topics/distlock
+
+Each lock is a key holding a random token, set with SET NX PX. The
+token is checked by a Lua script before releasing or extending the
+lock, so a client never releases a lock that expired and was acquired
+by someone else.
+
+Example
+
+    package main
+
+    import (
+    	"context"
+    	"github.com/inkel/gedis/client"
+    	"github.com/inkel/gedis/lock"
+    	"time"
+    )
+
+    func main() {
+    	c, err := client.DialMux("tcp", "localhost:6379")
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer c.Close()
+
+    	l, err := lock.New(c).Acquire(context.Background(), "resource", 10*time.Second)
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer l.Release()
+
+    	// Keep the lock while we work
+    	l.KeepAlive()
+
+    	select {
+    	case <-l.Lost():
+    		panic("lost the lock")
+    	case <-time.After(time.Minute):
+    	}
+    }
+*/
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/inkel/gedis/client"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// Returned by Acquire when the lock is held by someone else
+var ErrNotAcquired = errors.New("lock: not acquired")
+
+// Returned by Release and Extend when the lock expired or is held by
+// someone else
+var ErrNotHeld = errors.New("lock: not held")
+
+var releaseScript = client.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+var extendScript = client.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Creates locks on one or more independent Redis servers
+//
+// With a single server a lock is acquired when the key is set. With
+// more servers the Redlock algorithm is used: a lock is acquired when
+// it is set in a majority of the servers before it expires, taking
+// into account the possible drift between their clocks.
+//
+// Senders must be safe for concurrent use if KeepAlive is used, i.e.
+// a client.MuxClient.
+type Locker struct {
+	senders []client.Sender
+
+	// Fraction of the TTL of a lock allowed as clock drift between
+	// servers, defaults to 0.01
+	DriftFactor float64
+	// Number of times Acquire tries to get the lock, defaults to 3
+	Retries int
+	// Maximum time to wait between tries, defaults to 200ms; the
+	// actual delay is random
+	RetryDelay time.Duration
+}
+
+// Create a Locker on the given servers
+func New(senders ...client.Sender) *Locker {
+	return &Locker{
+		senders:     senders,
+		DriftFactor: 0.01,
+		Retries:     3,
+		RetryDelay:  200 * time.Millisecond,
+	}
+}
+
+// A lock held on a key
+type Lock struct {
+	l     *Locker
+	key   string
+	token string
+	ttl   time.Duration
+
+	mu       sync.Mutex
+	until    time.Time
+	stop     chan struct{}
+	lost     chan struct{}
+	released bool
+}
+
+// Acquire a lock on key, valid for ttl
+//
+// Returns ErrNotAcquired if the lock is still held by someone else
+// after all the retries.
+func (l *Locker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	if len(l.senders) == 0 {
+		return nil, errors.New("lock: no servers")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	lk := &Lock{
+		l:     l,
+		key:   key,
+		token: token,
+		ttl:   ttl,
+		lost:  make(chan struct{}),
+	}
+
+	for try := 0; try < l.Retries || try == 0; try++ {
+		if try > 0 {
+			delay := time.Duration(mrand.Int63n(int64(l.RetryDelay) + 1))
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		until, ok := l.quorum(ttl, func(s client.Sender) bool {
+			res, err := s.Send("SET", key, token, "NX", "PX", ttl.Milliseconds())
+			return err == nil && res != nil
+		})
+
+		if ok {
+			lk.until = until
+			return lk, nil
+		}
+
+		// Undo the partial acquisition
+		lk.releaseAll()
+	}
+
+	return nil, ErrNotAcquired
+}
+
+// Run fn on every server, concurrently, returning until when the lock
+// is valid and whether fn succeeded on a majority of the servers in
+// time
+func (l *Locker) quorum(ttl time.Duration, fn func(s client.Sender) bool) (time.Time, bool) {
+	start := time.Now()
+
+	results := make(chan bool, len(l.senders))
+	for _, s := range l.senders {
+		go func(s client.Sender) {
+			results <- fn(s)
+		}(s)
+	}
+
+	n := 0
+	for range l.senders {
+		if <-results {
+			n++
+		}
+	}
+
+	// Redlock adds 2ms to the drift to account for the
+	// granularity of the expiration in Redis
+	drift := time.Duration(float64(ttl)*l.DriftFactor) + 2*time.Millisecond
+	until := start.Add(ttl - drift)
+
+	return until, n >= len(l.senders)/2+1 && time.Now().Before(until)
+}
+
+func (lk *Lock) releaseAll() int {
+	n := 0
+	for _, s := range lk.l.senders {
+		res, err := releaseScript.Run(s, []string{lk.key}, lk.token)
+		if err == nil && res == int64(1) {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the key of the lock
+func (lk *Lock) Key() string {
+	return lk.key
+}
+
+// Returns the random token identifying this holder of the lock
+//
+// Pass it along to other systems to detect requests made by a holder
+// that lost the lock.
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// Returns until when the lock is known to be valid
+func (lk *Lock) Until() time.Time {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	return lk.until
+}
+
+// Release the lock
+//
+// Returns ErrNotHeld if the lock had already expired, on all servers.
+func (lk *Lock) Release() error {
+	lk.mu.Lock()
+	if lk.stop != nil && !lk.released {
+		close(lk.stop)
+	}
+	lk.released = true
+	lk.mu.Unlock()
+
+	if lk.releaseAll() == 0 {
+		return ErrNotHeld
+	}
+
+	return nil
+}
+
+// Extend the validity of the lock to ttl from now
+//
+// Returns ErrNotHeld if the lock expired or couldn't be extended on a
+// majority of the servers.
+func (lk *Lock) Extend(ttl time.Duration) error {
+	until, ok := lk.l.quorum(ttl, func(s client.Sender) bool {
+		res, err := extendScript.Run(s, []string{lk.key}, lk.token, ttl.Milliseconds())
+		return err == nil && res == int64(1)
+	})
+
+	if !ok {
+		return ErrNotHeld
+	}
+
+	lk.mu.Lock()
+	lk.until = until
+	lk.ttl = ttl
+	lk.mu.Unlock()
+
+	return nil
+}
+
+// Extend the lock in a background goroutine every third of its TTL,
+// until it is released
+//
+// If the lock can't be extended the Lost channel is closed.
+func (lk *Lock) KeepAlive() {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	if lk.stop != nil || lk.released {
+		return
+	}
+
+	lk.stop = make(chan struct{})
+
+	go lk.keepAlive(lk.stop)
+}
+
+func (lk *Lock) keepAlive(stop chan struct{}) {
+	for {
+		lk.mu.Lock()
+		ttl := lk.ttl
+		lk.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(ttl / 3):
+		}
+
+		if err := lk.Extend(ttl); err != nil {
+			select {
+			case <-stop:
+				// Released while extending
+			default:
+				close(lk.lost)
+			}
+			return
+		}
+	}
+}
+
+// Returns a channel that is closed when KeepAlive fails to extend the
+// lock
+func (lk *Lock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
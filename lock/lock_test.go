@@ -0,0 +1,183 @@
+package lock
+
+import (
+	"context"
+	"github.com/inkel/gedis/client"
+	"github.com/inkel/gedis/internal/redistest"
+	"testing"
+	"time"
+)
+
+func dial(t *testing.T, servers ...*redistest.Server) []client.Sender {
+	var senders []client.Sender
+
+	for _, s := range servers {
+		m, err := client.DialMux("tcp", s.Addr())
+		if err != nil {
+			t.Fatalf("Cannot dial: %v", err)
+		}
+		t.Cleanup(func() { m.Close() })
+		senders = append(senders, m)
+	}
+
+	return senders
+}
+
+func TestLock(t *testing.T) {
+	s := redistest.NewServer(t)
+	l := New(dial(t, s)...)
+	l.RetryDelay = time.Millisecond
+
+	ctx := context.Background()
+
+	lk, err := l.Acquire(ctx, "resource", time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(lk.Token()) != 32 {
+		t.Fatalf("Unexpected token: %q", lk.Token())
+	}
+
+	if _, err = l.Acquire(ctx, "resource", time.Second); err != ErrNotAcquired {
+		t.Fatalf("Expected ErrNotAcquired, got %v", err)
+	}
+
+	if v, _ := s.Get("resource"); v != lk.Token() {
+		t.Fatalf("Unexpected value: %q", v)
+	}
+
+	if err = lk.Extend(2 * time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if ttl := s.TTL("resource"); ttl <= time.Second || ttl > 2*time.Second {
+		t.Fatalf("The lock wasn't extended: %v", ttl)
+	}
+
+	if err = lk.Release(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if s.Exists("resource") {
+		t.Fatal("The lock wasn't released")
+	}
+
+	if err = lk.Release(); err != ErrNotHeld {
+		t.Fatalf("Expected ErrNotHeld, got %v", err)
+	}
+
+	other, err := l.Acquire(ctx, "resource", time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A stale holder can't extend or release a lock acquired by
+	// someone else
+	if err = lk.Extend(5 * time.Second); err != ErrNotHeld {
+		t.Fatalf("Expected ErrNotHeld, got %v", err)
+	}
+
+	if err = lk.Release(); err != ErrNotHeld {
+		t.Fatalf("Expected ErrNotHeld, got %v", err)
+	}
+
+	if v, _ := s.Get("resource"); v != other.Token() || s.TTL("resource") > time.Second {
+		t.Fatalf("The lock of the new holder was modified: %q %v", v, s.TTL("resource"))
+	}
+
+	other.Release()
+}
+
+func TestLock_expires(t *testing.T) {
+	s := redistest.NewServer(t)
+	l := New(dial(t, s)...)
+
+	lk, err := l.Acquire(context.Background(), "resource", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	s.Advance(30 * time.Millisecond)
+
+	if _, err = l.Acquire(context.Background(), "resource", time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = lk.Release(); err != ErrNotHeld {
+		t.Fatalf("Expected ErrNotHeld, got %v", err)
+	}
+}
+
+func TestLock_KeepAlive(t *testing.T) {
+	s := redistest.NewServer(t)
+	l := New(dial(t, s)...)
+
+	lk, err := l.Acquire(context.Background(), "resource", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	lk.KeepAlive()
+
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case <-lk.Lost():
+		t.Fatal("The lock was lost")
+	default:
+	}
+
+	if err = lk.Release(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Losing the lock is reported
+	lk, err = l.Acquire(context.Background(), "resource", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	lk.KeepAlive()
+	s.SetFailure("ERR down")
+
+	select {
+	case <-lk.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("Losing the lock wasn't reported")
+	}
+}
+
+func TestRedlock(t *testing.T) {
+	a, b, c := redistest.NewServer(t), redistest.NewServer(t), redistest.NewServer(t)
+	l := New(dial(t, a, b, c)...)
+	l.RetryDelay = time.Millisecond
+
+	ctx := context.Background()
+
+	// A minority of the servers being down doesn't matter
+	c.SetFailure("ERR down")
+
+	lk, err := l.Acquire(ctx, "resource", time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = lk.Extend(time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	lk.Release()
+
+	// But a majority does
+	b.SetFailure("ERR down")
+
+	if _, err = l.Acquire(ctx, "resource", time.Second); err != ErrNotAcquired {
+		t.Fatalf("Expected ErrNotAcquired, got %v", err)
+	}
+
+	// And the partial acquisition is undone
+	if a.Exists("resource") {
+		t.Fatal("The lock wasn't released after failing to acquire it")
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis mock - Test doubles for Redis clients
+
+This package lets code that talks to Redis through a client.Sender,
+which every client in the client package implements, be tested
+without a live server.
+
+Mock replies to the commands that the test expects with canned
+replies. Recorder captures the traffic of a real client to a file, and
+Replayer plays it back later.
+
+Example
+
+    func TestVisits(t *testing.T) {
+    	m := mock.New()
+    	m.Expect("INCR", "visits").Reply(int64(1))
+    	m.Expect("EXPIRE", "visits", 60).Reply(int64(1))
+
+    	// countVisit(s client.Sender) is the code being tested
+    	if err := countVisit(m); err != nil {
+    		t.Fatal(err)
+    	}
+
+    	if err := m.Verify(); err != nil {
+    		t.Fatal(err)
+    	}
+    }
+*/
+package mock
+
+import (
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var _ client.Sender = (*Mock)(nil)
+
+// A command a Mock expects, and what it replies
+type Expectation struct {
+	args  []string
+	reply interface{}
+	err   error
+	times int
+	calls int
+
+	// Why the expected arguments can't be sent, reported by Verify
+	invalid error
+}
+
+// Set the reply to the command
+func (e *Expectation) Reply(reply interface{}) *Expectation {
+	e.reply = reply
+	return e
+}
+
+// Reply to the command with an error; use gedis.Error for error
+// replies of the server
+func (e *Expectation) Error(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// Expect the command n times instead of once
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+func (e *Expectation) String() string {
+	return formatArgs(e.args)
+}
+
+// A client.Sender that replies to expected commands
+//
+// Arguments are compared as they would be sent to the server, so an
+// expected 1 matches "1". It is safe for concurrent use.
+type Mock struct {
+	mu         sync.Mutex
+	expected   []*Expectation
+	unexpected []string
+
+	// Whether commands must be sent in the order they were
+	// expected, the default
+	Ordered bool
+}
+
+// Create a new Mock expecting commands in order
+func New() *Mock {
+	return &Mock{Ordered: true}
+}
+
+// Expect a command, replying nil unless told otherwise
+//
+// Arguments that can't be sent to the server make Verify fail.
+func (m *Mock) Expect(args ...interface{}) *Expectation {
+	e := &Expectation{times: 1}
+	if e.args, e.invalid = encodeArgs(args); e.invalid != nil {
+		for _, arg := range args {
+			e.args = append(e.args, fmt.Sprint(arg))
+		}
+	}
+
+	m.mu.Lock()
+	m.expected = append(m.expected, e)
+	m.mu.Unlock()
+
+	return e
+}
+
+// Reply to a command if it's expected, or return an error otherwise
+func (m *Mock) Send(args ...interface{}) (interface{}, error) {
+	cmd, err := encodeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.expected {
+		if e.calls == e.times || e.invalid != nil {
+			continue
+		}
+
+		if equalArgs(e.args, cmd) {
+			e.calls++
+			return e.reply, e.err
+		}
+
+		if m.Ordered {
+			break
+		}
+	}
+
+	m.unexpected = append(m.unexpected, formatArgs(cmd))
+
+	return nil, fmt.Errorf("mock: unexpected command %s", formatArgs(cmd))
+}
+
+// Returns an error describing the commands that were expected but not
+// sent, and the unexpected ones that were sent
+func (m *Mock) Verify() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var problems []string
+
+	for _, e := range m.expected {
+		if e.invalid != nil {
+			problems = append(problems, fmt.Sprintf("cannot expect %s: %v", e, e.invalid))
+		} else if e.calls < e.times {
+			problems = append(problems, fmt.Sprintf("expected %s %d times, got %d", e, e.times, e.calls))
+		}
+	}
+
+	for _, cmd := range m.unexpected {
+		problems = append(problems, "unexpected "+cmd)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("mock: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Encode arguments as they are sent to the server
+func encodeArgs(args []interface{}) ([]string, error) {
+	res := make([]string, len(args))
+	for i, arg := range args {
+		bs, err := gedis.AppendArg(nil, arg)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = bulkValue(bs)
+	}
+	return res, nil
+}
+
+// Strip the $n\r\n header and \r\n trailer of an encoded bulk
+func bulkValue(bs []byte) string {
+	s := string(bs)
+	if i := strings.Index(s, "\r\n"); i >= 0 && strings.HasSuffix(s, "\r\n") {
+		return s[i+2 : len(s)-2]
+	}
+	return s
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if i == 0 {
+			if !strings.EqualFold(a[i], b[i]) {
+				return false
+			}
+		} else if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
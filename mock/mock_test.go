@@ -0,0 +1,93 @@
+package mock
+
+import (
+	"errors"
+	"github.com/inkel/gedis"
+	"strings"
+	"testing"
+)
+
+func TestMock(t *testing.T) {
+	m := New()
+	m.Expect("SET", "key", 1).Reply(gedis.Status("OK"))
+	m.Expect("GET", "key").Reply("1").Times(2)
+
+	res, err := m.Send("set", "key", "1")
+	if err != nil || res != gedis.Status("OK") {
+		t.Fatalf("Unexpected %#v, %v", res, err)
+	}
+
+	if err = m.Verify(); err == nil || !strings.Contains(err.Error(), `expected "GET" "key" 2 times, got 0`) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if res, err = m.Send("GET", "key"); err != nil || res != "1" {
+			t.Fatalf("Unexpected %#v, %v", res, err)
+		}
+	}
+
+	if err = m.Verify(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = m.Send("GET", "key"); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if err = m.Verify(); err == nil || !strings.Contains(err.Error(), `unexpected "GET" "key"`) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestMock_ordered(t *testing.T) {
+	m := New()
+	m.Expect("INCR", "a")
+	m.Expect("INCR", "b")
+
+	if _, err := m.Send("INCR", "b"); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	m = New()
+	m.Ordered = false
+	m.Expect("INCR", "a")
+	m.Expect("INCR", "b")
+
+	for _, k := range []string{"b", "a"} {
+		if _, err := m.Send("INCR", k); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if err := m.Verify(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestMock_errors(t *testing.T) {
+	m := New()
+	m.Expect("GET", "list").Error(gedis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	m.Expect("PING").Error(errors.New("connection reset"))
+
+	if _, err := m.Send("GET", "list"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := m.Send("PING"); err == nil || err.Error() != "connection reset" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestMock_invalidArgs(t *testing.T) {
+	m := New()
+	m.Expect("SET", "key", struct{}{})
+
+	if _, err := m.Send("SET", "key", struct{}{}); err == nil || strings.HasPrefix(err.Error(), "mock:") {
+		t.Fatalf("Expected the encoding error, got %v", err)
+	}
+
+	if err := m.Verify(); err == nil || !strings.Contains(err.Error(), `cannot expect "SET" "key" "{}"`) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
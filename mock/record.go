@@ -0,0 +1,176 @@
+package mock
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"io"
+	"strconv"
+	"sync"
+)
+
+var (
+	_ client.Sender = (*Recorder)(nil)
+	_ client.Sender = (*Replayer)(nil)
+)
+
+// A client.Sender that writes the commands sent through another
+// Sender, and their replies, to w
+//
+// The recording uses the Redis protocol: each command is written as a
+// multi-bulk followed by its reply. Errors that aren't error replies
+// from the server, like network errors, are recorded as error replies.
+type Recorder struct {
+	s client.Sender
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Record the traffic of s to w
+func NewRecorder(s client.Sender, w io.Writer) *Recorder {
+	return &Recorder{s: s, w: w}
+}
+
+// Send a command and record it along with its reply
+func (r *Recorder) Send(args ...interface{}) (interface{}, error) {
+	res, err := r.s.Send(args...)
+
+	cmd, encErr := gedis.EncodeCommand(args...)
+	if encErr != nil {
+		return res, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(cmd)
+	if err != nil {
+		encodeReply(&buf, err)
+	} else {
+		encodeReply(&buf, res)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, werr := r.w.Write(buf.Bytes()); werr != nil && err == nil {
+		err = werr
+	}
+
+	return res, err
+}
+
+// Write a reply in the Redis protocol, keeping its type
+func encodeReply(buf *bytes.Buffer, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		buf.WriteString("$-1\r\n")
+	case gedis.Status:
+		buf.Write(gedis.WriteStatus(string(reply)))
+	case string:
+		buf.Write(gedis.WriteBulk(reply))
+	case int64:
+		buf.Write(gedis.WriteInt(reply))
+	case error:
+		// Unlike gedis.WriteError, keep the message as is so error
+		// replies are replayed unchanged
+		buf.WriteByte('-')
+		buf.WriteString(reply.Error())
+		buf.WriteString("\r\n")
+	case []interface{}:
+		buf.WriteByte('*')
+		buf.WriteString(strconv.Itoa(len(reply)))
+		buf.WriteString("\r\n")
+		for _, r := range reply {
+			encodeReply(buf, r)
+		}
+	default:
+		buf.Write(gedis.WriteBulk(fmt.Sprint(reply)))
+	}
+}
+
+// A recorded command and its reply
+type exchange struct {
+	args  []string
+	reply interface{}
+	err   error
+}
+
+// A client.Sender that replies with the traffic recorded by a Recorder
+//
+// Commands must be sent in the same order they were recorded. It is
+// safe for concurrent use, although concurrent commands would be
+// replayed in an unpredictable order.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []exchange
+	next      int
+}
+
+// Load a recording made by a Recorder
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	br := bufio.NewReader(r)
+	p := &Replayer{}
+
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return p, nil
+		}
+
+		cmd, err := gedis.Read(br)
+		if err != nil {
+			return nil, err
+		}
+
+		var args []string
+		if err = gedis.Scan(cmd, &args); err != nil || len(args) == 0 {
+			return nil, fmt.Errorf("mock: invalid recorded command %#v", cmd)
+		}
+
+		reply, err := gedis.Read(br)
+		if _, ok := err.(gedis.Error); err != nil && !ok {
+			return nil, err
+		}
+
+		p.exchanges = append(p.exchanges, exchange{args, reply, err})
+	}
+}
+
+// Reply with the recorded reply if the command is the next one in the
+// recording, or return an error otherwise
+func (p *Replayer) Send(args ...interface{}) (interface{}, error) {
+	cmd, err := encodeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next == len(p.exchanges) {
+		return nil, fmt.Errorf("mock: unexpected command %s after the end of the recording", formatArgs(cmd))
+	}
+
+	e := p.exchanges[p.next]
+	if !equalArgs(e.args, cmd) {
+		return nil, fmt.Errorf("mock: expected command %s, got %s", formatArgs(e.args), formatArgs(cmd))
+	}
+
+	p.next++
+
+	return e.reply, e.err
+}
+
+// Returns an error if some recorded commands weren't replayed
+func (p *Replayer) Verify() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next < len(p.exchanges) {
+		return fmt.Errorf("mock: %d recorded commands not sent, starting with %s",
+			len(p.exchanges)-p.next, formatArgs(p.exchanges[p.next].args))
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package mock
+
+import (
+	"bytes"
+	"github.com/inkel/gedis"
+	"reflect"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	m := New()
+	m.Expect("SET", "key", "lorem").Reply(gedis.Status("OK"))
+	m.Expect("GET", "key").Reply("lorem")
+	m.Expect("GET", "missing")
+	m.Expect("HGETALL", "hash").Reply([]interface{}{"a", "1", "b", "2"})
+	m.Expect("INCR", "key").Error(gedis.Error("ERR value is not an integer or out of range"))
+	m.Expect("DEL", "key").Reply(int64(1))
+
+	var buf bytes.Buffer
+	r := NewRecorder(m, &buf)
+
+	type exchange struct {
+		args  []interface{}
+		reply interface{}
+		err   error
+	}
+
+	var recorded []exchange
+
+	for _, args := range [][]interface{}{
+		{"SET", "key", "lorem"},
+		{"GET", "key"},
+		{"GET", "missing"},
+		{"HGETALL", "hash"},
+		{"INCR", "key"},
+		{"DEL", "key"},
+	} {
+		res, err := r.Send(args...)
+		recorded = append(recorded, exchange{args, res, err})
+	}
+
+	p, err := NewReplayer(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = p.Verify(); err == nil {
+		t.Fatal("Expected an error before replaying")
+	}
+
+	for _, e := range recorded {
+		res, err := p.Send(e.args...)
+		if !reflect.DeepEqual(res, e.reply) || !reflect.DeepEqual(err, e.err) {
+			t.Fatalf("%v: expected %#v, %v; got %#v, %v", e.args, e.reply, e.err, res, err)
+		}
+	}
+
+	if err = p.Verify(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = p.Send("PING"); err == nil {
+		t.Fatal("Expected an error after the end of the recording")
+	}
+}
+
+func TestReplayer_mismatch(t *testing.T) {
+	m := New()
+	m.Expect("GET", "a").Reply("1")
+
+	var buf bytes.Buffer
+	NewRecorder(m, &buf).Send("GET", "a")
+
+	p, err := NewReplayer(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = p.Send("GET", "b"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,604 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis queue - Reliable job queues on top of Redis
+
+This package implements a job queue using Redis lists. Jobs taken by a
+worker are moved atomically, by a script, to a list of jobs being
+processed by that worker, so they aren't lost if the worker dies.
+Jobs that aren't acknowledged within a visibility timeout are put
+back in the queue, and failed jobs are retried with backoff until
+they run out of attempts.
+
+The keys of a queue named "emails" are:
+
+    queue:emails:ready               jobs waiting to be processed
+    queue:emails:scheduled           delayed jobs, scored by when to run
+    queue:emails:inflight            jobs being processed, scored by
+                                     their visibility deadline
+    queue:emails:processing:WORKER   jobs being processed by WORKER
+    queue:emails:failed              jobs that ran out of attempts
+    queue:emails:job:ID              the payload and state of a job
+
+Taking a job and putting it back in the queue are done by scripts that
+build the keys of the jobs, and of the processing lists, from the IDs
+they find, as they can't be known in advance. Redis Cluster requires
+every key used by a script to be given in KEYS, so every key of a queue
+must live in a single Redis server.
+
+Example
+
+    package main
+
+    import (
+    	"context"
+    	"fmt"
+    	"github.com/inkel/gedis/client"
+    	"github.com/inkel/gedis/queue"
+    	"time"
+    )
+
+    func main() {
+    	c, err := client.Dial("tcp", "localhost:6379")
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer c.Close()
+
+    	q := queue.New(&c, "emails")
+
+    	q.Enqueue("hello@example.com")
+    	q.EnqueueIn("later@example.com", time.Hour)
+
+    	for {
+    		job, err := q.Dequeue(context.Background(), 5*time.Second)
+    		if err != nil {
+    			continue
+    		}
+
+    		fmt.Println("Sending email to", job.Payload)
+
+    		q.Ack(job)
+    	}
+    }
+*/
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"os"
+	"time"
+)
+
+// Returned by Ack, Retry and Fail when the job is no longer being
+// processed by this worker, i.e. because its visibility timeout
+// expired and it was put back in the queue
+var ErrNotInFlight = errors.New("queue: job not in flight")
+
+// Maximum number of jobs moved at once by Requeue
+const requeueBatch = 100
+
+// KEYS[1] job, KEYS[2] ready, KEYS[3] scheduled
+// ARGV[1] id, ARGV[2] payload, ARGV[3] when to run, in ms; 0 runs now
+var enqueueScript = client.NewScript(`
+redis.call("HSET", KEYS[1], "payload", ARGV[2], "attempts", 0)
+if tonumber(ARGV[3]) > 0 then
+	redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+else
+	redis.call("LPUSH", KEYS[2], ARGV[1])
+end
+return 1`)
+
+// KEYS[1] processing, KEYS[2] inflight, KEYS[3] job, KEYS[4] target
+// ARGV[1] id, ARGV[2] ack, retry or fail, ARGV[3] when to retry, in ms,
+// ARGV[4] error
+var settleScript = client.NewScript(`
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+if ARGV[2] == "ack" then
+	redis.call("DEL", KEYS[3])
+else
+	redis.call("HSET", KEYS[3], "error", ARGV[4])
+	if ARGV[2] == "retry" then
+		redis.call("ZADD", KEYS[4], ARGV[3], ARGV[1])
+	else
+		redis.call("LPUSH", KEYS[4], ARGV[1])
+	end
+end
+return 1`)
+
+// KEYS[1] scheduled, KEYS[2] ready, KEYS[3] inflight
+// ARGV[1] now, in ms, ARGV[2] key prefix, ARGV[3] batch size
+//
+// The job and processing keys of the stuck jobs are built from the
+// prefix, see the package documentation.
+var requeueScript = client.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[3])
+for _, id in ipairs(due) do
+	redis.call("ZREM", KEYS[1], id)
+	redis.call("LPUSH", KEYS[2], id)
+end
+local stuck = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[1], "LIMIT", 0, ARGV[3])
+for _, id in ipairs(stuck) do
+	local worker = redis.call("HGET", ARGV[2] .. "job:" .. id, "worker")
+	if worker then
+		redis.call("LREM", ARGV[2] .. "processing:" .. worker, 0, id)
+	end
+	redis.call("ZREM", KEYS[3], id)
+	redis.call("RPUSH", KEYS[2], id)
+end
+local next_at = -1
+for _, key in ipairs({KEYS[1], KEYS[3]}) do
+	local first = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+	if first[2] and (next_at < 0 or tonumber(first[2]) < next_at) then
+		next_at = tonumber(first[2])
+	end
+end
+return {#due + #stuck, next_at}`)
+
+// KEYS[1] ready, KEYS[2] processing, KEYS[3] inflight
+// ARGV[1] visibility deadline, in ms, ARGV[2] worker, ARGV[3] key prefix
+//
+// The job key is built from the prefix, see the package documentation.
+var startScript = client.NewScript(`
+local id = redis.call("LMOVE", KEYS[1], KEYS[2], "RIGHT", "LEFT")
+if not id then
+	return false
+end
+local job = ARGV[3] .. "job:" .. id
+redis.call("ZADD", KEYS[3], ARGV[1], id)
+redis.call("HSET", job, "worker", ARGV[2])
+redis.call("HINCRBY", job, "attempts", 1)
+return {id, redis.call("HGETALL", job)}`)
+
+// KEYS[1] processing, KEYS[2] ready, KEYS[3] inflight
+var recoverScript = client.NewScript(`
+local ids = redis.call("LRANGE", KEYS[1], 0, -1)
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[3], id)
+	redis.call("RPUSH", KEYS[2], id)
+end
+redis.call("DEL", KEYS[1])
+return #ids`)
+
+// A unit of work
+type Job struct {
+	ID      string `redis:"-"`
+	Payload string `redis:"payload"`
+	// Number of times the job was dequeued, including this one
+	Attempts int64 `redis:"attempts"`
+	// Error the job failed with the last time it was attempted
+	Error string `redis:"error"`
+}
+
+// Number of jobs in each state
+type Stats struct {
+	Ready     int64
+	Scheduled int64
+	InFlight  int64
+	Failed    int64
+}
+
+// A named job queue
+//
+// A Queue uses its client exclusively and, like it, is not safe for
+// concurrent use. Every worker should have its own Queue, with its own
+// client and a distinct Worker name.
+type Queue struct {
+	c      *client.Client
+	prefix string
+	now    func() time.Time
+
+	// Identifies the list of jobs being processed by this worker,
+	// defaults to a random name, or to one made of the host name, the
+	// process ID and the time if there's no randomness available
+	Worker string
+	// How long a job can be processed before it's put back in the
+	// queue, defaults to 1 minute
+	Timeout time.Duration
+	// Number of attempts after which a job is moved to the failed
+	// list, defaults to 5
+	MaxAttempts int64
+	// How long to wait before retrying a job that failed the given
+	// number of attempts, defaults to 2^attempts seconds, up to an
+	// hour
+	Backoff func(attempts int64) time.Duration
+}
+
+// Create a queue with the given name
+func New(c *client.Client, name string) *Queue {
+	worker, err := randomID()
+	if err != nil {
+		host, _ := os.Hostname()
+		worker = fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	}
+
+	return &Queue{
+		c:           c,
+		prefix:      "queue:" + name + ":",
+		now:         time.Now,
+		Worker:      worker,
+		Timeout:     time.Minute,
+		MaxAttempts: 5,
+		Backoff:     ExponentialBackoff,
+	}
+}
+
+// Wait 2^attempts seconds, up to an hour
+func ExponentialBackoff(attempts int64) time.Duration {
+	if attempts >= 12 {
+		return time.Hour
+	}
+	return time.Duration(1<<uint(attempts)) * time.Second
+}
+
+func (q *Queue) key(name string) string {
+	return q.prefix + name
+}
+
+func (q *Queue) processing() string {
+	return q.key("processing:" + q.Worker)
+}
+
+// Add a job to the queue, returning its ID
+func (q *Queue) Enqueue(payload string) (string, error) {
+	return q.enqueue(payload, 0)
+}
+
+// Add a job to the queue to be processed after delay
+func (q *Queue) EnqueueIn(payload string, delay time.Duration) (string, error) {
+	return q.EnqueueAt(payload, q.now().Add(delay))
+}
+
+// Add a job to the queue to be processed at the given time
+//
+// Scheduled jobs are moved to the queue by Requeue, which is called by
+// every Dequeue and again when the next one is due while waiting, so a
+// job might run a bit later than scheduled.
+func (q *Queue) EnqueueAt(payload string, t time.Time) (string, error) {
+	at := t.UnixNano() / int64(time.Millisecond)
+	if at <= 0 {
+		at = 1
+	}
+	return q.enqueue(payload, at)
+}
+
+func (q *Queue) enqueue(payload string, at int64) (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	keys := []string{q.key("job:" + id), q.key("ready"), q.key("scheduled")}
+	if _, err := enqueueScript.Run(q.c, keys, id, payload, at); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Take the oldest job from the queue, waiting up to timeout for one to
+// be available; zero waits forever
+//
+// Jobs must be acknowledged with Ack once processed, or given back with
+// Retry or Fail; otherwise they're put back in the queue after the
+// visibility timeout. Jobs that were attempted MaxAttempts times
+// already are moved to the failed list instead of being returned.
+//
+// Returns gedis.ErrNil if the timeout expires. As with any blocking
+// command, the client is closed if ctx is done while waiting.
+func (q *Queue) Dequeue(ctx context.Context, timeout time.Duration) (*Job, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		_, next, err := q.requeue()
+		if err != nil {
+			return nil, err
+		}
+
+		job, err := q.start()
+		if err != nil {
+			return nil, err
+		}
+
+		if job == nil {
+			if err = q.wait(ctx, deadline, next); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if job.Attempts <= q.MaxAttempts {
+			return job, nil
+		}
+
+		// A job that kept timing out
+		if err = q.Fail(job, errors.New("queue: too many attempts")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Take the oldest job from the queue, marking it as in flight, or
+// returns nil if there are none
+//
+// Everything happens in a script, so a worker dying halfway can't leave
+// a job in its processing list without a visibility deadline.
+func (q *Queue) start() (*Job, error) {
+	keys := []string{q.key("ready"), q.processing(), q.key("inflight")}
+	deadline := q.now().Add(q.Timeout).UnixNano() / int64(time.Millisecond)
+
+	res, err := startScript.Run(q.c, keys, deadline, q.Worker, q.prefix)
+	if err != nil || res == nil {
+		return nil, err
+	}
+
+	arr, ok := res.([]interface{})
+	if !ok || len(arr) != 2 {
+		return nil, fmt.Errorf("queue: unexpected reply %#v", res)
+	}
+
+	j := &Job{}
+	if err = gedis.Scan(arr[0], &j.ID); err != nil {
+		return nil, err
+	}
+	if err = gedis.Scan(arr[1], j); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Block until a job is added to the queue, the deadline passes, or next,
+// the time in ms when a scheduled or timed out job is due, comes; a
+// negative next means there are none
+//
+// Returns gedis.ErrNil once the deadline passed. Waiting doesn't take
+// the job, it's left to start, so there's nothing to lose if the client
+// dies meanwhile.
+func (q *Queue) wait(ctx context.Context, deadline time.Time, next int64) error {
+	var timeout time.Duration
+
+	if !deadline.IsZero() {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return gedis.ErrNil
+		}
+	}
+
+	if next >= 0 {
+		due := time.Duration(next-q.now().UnixNano()/int64(time.Millisecond)) * time.Millisecond
+		if due <= 0 {
+			return nil
+		}
+		if timeout == 0 || due < timeout {
+			timeout = due
+		}
+	}
+
+	// Redis takes the timeout in ms, and zero would block forever
+	timeout = (timeout + time.Millisecond - 1).Truncate(time.Millisecond)
+
+	// Moving from the tail to the tail of the same list leaves it as is
+	ready := q.key("ready")
+	if _, err := q.c.BLMove(ctx, ready, ready, "RIGHT", "RIGHT", timeout); err != nil && err != gedis.ErrNil {
+		return err
+	}
+
+	return nil
+}
+
+// Acknowledge a job was processed, removing it from the queue
+func (q *Queue) Ack(job *Job) error {
+	return q.settle(job, "ack", "", 0, "")
+}
+
+// Give back a job that failed, to be retried after a backoff
+//
+// The job is moved to the failed list instead if it ran out of
+// attempts.
+func (q *Queue) Retry(job *Job, err error) error {
+	if job.Attempts >= q.MaxAttempts {
+		return q.Fail(job, err)
+	}
+
+	at := q.now().Add(q.Backoff(job.Attempts)).UnixNano() / int64(time.Millisecond)
+
+	return q.settle(job, "retry", q.key("scheduled"), at, errString(err))
+}
+
+// Move a job that can't be processed to the failed list, without
+// retrying it
+func (q *Queue) Fail(job *Job, err error) error {
+	return q.settle(job, "fail", q.key("failed"), 0, errString(err))
+}
+
+func (q *Queue) settle(job *Job, action, target string, at int64, msg string) error {
+	keys := []string{q.processing(), q.key("inflight"), q.key("job:" + job.ID), target}
+
+	res, err := settleScript.Run(q.c, keys, job.ID, action, at, msg)
+	if err != nil {
+		return err
+	}
+
+	if res != int64(1) {
+		return ErrNotInFlight
+	}
+
+	if action != "ack" {
+		job.Error = msg
+	}
+
+	return nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Move the scheduled jobs that are due, and the jobs whose visibility
+// timeout expired, to the queue, returning how many were moved
+func (q *Queue) Requeue() (int64, error) {
+	n, _, err := q.requeue()
+	return n, err
+}
+
+// Like Requeue, but also returns when the next scheduled or in flight
+// job is due, in ms, or -1 if there are none
+func (q *Queue) requeue() (n, next int64, err error) {
+	keys := []string{q.key("scheduled"), q.key("ready"), q.key("inflight")}
+	now := q.now().UnixNano() / int64(time.Millisecond)
+
+	res, err := requeueScript.Run(q.c, keys, now, q.prefix, requeueBatch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	arr, ok := res.([]interface{})
+	if !ok || len(arr) != 2 {
+		return 0, 0, fmt.Errorf("queue: unexpected reply %#v", res)
+	}
+
+	if err = gedis.Scan(arr[0], &n); err == nil {
+		err = gedis.Scan(arr[1], &next)
+	}
+
+	return n, next, err
+}
+
+// Put back in the queue the jobs that this worker was processing,
+// returning how many there were
+//
+// Call it when a worker starts with the Worker name it had before
+// dying, instead of waiting for the visibility timeout.
+func (q *Queue) Recover() (int64, error) {
+	keys := []string{q.processing(), q.key("ready"), q.key("inflight")}
+
+	res, err := recoverScript.Run(q.c, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = gedis.Scan(res, &n)
+
+	return n, err
+}
+
+// Returns the number of jobs in each state
+func (q *Queue) Stats() (Stats, error) {
+	p := q.c.Pipeline()
+	p.Send("LLEN", q.key("ready"))
+	p.Send("ZCARD", q.key("scheduled"))
+	p.Send("ZCARD", q.key("inflight"))
+	p.Send("LLEN", q.key("failed"))
+
+	cmds, err := p.Exec()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	dest := []*int64{&stats.Ready, &stats.Scheduled, &stats.InFlight, &stats.Failed}
+
+	for i, cmd := range cmds {
+		if cmd.Err != nil {
+			return Stats{}, cmd.Err
+		}
+		if err = gedis.Scan(cmd.Reply, dest[i]); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	return stats, nil
+}
+
+// Returns the number of jobs waiting to be processed
+func (q *Queue) Len() (int64, error) {
+	res, err := q.c.Send("LLEN", q.key("ready"))
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = gedis.Scan(res, &n)
+
+	return n, err
+}
+
+// Returns up to count of the jobs that ran out of attempts, the most
+// recent first; zero returns all of them
+func (q *Queue) Failed(count int64) ([]*Job, error) {
+	res, err := q.c.Send("LRANGE", q.key("failed"), 0, count-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if err = gedis.Scan(res, &ids); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, len(ids))
+
+	for _, id := range ids {
+		res, err := q.c.Send("HGETALL", q.key("job:"+id))
+		if err != nil {
+			return nil, err
+		}
+
+		job := &Job{ID: id}
+		if err = gedis.Scan(res, job); err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// Reads random bytes; replaced by tests
+var randRead = rand.Read
+
+// Returns a random ID for a job or a worker
+func randomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := randRead(b); err != nil {
+		return "", fmt.Errorf("queue: cannot generate an ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
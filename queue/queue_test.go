@@ -0,0 +1,282 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"github.com/inkel/gedis/internal/redistest"
+	"testing"
+	"time"
+)
+
+func newQueue(t *testing.T, s *redistest.Server, worker string) (*Queue, *time.Time) {
+	c, err := client.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	now := time.Unix(1700000000, 0)
+
+	q := New(&c, "jobs")
+	q.Worker = worker
+	q.now = func() time.Time { return now }
+
+	return q, &now
+}
+
+func notErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func stats(t *testing.T, q *Queue, expected Stats) {
+	t.Helper()
+	s, err := q.Stats()
+	notErr(t, err)
+	if s != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, s)
+	}
+}
+
+func dequeue(t *testing.T, q *Queue) *Job {
+	t.Helper()
+	job, err := q.Dequeue(context.Background(), 10*time.Millisecond)
+	notErr(t, err)
+	return job
+}
+
+func TestQueue(t *testing.T) {
+	s := redistest.NewServer(t)
+	q, _ := newQueue(t, s, "w1")
+
+	for _, p := range []string{"a", "b"} {
+		_, err := q.Enqueue(p)
+		notErr(t, err)
+	}
+
+	stats(t, q, Stats{Ready: 2})
+
+	job := dequeue(t, q)
+	if job.Payload != "a" || job.Attempts != 1 {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+
+	stats(t, q, Stats{Ready: 1, InFlight: 1})
+
+	notErr(t, q.Ack(job))
+
+	if err := q.Ack(job); err != ErrNotInFlight {
+		t.Fatalf("Expected ErrNotInFlight, got %v", err)
+	}
+
+	if job = dequeue(t, q); job.Payload != "b" {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+	notErr(t, q.Ack(job))
+
+	if _, err := q.Dequeue(context.Background(), 10*time.Millisecond); err != gedis.ErrNil {
+		t.Fatalf("Expected gedis.ErrNil, got %v", err)
+	}
+
+	stats(t, q, Stats{})
+}
+
+func TestQueue_delayed(t *testing.T) {
+	s := redistest.NewServer(t)
+	q, now := newQueue(t, s, "w1")
+
+	_, err := q.EnqueueIn("later", time.Minute)
+	notErr(t, err)
+
+	stats(t, q, Stats{Scheduled: 1})
+
+	if _, err = q.Dequeue(context.Background(), 10*time.Millisecond); err != gedis.ErrNil {
+		t.Fatalf("Expected gedis.ErrNil, got %v", err)
+	}
+
+	*now = now.Add(time.Minute)
+
+	if job := dequeue(t, q); job.Payload != "later" {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+}
+
+func TestQueue_delayedWhileWaiting(t *testing.T) {
+	s := redistest.NewServer(t)
+	q, _ := newQueue(t, s, "w1")
+	q.now = time.Now
+
+	_, err := q.EnqueueIn("soon", 50*time.Millisecond)
+	notErr(t, err)
+
+	// The job is due long before the timeout, and it's taken without
+	// calling Dequeue again
+	start := time.Now()
+
+	job, err := q.Dequeue(context.Background(), 5*time.Second)
+	notErr(t, err)
+
+	if job.Payload != "soon" {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("The scheduled job was taken after %v", d)
+	}
+}
+
+func TestQueue_enqueuedWhileWaiting(t *testing.T) {
+	s := redistest.NewServer(t)
+	q1, _ := newQueue(t, s, "w1")
+	q2, _ := newQueue(t, s, "w2")
+
+	enqueued := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := q2.Enqueue("late")
+		enqueued <- err
+	}()
+
+	job, err := q1.Dequeue(context.Background(), 0)
+	notErr(t, err)
+	notErr(t, <-enqueued)
+
+	if job.Payload != "late" || job.Attempts != 1 {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+
+	stats(t, q1, Stats{InFlight: 1})
+
+	// The job is only in the processing list of the worker that took it
+	res, err := q2.c.Send("LRANGE", q1.processing(), 0, -1)
+	notErr(t, err)
+
+	if ids, ok := res.([]interface{}); !ok || len(ids) != 1 || ids[0] != job.ID {
+		t.Fatalf("Unexpected processing list: %#v", res)
+	}
+
+	res, err = q2.c.Send("HGET", q1.key("job:"+job.ID), "worker")
+	notErr(t, err)
+
+	if res != "w1" {
+		t.Fatalf("Unexpected worker: %#v", res)
+	}
+}
+
+func TestQueue_retry(t *testing.T) {
+	s := redistest.NewServer(t)
+	q, now := newQueue(t, s, "w1")
+	q.MaxAttempts = 2
+
+	_, err := q.Enqueue("flaky")
+	notErr(t, err)
+
+	job := dequeue(t, q)
+	notErr(t, q.Retry(job, errors.New("boom")))
+
+	stats(t, q, Stats{Scheduled: 1})
+
+	// Backoff after the first attempt is 2 seconds
+	*now = now.Add(2 * time.Second)
+
+	job = dequeue(t, q)
+	if job.Attempts != 2 || job.Error != "boom" {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+
+	// Out of attempts
+	notErr(t, q.Retry(job, errors.New("boom again")))
+
+	stats(t, q, Stats{Failed: 1})
+
+	failed, err := q.Failed(10)
+	notErr(t, err)
+
+	if len(failed) != 1 || failed[0].ID != job.ID || failed[0].Error != "boom again" {
+		t.Fatalf("Unexpected failed jobs: %+v", failed)
+	}
+}
+
+func TestQueue_visibilityTimeout(t *testing.T) {
+	s := redistest.NewServer(t)
+	q1, _ := newQueue(t, s, "w1")
+	q2, now2 := newQueue(t, s, "w2")
+
+	_, err := q1.Enqueue("stuck")
+	notErr(t, err)
+
+	job := dequeue(t, q1)
+
+	// w1 hangs, and w2 takes the job once the timeout expires
+	*now2 = now2.Add(q2.Timeout)
+
+	again := dequeue(t, q2)
+	if again.ID != job.ID || again.Attempts != 2 {
+		t.Fatalf("Unexpected job: %+v", again)
+	}
+
+	if err = q1.Ack(job); err != ErrNotInFlight {
+		t.Fatalf("Expected ErrNotInFlight, got %v", err)
+	}
+
+	notErr(t, q2.Ack(again))
+}
+
+func TestQueue_Recover(t *testing.T) {
+	s := redistest.NewServer(t)
+	q, _ := newQueue(t, s, "w1")
+
+	_, err := q.Enqueue("interrupted")
+	notErr(t, err)
+
+	dequeue(t, q)
+
+	// w1 restarts
+	q, _ = newQueue(t, s, "w1")
+
+	n, err := q.Recover()
+	notErr(t, err)
+
+	if n != 1 {
+		t.Fatalf("Expected 1 job recovered, got %d", n)
+	}
+
+	stats(t, q, Stats{Ready: 1})
+
+	if job := dequeue(t, q); job.Payload != "interrupted" || job.Attempts != 2 {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	if d := ExponentialBackoff(3); d != 8*time.Second {
+		t.Fatalf("Unexpected backoff: %v", d)
+	}
+	if d := ExponentialBackoff(20); d != time.Hour {
+		t.Fatalf("Unexpected backoff: %v", d)
+	}
+}
+
+func TestQueue_noRandomness(t *testing.T) {
+	randRead = func(b []byte) (int, error) {
+		return 0, errors.New("lorem")
+	}
+	defer func() { randRead = rand.Read }()
+
+	s := redistest.NewServer(t)
+	q, _ := newQueue(t, s, "")
+
+	if worker := New(nil, "jobs").Worker; worker == "" {
+		t.Fatal("The worker should have a name")
+	}
+
+	if _, err := q.Enqueue("lorem"); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	stats(t, q, Stats{})
+}
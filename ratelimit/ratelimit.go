@@ -0,0 +1,315 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis ratelimit - Rate limiting on top of Redis
+
+This package limits how often something can happen, i.e. API
+requests per user, using one of three algorithms:
+
+    FixedWindow    counts the requests in windows of a fixed length
+    SlidingWindow  keeps a log of the requests made in the last period
+    GCRA           the generic cell rate algorithm, a token bucket
+
+Each algorithm is a Lua script, so checking and updating a limit is
+atomic even with many clients sharing the same Redis server. The
+sliding window and GCRA use the clock of the server, so the clocks of
+the clients don't matter.
+
+Example
+
+    package main
+
+    import (
+    	"fmt"
+    	"github.com/inkel/gedis/client"
+    	"github.com/inkel/gedis/ratelimit"
+    )
+
+    func main() {
+    	c, err := client.DialMux("tcp", "localhost:6379")
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer c.Close()
+
+    	l := ratelimit.New(c, ratelimit.GCRA)
+
+    	res, err := l.Allow("user:1", ratelimit.PerMinute(60))
+    	if err != nil {
+    		panic(err)
+    	}
+
+    	if !res.Allowed {
+    		fmt.Println("Try again in", res.RetryAfter)
+    	}
+    }
+*/
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"time"
+)
+
+// Algorithm used by a Limiter
+type Algorithm int
+
+const (
+	// Count the requests in consecutive windows of one period, the
+	// first one starting with the first request
+	//
+	// It's the cheapest algorithm, but allows up to twice the rate
+	// around the boundary of two windows.
+	FixedWindow Algorithm = iota
+	// Keep the time of every request made in the last period in a
+	// sorted set
+	//
+	// It's exact, but uses memory proportional to the rate.
+	SlidingWindow
+	// Generic cell rate algorithm: requests are evenly spaced at the
+	// rate, allowing bursts of up to Burst requests
+	//
+	// It only stores a timestamp per key.
+	GCRA
+)
+
+// How many requests are allowed per period
+type Limit struct {
+	Rate   int64
+	Period time.Duration
+	// Maximum number of requests allowed at once, only used by GCRA;
+	// defaults to Rate
+	Burst int64
+}
+
+// Allow rate requests per second
+func PerSecond(rate int64) Limit {
+	return Limit{Rate: rate, Period: time.Second}
+}
+
+// Allow rate requests per minute
+func PerMinute(rate int64) Limit {
+	return Limit{Rate: rate, Period: time.Minute}
+}
+
+// Allow rate requests per hour
+func PerHour(rate int64) Limit {
+	return Limit{Rate: rate, Period: time.Hour}
+}
+
+// The outcome of checking a limit
+type Result struct {
+	Allowed bool
+	// Number of requests that would still be allowed right now
+	Remaining int64
+	// How long to wait before the same request is allowed; zero if
+	// it was allowed, and -1 if it never will be because it's
+	// larger than the limit
+	RetryAfter time.Duration
+	// How long until the limit is back to its initial state
+	ResetAfter time.Duration
+}
+
+// KEYS[1] counter
+// ARGV[1] rate, ARGV[2] period in ms, ARGV[3] requests
+var fixedWindowScript = client.NewScript(`
+local rate, period, n = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local count = tonumber(redis.call("GET", KEYS[1]) or 0)
+local ttl = redis.call("PTTL", KEYS[1])
+local fresh = ttl < 0
+if fresh then ttl = period end
+if count + n > rate then
+	local retry = ttl
+	if n > rate then retry = -1 end
+	return {0, rate - count, retry, ttl}
+end
+count = redis.call("INCRBY", KEYS[1], n)
+if fresh then redis.call("PEXPIRE", KEYS[1], period) end
+return {1, rate - count, 0, ttl}`)
+
+// KEYS[1] sorted set of request times
+// ARGV[1] rate, ARGV[2] period in ms, ARGV[3] requests, ARGV[4] unique id
+var slidingWindowScript = client.NewScript(`
+local rate, period, n = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - period)
+local count = redis.call("ZCARD", KEYS[1])
+if count + n <= rate then
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], now, ARGV[4] .. ":" .. i)
+	end
+	redis.call("PEXPIRE", KEYS[1], period)
+	return {1, rate - count - n, 0, period}
+end
+local retry = -1
+if n <= rate then
+	local i = count + n - rate - 1
+	local oldest = redis.call("ZRANGE", KEYS[1], i, i, "WITHSCORES")
+	retry = tonumber(oldest[2]) + period - now
+end
+local reset = 0
+local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+if newest[2] then reset = tonumber(newest[2]) + period - now end
+return {0, rate - count, retry, reset}`)
+
+// KEYS[1] theoretical arrival time, in microseconds
+// ARGV[1] burst, ARGV[2] emission interval in microseconds, ARGV[3] requests
+var gcraScript = client.NewScript(`
+local burst, interval, n = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then tat = now end
+local new_tat = tat + n * interval
+local diff = now - (new_tat - burst * interval)
+if diff < 0 then
+	local retry = -1
+	if n <= burst then retry = math.ceil(-diff / 1000) end
+	local remaining = math.floor((now - (tat - burst * interval)) / interval)
+	return {0, remaining, retry, math.ceil((tat - now) / 1000)}
+end
+local reset = math.ceil((new_tat - now) / 1000)
+redis.call("SET", KEYS[1], string.format("%.0f", new_tat), "PX", math.max(reset, 1))
+return {1, math.floor(diff / interval), 0, reset}`)
+
+// Checks and updates rate limits stored in a Redis server
+type Limiter struct {
+	s   client.Sender
+	alg Algorithm
+
+	// Prepended to every key, defaults to "ratelimit:"
+	Prefix string
+}
+
+// Create a new Limiter using the given algorithm
+func New(s client.Sender, alg Algorithm) *Limiter {
+	return &Limiter{s: s, alg: alg, Prefix: "ratelimit:"}
+}
+
+// Check whether a request identified by key is allowed by limit,
+// counting it if it is
+func (l *Limiter) Allow(key string, limit Limit) (Result, error) {
+	return l.AllowN(key, limit, 1)
+}
+
+// Check whether n requests identified by key are allowed by limit,
+// counting them if they are
+//
+// Either all n requests are allowed or none is. n must be at least 1,
+// otherwise the scripts would give back requests already counted.
+func (l *Limiter) AllowN(key string, limit Limit, n int64) (Result, error) {
+	if limit.Rate <= 0 || limit.Period < time.Millisecond {
+		return Result{}, errors.New("ratelimit: invalid limit")
+	}
+
+	if n < 1 {
+		return Result{}, fmt.Errorf("ratelimit: invalid number of requests %d", n)
+	}
+
+	keys := []string{l.Prefix + key}
+	period := limit.Period.Milliseconds()
+
+	var res interface{}
+	var err error
+
+	switch l.alg {
+	case FixedWindow:
+		res, err = fixedWindowScript.Run(l.s, keys, limit.Rate, period, n)
+	case SlidingWindow:
+		var id string
+		if id, err = uniqueID(); err != nil {
+			return Result{}, err
+		}
+		res, err = slidingWindowScript.Run(l.s, keys, limit.Rate, period, n, id)
+	case GCRA:
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = limit.Rate
+		}
+		// The emission interval must be at least a microsecond
+		interval := limit.Period.Microseconds() / limit.Rate
+		if interval <= 0 {
+			return Result{}, errors.New("ratelimit: invalid limit")
+		}
+		res, err = gcraScript.Run(l.s, keys, burst, interval, n)
+	default:
+		return Result{}, fmt.Errorf("ratelimit: unknown algorithm %d", l.alg)
+	}
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseResult(res)
+}
+
+// Forget the requests made for key
+func (l *Limiter) Reset(key string) error {
+	_, err := l.s.Send("DEL", l.Prefix+key)
+	return err
+}
+
+// Parse the {allowed, remaining, retry after, reset after} reply of
+// the scripts
+func parseResult(reply interface{}) (Result, error) {
+	var values []int64
+	if err := gedis.Scan(reply, &values); err != nil {
+		return Result{}, err
+	}
+
+	if len(values) != 4 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected reply: %#v", reply)
+	}
+
+	res := Result{
+		Allowed:    values[0] == 1,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}
+
+	if values[2] < 0 {
+		res.RetryAfter = -1
+	}
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+
+	return res, nil
+}
+
+// A random member for the sliding window log, so concurrent requests
+// made in the same millisecond are all counted
+func uniqueID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"github.com/inkel/gedis/client"
+	"github.com/inkel/gedis/internal/redistest"
+	"testing"
+	"time"
+)
+
+// Start a server with its clock frozen, returning a client to it
+func newServer(t *testing.T) (*redistest.Server, client.Sender) {
+	s := redistest.NewServer(t)
+	s.SetTime(time.Unix(1700000000, 0))
+
+	c, err := client.DialMux("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return s, c
+}
+
+func allow(t *testing.T, l *Limiter, limit Limit, allowed bool, remaining int64) Result {
+	t.Helper()
+
+	res, err := l.Allow("user:1", limit)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if res.Allowed != allowed || res.Remaining != remaining {
+		t.Fatalf("Expected allowed=%v remaining=%d, got %+v", allowed, remaining, res)
+	}
+
+	return res
+}
+
+func TestFixedWindow(t *testing.T) {
+	f, s := newServer(t)
+	l := New(s, FixedWindow)
+	limit := PerSecond(3)
+
+	allow(t, l, limit, true, 2)
+	f.Advance(400 * time.Millisecond)
+	allow(t, l, limit, true, 1)
+	allow(t, l, limit, true, 0)
+
+	res := allow(t, l, limit, false, 0)
+	if res.RetryAfter != 600*time.Millisecond {
+		t.Fatalf("Unexpected retry after: %v", res.RetryAfter)
+	}
+
+	f.Advance(600 * time.Millisecond)
+	allow(t, l, limit, true, 2)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	f, s := newServer(t)
+	l := New(s, SlidingWindow)
+	limit := PerSecond(3)
+
+	allow(t, l, limit, true, 2)
+	f.Advance(400 * time.Millisecond)
+	allow(t, l, limit, true, 1)
+	allow(t, l, limit, true, 0)
+
+	res := allow(t, l, limit, false, 0)
+	if res.RetryAfter != 600*time.Millisecond {
+		t.Fatalf("Unexpected retry after: %v", res.RetryAfter)
+	}
+	if res.ResetAfter != time.Second {
+		t.Fatalf("Unexpected reset after: %v", res.ResetAfter)
+	}
+
+	// Only the first request left the window
+	f.Advance(600 * time.Millisecond)
+	allow(t, l, limit, true, 0)
+	allow(t, l, limit, false, 0)
+}
+
+func TestGCRA(t *testing.T) {
+	f, s := newServer(t)
+	l := New(s, GCRA)
+	limit := Limit{Rate: 10, Period: time.Second, Burst: 2}
+
+	allow(t, l, limit, true, 1)
+	allow(t, l, limit, true, 0)
+
+	res := allow(t, l, limit, false, 0)
+	if res.RetryAfter != 100*time.Millisecond {
+		t.Fatalf("Unexpected retry after: %v", res.RetryAfter)
+	}
+	if res.ResetAfter != 200*time.Millisecond {
+		t.Fatalf("Unexpected reset after: %v", res.ResetAfter)
+	}
+
+	// Requests are allowed again at the rate
+	f.Advance(100 * time.Millisecond)
+	allow(t, l, limit, true, 0)
+	allow(t, l, limit, false, 0)
+
+	f.Advance(time.Second)
+	allow(t, l, limit, true, 1)
+}
+
+func TestAllowN(t *testing.T) {
+	for _, alg := range []Algorithm{FixedWindow, SlidingWindow, GCRA} {
+		_, s := newServer(t)
+		l := New(s, alg)
+		limit := PerMinute(5)
+
+		res, err := l.AllowN("user:1", limit, 4)
+		if err != nil || !res.Allowed || res.Remaining != 1 {
+			t.Fatalf("Algorithm %d: unexpected %+v, %v", alg, res, err)
+		}
+
+		res, err = l.AllowN("user:1", limit, 2)
+		if err != nil || res.Allowed || res.Remaining != 1 || res.RetryAfter <= 0 {
+			t.Fatalf("Algorithm %d: unexpected %+v, %v", alg, res, err)
+		}
+
+		res, err = l.AllowN("user:1", limit, 6)
+		if err != nil || res.Allowed || res.RetryAfter != -1 {
+			t.Fatalf("Algorithm %d: unexpected %+v, %v", alg, res, err)
+		}
+
+		if err = l.Reset("user:1"); err != nil {
+			t.Fatalf("Algorithm %d: unexpected error: %v", alg, err)
+		}
+
+		res, err = l.AllowN("user:1", limit, 5)
+		if err != nil || !res.Allowed || res.Remaining != 0 {
+			t.Fatalf("Algorithm %d: unexpected %+v, %v", alg, res, err)
+		}
+
+		// More requests than the limit, with nothing counted yet
+		res, err = l.AllowN("user:2", limit, 6)
+		if err != nil || res.Allowed || res.RetryAfter != -1 {
+			t.Fatalf("Algorithm %d: unexpected %+v, %v", alg, res, err)
+		}
+
+		// Requests can't be given back
+		for _, n := range []int64{0, -10} {
+			if _, err = l.AllowN("user:1", limit, n); err == nil {
+				t.Fatalf("Algorithm %d: expected an error for %d requests", alg, n)
+			}
+		}
+
+		res, err = l.AllowN("user:1", limit, 1)
+		if err != nil || res.Allowed {
+			t.Fatalf("Algorithm %d: unexpected %+v, %v", alg, res, err)
+		}
+	}
+}
+
+func TestAllow_invalidLimit(t *testing.T) {
+	_, s := newServer(t)
+
+	if _, err := New(s, GCRA).Allow("user:1", Limit{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	// Too fast for an emission interval of at least a microsecond
+	if _, err := New(s, GCRA).Allow("user:1", PerSecond(2000000)); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
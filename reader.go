@@ -104,12 +104,14 @@ func readBulk(r Reader) (interface{}, error) {
 
 	bs = make([]byte, numBytes)
 
-	bytesRead, err := r.Read(bs)
+	// A single Read might return less bytes than requested when
+	// reading from a network connection or a buffered reader
+	bytesRead, err := io.ReadFull(r, bs)
 
-	if err != nil {
-		return nil, err
-	} else if int64(bytesRead) != numBytes {
+	if err == io.ErrUnexpectedEOF || int64(bytesRead) != numBytes {
 		return nil, NewParseError("Invalid byte count read")
+	} else if err != nil {
+		return nil, err
 	}
 
 	// Must read following two bytes for \r\n
@@ -148,7 +150,7 @@ func Read(r Reader) (ret interface{}, err error) {
 
 		if err == nil {
 			if bs, ok := ret.(string); ok {
-				err = fmt.Errorf(string(bs))
+				err = Error(bs)
 			} else {
 				err = fmt.Errorf("Cannot convert to []byte: %#v", ret)
 			}
@@ -0,0 +1,433 @@
+package gedis
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned by Scan when the reply is nil, i.e. a missing key
+var ErrNil = errors.New("gedis: nil reply")
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Copies a reply returned by Read into the value pointed to by dest
+//
+// dest can be a pointer to:
+//
+//   - a string, []byte, bool, any integer or float type
+//   - a time.Time, read either as RFC 3339 or as Unix seconds
+//   - a time.Duration, read either as a Go duration string or as
+//     seconds, which is what commands like TTL return
+//   - a slice of any of the above, for replies like MGET or LRANGE;
+//     nil elements are left as the zero value
+//   - a map with string keys, for replies like HGETALL
+//   - a struct, for replies like HGETALL, where fields are matched
+//     using the `redis:"name"` tag or the field name if there's no
+//     tag; fields tagged with `redis:"-"` are ignored
+//
+// A nil reply returns ErrNil, and error replies are returned as is.
+func Scan(reply interface{}, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("gedis: Scan needs a non-nil pointer, got %T", dest)
+	}
+
+	if err, ok := reply.(error); ok {
+		return err
+	}
+
+	if reply == nil {
+		return ErrNil
+	}
+
+	return scanValue(reply, v.Elem())
+}
+
+func scanValue(reply interface{}, v reflect.Value) error {
+	if err, ok := reply.(error); ok {
+		return err
+	}
+
+	if reply == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return scanValue(reply, v.Elem())
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		v.Set(reflect.ValueOf(reply))
+		return nil
+	}
+
+	switch v.Type() {
+	case timeType:
+		t, err := parseTime(reply)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case durationType:
+		d, err := parseDuration(reply)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s, err := replyString(reply)
+			if err != nil {
+				return err
+			}
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		return scanSlice(reply, v)
+	case reflect.Map:
+		return scanMap(reply, v)
+	case reflect.Struct:
+		return scanStruct(reply, v)
+	case reflect.String:
+		s, err := replyString(reply)
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		if n, ok := reply.(int64); ok {
+			v.SetBool(n != 0)
+			return nil
+		}
+		s, err := replyString(reply)
+		if err != nil {
+			return err
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := reply.(int64); ok {
+			v.SetInt(n)
+			return nil
+		}
+		s, err := replyString(reply)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := reply.(int64); ok && n >= 0 {
+			v.SetUint(uint64(n))
+			return nil
+		}
+		s, err := replyString(reply)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if n, ok := reply.(int64); ok {
+			v.SetFloat(float64(n))
+			return nil
+		}
+		s, err := replyString(reply)
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("gedis: cannot scan into %s", v.Type())
+	}
+
+	return nil
+}
+
+func scanSlice(reply interface{}, v reflect.Value) error {
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return fmt.Errorf("gedis: cannot scan %#v into %s", reply, v.Type())
+	}
+
+	s := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+
+	for i, elem := range arr {
+		if err := scanValue(elem, s.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	v.Set(s)
+
+	return nil
+}
+
+func scanMap(reply interface{}, v reflect.Value) error {
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr)%2 != 0 {
+		return fmt.Errorf("gedis: cannot scan %#v into %s", reply, v.Type())
+	}
+
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("gedis: cannot scan into %s, keys must be strings", v.Type())
+	}
+
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+
+	for i := 0; i < len(arr); i += 2 {
+		key, err := replyString(arr[i])
+		if err != nil {
+			return err
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := scanValue(arr[i+1], elem); err != nil {
+			return err
+		}
+
+		v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+	}
+
+	return nil
+}
+
+func scanStruct(reply interface{}, v reflect.Value) error {
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr)%2 != 0 {
+		return fmt.Errorf("gedis: cannot scan %#v into %s", reply, v.Type())
+	}
+
+	fields := structFields(v.Type())
+
+	for i := 0; i < len(arr); i += 2 {
+		name, err := replyString(arr[i])
+		if err != nil {
+			return err
+		}
+
+		f, ok := fields[name]
+		if !ok {
+			continue
+		}
+
+		if err := scanValue(arr[i+1], v.Field(f.index)); err != nil {
+			return fmt.Errorf("gedis: field %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Information about a struct field read from its tag
+type field struct {
+	index     int
+	omitEmpty bool
+}
+
+// Returns the fields of a struct that can be scanned or flattened,
+// indexed by their name in Redis
+func structFields(t reflect.Type) map[string]field {
+	fields := make(map[string]field)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		opts := ""
+
+		if tag := f.Tag.Get("redis"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if i := strings.Index(tag, ","); i >= 0 {
+				tag, opts = tag[:i], tag[i+1:]
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+
+		fields[name] = field{index: i, omitEmpty: opts == "omitempty"}
+	}
+
+	return fields
+}
+
+func replyString(reply interface{}) (string, error) {
+	switch reply := reply.(type) {
+	case string:
+		return reply, nil
+	case Status:
+		return string(reply), nil
+	case int64:
+		return strconv.FormatInt(reply, 10), nil
+	}
+	return "", fmt.Errorf("gedis: cannot convert %#v to string", reply)
+}
+
+func parseTime(reply interface{}) (time.Time, error) {
+	if n, ok := reply.(int64); ok {
+		return time.Unix(n, 0), nil
+	}
+
+	s, err := replyString(reply)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func parseDuration(reply interface{}) (time.Duration, error) {
+	if n, ok := reply.(int64); ok {
+		return time.Duration(n) * time.Second, nil
+	}
+
+	s, err := replyString(reply)
+	if err != nil {
+		return 0, err
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// Returns the fields of a struct as a sequence of name/value pairs,
+// ready to be appended to an HSET command
+//
+// Field names follow the same rules as Scan, and the `omitempty` tag
+// option skips fields with a zero value. Nil pointers are always
+// skipped. Values are formatted as strings so the result can be
+// passed to WriteMultiBulk or client.Client.Send:
+//
+//	args, err := gedis.Flatten(user)
+//	c.Send(append([]interface{}{"HSET", "user:1"}, args...)...)
+//
+// Unlike AppendArg, which encodes a time.Duration as the seconds a
+// command like EXPIRE expects, Flatten stores durations as Go duration
+// strings, i.e. 1m30s, so values like 1.5s are kept as is; Scan reads
+// both forms back.
+func Flatten(v interface{}) ([]interface{}, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("gedis: cannot flatten a nil pointer")
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("gedis: cannot flatten %T", v)
+	}
+
+	fields := structFields(rv.Type())
+
+	// Keep the order in which fields were declared
+	names := make([]string, rv.NumField())
+	for name, f := range fields {
+		names[f.index] = name
+	}
+
+	args := make([]interface{}, 0, 2*len(fields))
+
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+
+		fv := rv.Field(i)
+
+		if fields[name].omitEmpty && fv.IsZero() {
+			continue
+		}
+
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+
+		s, err := formatValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("gedis: field %s: %v", name, err)
+		}
+
+		args = append(args, name, s)
+	}
+
+	return args, nil
+}
+
+func formatValue(v reflect.Value) (string, error) {
+	switch v.Type() {
+	case timeType:
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	case durationType:
+		return time.Duration(v.Int()).String(), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return "1", nil
+		}
+		return "0", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot format %s", v.Type())
+}
@@ -0,0 +1,193 @@
+package gedis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type user struct {
+	Name    string        `redis:"name"`
+	Age     int           `redis:"age"`
+	Score   float64       `redis:"score"`
+	Admin   bool          `redis:"admin"`
+	Joined  time.Time     `redis:"joined"`
+	Timeout time.Duration `redis:"timeout"`
+	Nick    *string       `redis:"nick"`
+	Email   string        `redis:"email,omitempty"`
+	Secret  string        `redis:"-"`
+}
+
+func TestScan_scalars(t *testing.T) {
+	a := Asserter{t, 1}
+
+	var s string
+	a.Nil(Scan("lorem", &s))
+	a.StringEq("lorem", s)
+
+	var n int
+	a.Nil(Scan(int64(1234), &n))
+	a.Nil(Scan("1234", &n))
+	if n != 1234 {
+		t.Errorf("expected 1234, got %d", n)
+	}
+
+	var f float64
+	a.Nil(Scan("3.14", &f))
+	if f != 3.14 {
+		t.Errorf("expected 3.14, got %v", f)
+	}
+
+	var b bool
+	a.Nil(Scan(int64(1), &b))
+	if !b {
+		t.Errorf("expected true")
+	}
+
+	var d time.Duration
+	a.Nil(Scan(int64(60), &d))
+	if d != time.Minute {
+		t.Errorf("expected 1m, got %v", d)
+	}
+
+	var bs []byte
+	a.Nil(Scan("ipsum", &bs))
+	a.StringEq("ipsum", string(bs))
+
+	if err := Scan(nil, &s); err != ErrNil {
+		t.Errorf("expected ErrNil, got %#v", err)
+	}
+
+	if err := Scan("abc", &n); err == nil {
+		t.Errorf("expected error scanning %q into an int", "abc")
+	}
+
+	if err := Scan(Error("ERR unknown"), &s); err == nil {
+		t.Errorf("expected error reply to be returned")
+	}
+
+	a.NotNil(Scan("lorem", s))
+}
+
+func TestScan_slice(t *testing.T) {
+	var ss []string
+	if err := Scan([]interface{}{"lorem", nil, "ipsum"}, &ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := []string{"lorem", "", "ipsum"}; !reflect.DeepEqual(expected, ss) {
+		t.Errorf("\nexpected %#v\nreturned %#v", expected, ss)
+	}
+
+	var ns []int64
+	if err := Scan([]interface{}{"1", int64(2)}, &ns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := []int64{1, 2}; !reflect.DeepEqual(expected, ns) {
+		t.Errorf("\nexpected %#v\nreturned %#v", expected, ns)
+	}
+}
+
+func TestScan_map(t *testing.T) {
+	var m map[string]int
+	if err := Scan([]interface{}{"a", "1", "b", "2"}, &m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := map[string]int{"a": 1, "b": 2}; !reflect.DeepEqual(expected, m) {
+		t.Errorf("\nexpected %#v\nreturned %#v", expected, m)
+	}
+
+	if err := Scan([]interface{}{"a"}, &m); err == nil {
+		t.Errorf("expected error with an odd number of elements")
+	}
+}
+
+func TestScan_struct(t *testing.T) {
+	reply := []interface{}{
+		"name", "inkel",
+		"age", "37",
+		"score", "9.5",
+		"admin", "1",
+		"joined", "2013-06-01T10:00:00Z",
+		"timeout", "1m30s",
+		"nick", "lean",
+		"unknown", "ignored",
+		"Secret", "ignored",
+	}
+
+	var u user
+	if err := Scan(reply, &u); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	nick := "lean"
+	expected := user{
+		Name:    "inkel",
+		Age:     37,
+		Score:   9.5,
+		Admin:   true,
+		Joined:  time.Date(2013, 6, 1, 10, 0, 0, 0, time.UTC),
+		Timeout: 90 * time.Second,
+		Nick:    &nick,
+	}
+
+	if !reflect.DeepEqual(expected, u) {
+		t.Errorf("\nexpected %#v\nreturned %#v", expected, u)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	u := user{
+		Name:    "inkel",
+		Age:     37,
+		Score:   9.5,
+		Admin:   true,
+		Joined:  time.Date(2013, 6, 1, 10, 0, 0, 0, time.UTC),
+		Timeout: 90 * time.Second,
+		Secret:  "hidden",
+	}
+
+	args, err := Flatten(&u)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []interface{}{
+		"name", "inkel",
+		"age", "37",
+		"score", "9.5",
+		"admin", "1",
+		"joined", "2013-06-01T10:00:00Z",
+		"timeout", "1m30s",
+	}
+
+	if !reflect.DeepEqual(expected, args) {
+		t.Errorf("\nexpected %#v\nreturned %#v", expected, args)
+	}
+
+	// What gets flattened must be scanned back
+	var back user
+	if err := Scan(args, &back); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u.Secret = ""
+	if !reflect.DeepEqual(u, back) {
+		t.Errorf("\nexpected %#v\nreturned %#v", u, back)
+	}
+
+	if _, err := Flatten("lorem"); err == nil {
+		t.Errorf("expected error flattening a string")
+	}
+}
+
+func BenchmarkScan_struct(b *testing.B) {
+	reply := []interface{}{"name", "inkel", "age", "37", "score", "9.5"}
+
+	for i := 0; i < b.N; i++ {
+		var u user
+		Scan(reply, &u)
+	}
+}
@@ -1,37 +1,634 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/inkel/gedis"
+	"math"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Holds pointers to the current Server and client net.Conn
+// Maximum size of the replies held while processing pipelined
+// commands before sending them
+const maxPendingOutput = 64 * 1024
+
+// Source of the IDs of clients
+var lastClientID int64
+
+// Holds pointers to the current Server and client net.Conn, along with
+// the state of the connection
+//
+// Replies are buffered while a handler runs, and sent once it returns
+// or when Flush is called. When a client pipelines commands, replies
+// are held until every command it sent is processed. Replies written
+// outside of a handler, i.e. from another goroutine, are sent right
+// away along with any held ones.
+//
+// Sending is done by a goroutine of the client, so writing never waits
+// for a slow reader; what it couldn't send yet counts against the
+// output buffer limits of the server.
+//
+// Handlers can keep the state of the connection in the client, like
+// the selected database or the authenticated user, and any other data
+// with SetValue.
 type Client struct {
 	server *Server
 	conn   *net.Conn
+	r      *bufio.Reader
+	id     int64
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Whether the client is running a command, guarded by the mutex
+	// of the server
+	active bool
+
+	mu        sync.Mutex
+	out       []byte
+	buffering bool
+	proto     int
+
+	// Replies waiting for the writer goroutine, the size of the ones it
+	// is sending, and whether it's running; done is closed when it
+	// stops, and err is the error it stopped sending with
+	queued  []byte
+	sending int
+	writing bool
+	done    chan struct{}
+	err     error
+
+	// The command being run, and where its replies start in out
+	cmd        string
+	replyStart int
+
+	// Whether a command is running, and the goroutine watching the
+	// connection meanwhile, closed when it's done
+	running bool
+	watcher chan struct{}
+
+	created         time.Time
+	lastActive      time.Time
+	inputBuffer     int
+	closeAfterReply bool
+
+	// When the replies went over the soft output buffer limit, and
+	// whether the client was disconnected for going over a limit
+	softLimitSince time.Time
+	overLimit      bool
+
+	// Pushes held until the running command replies
+	pushes []byte
+
+	// Number of pub/sub subscriptions, which exempt the client from
+	// the idle timeout
+	subscriptions int
+
+	db     int
+	user   string
+	name   string
+	values map[interface{}]interface{}
+}
+
+func newClient(s *Server, conn net.Conn) *Client {
+	c := &Client{
+		server: s,
+		conn:   &conn,
+		r:      bufio.NewReader(conn),
+		id:     atomic.AddInt64(&lastClientID, 1),
+	}
+	c.created = time.Now()
+	c.lastActive = c.created
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
 }
 
 // Disconnects a client
 func (c *Client) Close() {
+	if c.cancel != nil {
+		c.cancel()
+	}
 	conn := *c.conn
 	conn.Close()
 }
 
+// Returns a context that is cancelled when the connection is closed
+//
+// Use it to stop work started by a handler, like a blocking command,
+// when nobody is waiting for its reply anymore. Asking for it while a
+// command runs makes the server watch the connection until the command
+// is done, so the context is cancelled as soon as the client goes
+// away.
+func (c *Client) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	c.watchClose()
+	return c.ctx
+}
+
+// Cancel the context of the client if it disconnects while a command
+// runs, when nobody else is reading from the connection
+//
+// Only peeks at what the client sends, so pipelined commands are left
+// for the server to read.
+func (c *Client) watchClose() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running || c.watcher != nil || c.r == nil || c.cancel == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	c.watcher = done
+
+	go func() {
+		defer close(done)
+
+		for n := c.r.Buffered() + 1; n <= c.r.Size(); n = c.r.Buffered() + 1 {
+			if _, err := c.r.Peek(n); err != nil {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					c.cancel()
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Stop watching the connection once the command is done, before
+// reading from it again
+func (c *Client) endCommand() {
+	c.mu.Lock()
+	done := c.watcher
+	c.running = false
+	c.watcher = nil
+	c.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	// Wake up the watcher, and then remove the deadline; readCommand
+	// sets its own
+	conn := *c.conn
+	conn.SetReadDeadline(time.Unix(1, 0))
+	<-done
+	conn.SetReadDeadline(time.Time{})
+}
+
+// Returns the unique ID of the connection, as reported by CLIENT ID
+func (c *Client) ID() int64 {
+	return c.id
+}
+
+// Returns the address of the client
+func (c *Client) RemoteAddr() net.Addr {
+	return (*c.conn).RemoteAddr()
+}
+
+// Returns the address of the server the client connected to
+func (c *Client) LocalAddr() net.Addr {
+	return (*c.conn).LocalAddr()
+}
+
+// Returns the database selected by the client, 0 by default
+func (c *Client) DB() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db
+}
+
+// Set the database selected by the client
+func (c *Client) SetDB(db int) {
+	c.mu.Lock()
+	c.db = db
+	c.mu.Unlock()
+}
+
+// Returns the user the client is authenticated as, "default" until
+// SetUser is called
+func (c *Client) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.user == "" {
+		return "default"
+	}
+	return c.user
+}
+
+// Set the user the client is authenticated as
+func (c *Client) SetUser(user string) {
+	c.mu.Lock()
+	c.user = user
+	c.mu.Unlock()
+}
+
+// Returns the name of the connection, empty by default
+func (c *Client) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// Set the name of the connection, as CLIENT SETNAME does
+//
+// Like in Redis, names can't contain spaces, newlines or special
+// characters. An empty name removes it.
+func (c *Client) SetName(name string) error {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return errors.New("Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Returns the value associated with key by SetValue, or nil
+func (c *Client) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// Associate value with key for the lifetime of the connection; a nil
+// value removes the key
+//
+// As with context.WithValue, packages should use keys of an unexported
+// type to avoid collisions.
+func (c *Client) SetValue(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value == nil {
+		delete(c.values, key)
+		return
+	}
+
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = value
+}
+
 // Read from the client, parsing the input with the Redis protocol
 func (c *Client) Read() ([][]byte, error) {
-	return Read(*c.conn)
+	if c.r == nil {
+		c.r = bufio.NewReader(*c.conn)
+	}
+	return Read(c.r)
+}
+
+// Read the next command, waiting for it up to the idle timeout of the
+// server, and then up to the read timeout for the rest of it
+//
+// Like in Redis, clients with subscriptions can be idle for as long as
+// they want, since they're waiting for messages.
+func (c *Client) readCommand() ([][]byte, error) {
+	s := c.server
+	conn := *c.conn
+
+	idle := s.IdleTimeout
+	if c.subscribed() {
+		idle = 0
+	}
+
+	if idle > 0 || s.ReadTimeout > 0 {
+		if c.r.Buffered() == 0 {
+			conn.SetReadDeadline(deadline(idle))
+			if _, err := c.r.Peek(1); err != nil {
+				return nil, err
+			}
+		}
+
+		conn.SetReadDeadline(deadline(s.ReadTimeout))
+	}
+
+	return c.Read()
+}
+
+// Returns the deadline for a timeout from now, or no deadline for
+// zero
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
 }
 
 // Send a sequence of bytes to a client
+//
+// Returns ErrOutputBufferLimit and disconnects the client if the
+// replies waiting to be sent exceed the limits of the server.
 func (c *Client) Write(bytes []byte) (int, error) {
-	conn := *c.conn
-	return conn.Write(bytes)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.overLimit {
+		return 0, ErrOutputBufferLimit
+	}
+
+	c.out = append(c.out, bytes...)
+
+	if c.exceedsLimit() {
+		c.disconnectOverLimit()
+		return 0, ErrOutputBufferLimit
+	}
+
+	if !c.buffering {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(bytes), nil
+}
+
+// Send an out of band message, like a pub/sub message, to the client
+//
+// The message must be complete. While a command runs it is held until
+// its reply is written, so they don't get mixed.
+func (c *Client) push(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.overLimit {
+		return ErrOutputBufferLimit
+	}
+
+	if c.buffering {
+		c.pushes = append(c.pushes, msg...)
+	} else {
+		c.out = append(c.out, msg...)
+	}
+
+	if c.exceedsLimit() {
+		c.disconnectOverLimit()
+		return ErrOutputBufferLimit
+	}
+
+	if c.buffering {
+		return nil
+	}
+
+	return c.flush()
+}
+
+// Send the buffered replies to the client
+//
+// They're handed to the goroutine that sends them, so Flush doesn't
+// wait for the client to read them. It returns the error sending
+// previous replies failed with, if any.
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+func (c *Client) flush() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if len(c.out) == 0 {
+		return nil
+	}
+
+	c.queued = append(c.queued, c.out...)
+	c.out = c.out[:0]
+
+	if !c.writing {
+		c.writing = true
+		c.done = make(chan struct{})
+		go c.writer(c.done)
+	}
+
+	return nil
+}
+
+// Send the queued replies until there are none left
+func (c *Client) writer(done chan struct{}) {
+	defer close(done)
+
+	var buf []byte
+
+	for {
+		c.mu.Lock()
+		c.sending = 0
+		if len(c.queued) == 0 || c.err != nil {
+			c.writing = false
+			c.mu.Unlock()
+			return
+		}
+		buf, c.queued = c.queued, buf[:0]
+		c.sending = len(buf)
+		c.mu.Unlock()
+
+		conn := *c.conn
+		if c.server != nil && c.server.WriteTimeout > 0 {
+			conn.SetWriteDeadline(deadline(c.server.WriteTimeout))
+		}
+
+		if _, err := conn.Write(buf); err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.queued = nil
+			c.mu.Unlock()
+			c.Close()
+		}
+	}
+}
+
+// Wait until the replies handed to the writer goroutine are sent, or
+// sending them failed
+func (c *Client) drain() {
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// Returns the size of the replies not sent yet
+func (c *Client) unsent() int {
+	return len(c.out) + len(c.pushes) + len(c.queued) + c.sending
+}
+
+// Disconnect a client that went over the output buffer limits,
+// dropping what wasn't sent yet
+func (c *Client) disconnectOverLimit() {
+	c.overLimit = true
+	c.out = nil
+	c.pushes = nil
+	c.queued = nil
+	c.Close()
+}
+
+// Whether the replies waiting to be sent exceed the output buffer
+// limits of the server
+func (c *Client) exceedsLimit() bool {
+	if c.server == nil {
+		return false
+	}
+
+	limit := c.server.OutputBufferLimit
+	size := c.unsent()
+
+	if limit.Hard > 0 && size > limit.Hard {
+		return true
+	}
+
+	if limit.Soft <= 0 || size <= limit.Soft {
+		c.softLimitSince = time.Time{}
+		return false
+	}
+
+	if c.softLimitSince.IsZero() {
+		c.softLimitSince = time.Now()
+		return false
+	}
+
+	return time.Since(c.softLimitSince) > limit.SoftDuration
+}
+
+// Buffer the replies written by the handler of cmd
+func (c *Client) startCommand(cmd string) {
+	var buffered int
+	if c.r != nil {
+		buffered = c.r.Buffered()
+	}
+
+	c.mu.Lock()
+	c.cmd = cmd
+	c.running = true
+	c.buffering = true
+	c.replyStart = len(c.out)
+	c.lastActive = time.Now()
+	c.inputBuffer = buffered
+	c.mu.Unlock()
+}
+
+// Switch to running cmd within the current command, like the commands
+// of a transaction within EXEC
+func (c *Client) setCommand(cmd string) {
+	c.mu.Lock()
+	c.cmd = cmd
+	c.replyStart = len(c.out)
+	c.mu.Unlock()
+}
+
+// Returns the name of the command being run, in upper case
+func (c *Client) Command() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cmd
+}
+
+// Drop the replies written so far for the command being run
+func (c *Client) discardReply() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buffering && c.replyStart <= len(c.out) {
+		c.out = c.out[:c.replyStart]
+	}
+}
+
+// Stop buffering the replies written by a handler, sending them if
+// the client isn't waiting for replies to other commands it already
+// sent, so replies to pipelined commands are sent together
+func (c *Client) stopBuffering() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buffering = false
+	c.lastActive = time.Now()
+
+	if len(c.pushes) > 0 {
+		c.out = append(c.out, c.pushes...)
+		c.pushes = c.pushes[:0]
+	}
+
+	if !c.closeAfterReply && c.r != nil && c.r.Buffered() > 0 && len(c.out) < maxPendingOutput {
+		return nil
+	}
+
+	return c.flush()
+}
+
+// Set the number of pub/sub subscriptions of the client
+func (c *Client) setSubscriptions(n int) {
+	c.mu.Lock()
+	c.subscriptions = n
+	c.mu.Unlock()
+}
+
+func (c *Client) subscribed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptions > 0
+}
+
+// Returns the version of the Redis protocol used by the client: 2,
+// the default, or 3 after a successful HELLO 3
+func (c *Client) Protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.proto == 0 {
+		return 2
+	}
+	return c.proto
+}
+
+// Set the version of the Redis protocol used to write replies to the
+// client, either 2 or 3
+func (c *Client) SetProtocol(proto int) error {
+	if proto != 2 && proto != 3 {
+		return fmt.Errorf("unsupported protocol version %d", proto)
+	}
+
+	c.mu.Lock()
+	c.proto = proto
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Client) resp3() bool {
+	return c.Protocol() == 3
+}
+
+func (c *Client) writeHeader(kind byte, n int64) error {
+	buf := make([]byte, 0, 24)
+	buf = append(buf, kind)
+	buf = strconv.AppendInt(buf, n, 10)
+	buf = append(buf, '\r', '\n')
+	_, err := c.Write(buf)
+	return err
 }
 
 // Sends an error to the client, formatted accordingly to the Redis
 // protocol
+//
+// Errors of type gedis.Error are sent as they are, so they can have
+// their own prefix, like WRONGTYPE; any other error is prefixed with
+// ERR.
 func (c *Client) Error(err error) (int, error) {
+	if e, ok := err.(gedis.Error); ok {
+		return c.Write([]byte("-" + string(e) + "\r\n"))
+	}
 	return c.Write(gedis.WriteError(err))
 }
 
@@ -45,3 +642,126 @@ func (c *Client) Errorf(format string, args ...interface{}) (int, error) {
 func (c *Client) Status(status string) (int, error) {
 	return c.Write(gedis.WriteStatus(status))
 }
+
+// Sends an integer reply
+func (c *Client) WriteInt(n int64) error {
+	return c.writeHeader(':', n)
+}
+
+// Sends a bulk reply
+func (c *Client) WriteBulk(bs []byte) error {
+	buf := make([]byte, 0, len(bs)+16)
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(bs)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, bs...)
+	buf = append(buf, '\r', '\n')
+	_, err := c.Write(buf)
+	return err
+}
+
+// Sends a string as a bulk reply
+func (c *Client) WriteBulkString(s string) error {
+	return c.WriteBulk([]byte(s))
+}
+
+// Sends a nil reply: a nil bulk in RESP2, or a null in RESP3
+func (c *Client) WriteNull() error {
+	if c.resp3() {
+		_, err := c.Write([]byte("_\r\n"))
+		return err
+	}
+	_, err := c.Write([]byte("$-1\r\n"))
+	return err
+}
+
+// Sends a nil array reply: a nil multi-bulk in RESP2, or a null in
+// RESP3
+func (c *Client) WriteNullArray() error {
+	if c.resp3() {
+		_, err := c.Write([]byte("_\r\n"))
+		return err
+	}
+	_, err := c.Write([]byte("*-1\r\n"))
+	return err
+}
+
+// Start an array reply of n elements, which must be written next
+func (c *Client) WriteArray(n int) error {
+	return c.writeHeader('*', int64(n))
+}
+
+// Start a map reply of n key/value pairs, which must be written next
+//
+// In RESP2 maps are sent as arrays of 2*n elements.
+func (c *Client) WriteMap(n int) error {
+	if c.resp3() {
+		return c.writeHeader('%', int64(n))
+	}
+	return c.writeHeader('*', int64(2*n))
+}
+
+// Start a set reply of n elements, which must be written next
+//
+// In RESP2 sets are sent as arrays.
+func (c *Client) WriteSet(n int) error {
+	if c.resp3() {
+		return c.writeHeader('~', int64(n))
+	}
+	return c.writeHeader('*', int64(n))
+}
+
+// Start an out of band push message of n elements, like pub/sub
+// messages, which must be written next
+//
+// In RESP2 pushes are sent as arrays.
+func (c *Client) WritePush(n int) error {
+	if c.resp3() {
+		return c.writeHeader('>', int64(n))
+	}
+	return c.writeHeader('*', int64(n))
+}
+
+// Sends a floating point reply
+//
+// In RESP2 doubles are sent as bulks.
+func (c *Client) WriteDouble(f float64) error {
+	var s string
+
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+
+	if c.resp3() {
+		_, err := c.Write([]byte("," + s + "\r\n"))
+		return err
+	}
+
+	return c.WriteBulkString(s)
+}
+
+// Sends a boolean reply
+//
+// In RESP2 booleans are sent as the integers 1 and 0.
+func (c *Client) WriteBool(b bool) error {
+	if c.resp3() {
+		if b {
+			_, err := c.Write([]byte("#t\r\n"))
+			return err
+		}
+		_, err := c.Write([]byte("#f\r\n"))
+		return err
+	}
+
+	if b {
+		return c.WriteInt(1)
+	}
+	return c.WriteInt(0)
+}
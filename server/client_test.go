@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/inkel/gedis"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// A client that keeps its replies in its buffer
+func bufferedClient(proto int) *Client {
+	c := &Client{buffering: true}
+	c.SetProtocol(proto)
+	return c
+}
+
+func expectOutput(t *testing.T, c *Client, expected string) {
+	t.Helper()
+	if string(c.out) != expected {
+		t.Fatalf("Expected %q, got %q", expected, c.out)
+	}
+	c.out = c.out[:0]
+}
+
+func TestClient_replies(t *testing.T) {
+	for _, proto := range []int{2, 3} {
+		c := bufferedClient(proto)
+
+		c.WriteInt(-42)
+		expectOutput(t, c, ":-42\r\n")
+
+		c.WriteBulk([]byte("lorem\r\nipsum"))
+		expectOutput(t, c, "$12\r\nlorem\r\nipsum\r\n")
+
+		c.WriteBulkString("")
+		expectOutput(t, c, "$0\r\n\r\n")
+
+		c.WriteArray(2)
+		expectOutput(t, c, "*2\r\n")
+
+		c.Status("OK")
+		expectOutput(t, c, "+OK\r\n")
+
+		c.Error(errors.New("lorem"))
+		expectOutput(t, c, "-ERR lorem\r\n")
+
+		c.Error(gedis.Error("WRONGTYPE lorem"))
+		expectOutput(t, c, "-WRONGTYPE lorem\r\n")
+	}
+}
+
+func TestClient_resp2(t *testing.T) {
+	c := bufferedClient(2)
+
+	c.WriteNull()
+	expectOutput(t, c, "$-1\r\n")
+
+	c.WriteNullArray()
+	expectOutput(t, c, "*-1\r\n")
+
+	c.WriteMap(2)
+	expectOutput(t, c, "*4\r\n")
+
+	c.WriteSet(3)
+	expectOutput(t, c, "*3\r\n")
+
+	c.WritePush(3)
+	expectOutput(t, c, "*3\r\n")
+
+	c.WriteDouble(1.5)
+	expectOutput(t, c, "$3\r\n1.5\r\n")
+
+	c.WriteDouble(math.Inf(-1))
+	expectOutput(t, c, "$4\r\n-inf\r\n")
+
+	c.WriteBool(true)
+	expectOutput(t, c, ":1\r\n")
+}
+
+func TestClient_resp3(t *testing.T) {
+	c := bufferedClient(3)
+
+	c.WriteNull()
+	expectOutput(t, c, "_\r\n")
+
+	c.WriteNullArray()
+	expectOutput(t, c, "_\r\n")
+
+	c.WriteMap(2)
+	expectOutput(t, c, "%2\r\n")
+
+	c.WriteSet(3)
+	expectOutput(t, c, "~3\r\n")
+
+	c.WritePush(3)
+	expectOutput(t, c, ">3\r\n")
+
+	c.WriteDouble(1.5)
+	expectOutput(t, c, ",1.5\r\n")
+
+	c.WriteDouble(math.Inf(1))
+	expectOutput(t, c, ",inf\r\n")
+
+	c.WriteBool(false)
+	expectOutput(t, c, "#f\r\n")
+}
+
+func TestClient_SetProtocol(t *testing.T) {
+	c := &Client{}
+
+	if c.Protocol() != 2 {
+		t.Fatalf("Unexpected default protocol %d", c.Protocol())
+	}
+
+	if err := c.SetProtocol(4); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestClient_buffering(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	s.Handle("TWICE", func(c *Client, args [][]byte) error {
+		c.WriteArray(2)
+		c.WriteBulk(args[0])
+		if len(c.out) == 0 {
+			t.Error("Replies should be buffered")
+		}
+		return c.WriteBulk(args[0])
+	})
+
+	conn, r := dial(t, s)
+
+	if _, err := conn.Write([]byte("*2\r\n$5\r\nTWICE\r\n$5\r\nlorem\r\n")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	res, err := gedis.Read(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if arr, ok := res.([]interface{}); !ok || len(arr) != 2 || arr[0] != "lorem" || arr[1] != "lorem" {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
+
+func TestClient_Write_outsideHandler(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := &Client{conn: &a}
+
+	go c.WriteBulkString("lorem")
+
+	buf := make([]byte, 11)
+	if _, err := b.Read(buf); err != nil || string(buf) != "$5\r\nlorem\r\n" {
+		t.Fatalf("Unexpected %q, %v", buf, err)
+	}
+}
+
+func TestClient_state(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := newClient(nil, a)
+
+	if c.ID() == 0 || newClient(nil, a).ID() == c.ID() {
+		t.Fatal("Clients should have unique IDs")
+	}
+
+	if c.DB() != 0 || c.User() != "default" || c.Name() != "" {
+		t.Fatalf("Unexpected defaults: %d %q %q", c.DB(), c.User(), c.Name())
+	}
+
+	c.SetDB(3)
+	c.SetUser("admin")
+
+	if c.DB() != 3 || c.User() != "admin" {
+		t.Fatalf("Unexpected state: %d %q", c.DB(), c.User())
+	}
+
+	if err := c.SetName("bad\nname"); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if err := c.SetName("worker-1"); err != nil || c.Name() != "worker-1" {
+		t.Fatalf("Unexpected %q, %v", c.Name(), err)
+	}
+
+	type key struct{}
+
+	c.SetValue(key{}, "lorem")
+	if v := c.Value(key{}); v != "lorem" {
+		t.Fatalf("Unexpected value: %#v", v)
+	}
+
+	c.SetValue(key{}, nil)
+	if v := c.Value(key{}); v != nil {
+		t.Fatalf("Unexpected value: %#v", v)
+	}
+
+	if err := c.Context().Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	c.Close()
+
+	if err := c.Context().Err(); err != context.Canceled {
+		t.Fatalf("The context should be cancelled, got %v", err)
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	done := make(chan error, 1)
+	s.Handle("WAIT", func(c *Client, args [][]byte) error {
+		<-c.Context().Done()
+		done <- c.Context().Err()
+		return nil
+	})
+
+	conn, _ := dial(t, s)
+	conn.Write([]byte("*1\r\n$4\r\nWAIT\r\n"))
+
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The context wasn't cancelled")
+	}
+}
+
+func TestClient_Context_disconnect(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	done := make(chan error, 1)
+	s.Handle("WAIT", func(c *Client, args [][]byte) error {
+		select {
+		case <-c.Context().Done():
+			done <- c.Context().Err()
+		case <-time.After(500 * time.Millisecond):
+			done <- nil
+		}
+		return nil
+	})
+
+	conn, r := dial(t, s)
+
+	// Pipelined commands aren't taken for a disconnection
+	conn.Write([]byte("*1\r\n$4\r\nWAIT\r\n*1\r\n$4\r\nPING\r\n"))
+
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("The context wasn't cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The context wasn't cancelled")
+	}
+
+	// A client that stays connected can keep sending commands
+	conn, r = dial(t, s)
+	conn.Write([]byte("*1\r\n$4\r\nWAIT\r\n"))
+
+	time.Sleep(20 * time.Millisecond)
+	if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+}
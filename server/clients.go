@@ -0,0 +1,344 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A snapshot of the state of a client, as reported by CLIENT LIST
+type ClientInfo struct {
+	ID        int64
+	Addr      string
+	LocalAddr string
+	Name      string
+	User      string
+	DB        int
+
+	// Time since the client connected, and since its last command
+	Age  time.Duration
+	Idle time.Duration
+
+	// Name of the last command run, in lower case
+	LastCommand string
+
+	// Size of the pipelined commands waiting to be read, as of the
+	// last command, and of the replies waiting to be sent
+	InputBuffer  int
+	OutputBuffer int
+}
+
+// Formats the info like a line of CLIENT LIST
+func (i ClientInfo) String() string {
+	cmd := i.LastCommand
+	if cmd == "" {
+		cmd = "NULL"
+	}
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=%d qbuf=%d omem=%d cmd=%s user=%s",
+		i.ID, i.Addr, i.LocalAddr, i.Name, int64(i.Age/time.Second), int64(i.Idle/time.Second),
+		i.DB, i.InputBuffer, i.OutputBuffer, cmd, i.User)
+}
+
+// Returns a snapshot of the state of the client
+func (c *Client) Info() ClientInfo {
+	info := ClientInfo{
+		ID:   c.id,
+		Name: c.Name(),
+		User: c.User(),
+		DB:   c.DB(),
+	}
+
+	if c.conn != nil {
+		info.Addr = c.RemoteAddr().String()
+		info.LocalAddr = c.LocalAddr().String()
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	info.Age = now.Sub(c.created)
+	info.Idle = now.Sub(c.lastActive)
+	info.LastCommand = strings.ToLower(c.cmd)
+	info.InputBuffer = c.inputBuffer
+	info.OutputBuffer = c.unsent()
+	c.mu.Unlock()
+
+	return info
+}
+
+// Close the connection once the reply to the current command is sent
+func (c *Client) closeAfterCommand() {
+	c.mu.Lock()
+	c.closeAfterReply = true
+	c.mu.Unlock()
+}
+
+func (c *Client) closing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeAfterReply
+}
+
+// Returns the connected clients, sorted by ID
+func (s *Server) Clients() []*Client {
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	return clients
+}
+
+// Stop processing commands for d; with writesOnly only the commands
+// flagged FlagWrite are held
+//
+// Commands flagged FlagAdmin, like CLIENT, are never held.
+func (s *Server) Pause(d time.Duration, writesOnly bool) {
+	s.mu.Lock()
+	s.pauseUntil = time.Now().Add(d)
+	s.pauseAll = !writesOnly
+	s.mu.Unlock()
+}
+
+// Resume processing commands after Pause
+func (s *Server) Unpause() {
+	s.mu.Lock()
+	s.pauseUntil = time.Time{}
+	close(s.unpaused)
+	s.unpaused = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Wait until cmd can run if the server is paused
+func (s *Server) waitPause(cmd *Command) {
+	if cmd.Flags&FlagAdmin != 0 {
+		return
+	}
+
+	for {
+		s.mu.Lock()
+		wait := time.Until(s.pauseUntil)
+		all := s.pauseAll
+		unpaused := s.unpaused
+		s.mu.Unlock()
+
+		if wait <= 0 || (!all && cmd.Flags&FlagWrite == 0) {
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-unpaused:
+		}
+	}
+}
+
+// The CLIENT command, not registered by default
+//
+// It implements the subcommands ID, INFO, LIST, KILL, GETNAME,
+// SETNAME, PAUSE and UNPAUSE. Register it with:
+//
+//	s.Register(server.ClientCommand)
+var ClientCommand = Command{
+	Name:    "CLIENT",
+	Handler: clientCommand,
+	Arity:   -2,
+	Flags:   FlagAdmin | FlagNoScript,
+	Help:    "Inspect and manage client connections",
+}
+
+func clientCommand(c *Client, args [][]byte) error {
+	sub := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	var err error
+
+	switch {
+	case sub == "ID" && len(args) == 0:
+		err = c.WriteInt(c.ID())
+
+	case sub == "INFO" && len(args) == 0:
+		err = c.WriteBulkString(c.Info().String() + "\n")
+
+	case sub == "LIST":
+		err = clientList(c, args)
+
+	case sub == "KILL" && len(args) > 0:
+		err = clientKill(c, args)
+
+	case sub == "GETNAME" && len(args) == 0:
+		if name := c.Name(); name != "" {
+			err = c.WriteBulkString(name)
+		} else {
+			err = c.WriteNull()
+		}
+
+	case sub == "SETNAME" && len(args) == 1:
+		if err = c.SetName(string(args[0])); err != nil {
+			_, err = c.Error(err)
+		} else {
+			_, err = c.Status("OK")
+		}
+
+	case sub == "PAUSE" && (len(args) == 1 || len(args) == 2):
+		err = clientPause(c, args)
+
+	case sub == "UNPAUSE" && len(args) == 0:
+		c.server.Unpause()
+		_, err = c.Status("OK")
+
+	default:
+		_, err = c.Errorf("unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", strings.ToLower(sub))
+	}
+
+	return err
+}
+
+// CLIENT LIST [ID id ...]
+func clientList(c *Client, args [][]byte) error {
+	var ids map[int64]bool
+
+	if len(args) > 0 {
+		if strings.ToUpper(string(args[0])) != "ID" || len(args) == 1 {
+			_, err := c.Errorf("syntax error")
+			return err
+		}
+
+		ids = make(map[int64]bool)
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(string(arg), 10, 64)
+			if err != nil || id <= 0 {
+				_, err = c.Errorf("Invalid client ID")
+				return err
+			}
+			ids[id] = true
+		}
+	}
+
+	var buf strings.Builder
+	for _, cl := range c.server.Clients() {
+		if ids == nil || ids[cl.ID()] {
+			buf.WriteString(cl.Info().String())
+			buf.WriteByte('\n')
+		}
+	}
+
+	return c.WriteBulkString(buf.String())
+}
+
+// CLIENT KILL addr, or CLIENT KILL with ID, ADDR, USER and SKIPME
+// filters
+func clientKill(c *Client, args [][]byte) error {
+	var (
+		id     int64
+		addr   string
+		user   string
+		skipMe = true
+	)
+
+	legacy := len(args) == 1
+	if legacy {
+		addr = string(args[0])
+	} else {
+		if len(args)%2 != 0 {
+			_, err := c.Errorf("syntax error")
+			return err
+		}
+
+		for i := 0; i < len(args); i += 2 {
+			val := string(args[i+1])
+
+			switch strings.ToUpper(string(args[i])) {
+			case "ID":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					_, err = c.Errorf("client-id should be greater than 0")
+					return err
+				}
+				id = n
+			case "ADDR":
+				addr = val
+			case "USER":
+				user = val
+			case "SKIPME":
+				switch strings.ToLower(val) {
+				case "yes":
+					skipMe = true
+				case "no":
+					skipMe = false
+				default:
+					_, err := c.Errorf("syntax error")
+					return err
+				}
+			default:
+				_, err := c.Errorf("syntax error")
+				return err
+			}
+		}
+	}
+
+	killed := 0
+
+	for _, cl := range c.server.Clients() {
+		if (id != 0 && cl.ID() != id) ||
+			(addr != "" && cl.RemoteAddr().String() != addr) ||
+			(user != "" && cl.User() != user) {
+			continue
+		}
+
+		if cl == c {
+			// SKIPME doesn't apply to the legacy form
+			if skipMe && !legacy {
+				continue
+			}
+			c.closeAfterCommand()
+		} else {
+			cl.Close()
+		}
+
+		killed++
+	}
+
+	if legacy {
+		if killed == 0 {
+			_, err := c.Errorf("No such client")
+			return err
+		}
+		_, err := c.Status("OK")
+		return err
+	}
+
+	return c.WriteInt(int64(killed))
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+func clientPause(c *Client, args [][]byte) error {
+	ms, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || ms < 0 {
+		_, err = c.Errorf("timeout is not an integer or out of range")
+		return err
+	}
+
+	writesOnly := false
+	if len(args) == 2 {
+		switch strings.ToUpper(string(args[1])) {
+		case "WRITE":
+			writesOnly = true
+		case "ALL":
+		default:
+			_, err = c.Errorf("syntax error")
+			return err
+		}
+	}
+
+	c.server.Pause(time.Duration(ms)*time.Millisecond, writesOnly)
+
+	_, err = c.Status("OK")
+	return err
+}
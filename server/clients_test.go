@@ -0,0 +1,172 @@
+package server
+
+import (
+	"github.com/inkel/gedis"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func clientServer(t *testing.T) *Server {
+	s, _ := startServer(t)
+	t.Cleanup(func() { s.Close() })
+
+	s.Register(ClientCommand)
+	s.Register(Command{
+		Name:  "SET",
+		Arity: -3,
+		Flags: FlagWrite,
+		Handler: func(c *Client, args [][]byte) error {
+			_, err := c.Status("OK")
+			return err
+		},
+	})
+
+	return s
+}
+
+func TestClientCommand_id(t *testing.T) {
+	s := clientServer(t)
+
+	a, b := connect(t, s), connect(t, s)
+
+	idA, idB := a.send("CLIENT", "ID"), b.send("CLIENT", "ID")
+	if idA == idB {
+		t.Fatalf("IDs should be unique: %v %v", idA, idB)
+	}
+
+	if res := a.send("CLIENT", "GETNAME"); res != nil {
+		t.Fatalf("Unexpected name: %#v", res)
+	}
+
+	if res := a.send("CLIENT", "SETNAME", "lorem ipsum"); res == gedis.Status("OK") {
+		t.Fatal("Names with spaces should be rejected")
+	}
+
+	if res := a.send("CLIENT", "SETNAME", "worker"); res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	if res := a.send("CLIENT", "GETNAME"); res != "worker" {
+		t.Fatalf("Unexpected name: %#v", res)
+	}
+
+	info, _ := a.send("CLIENT", "INFO").(string)
+	if !strings.HasPrefix(info, "id="+strconv.FormatInt(idA.(int64), 10)+" ") ||
+		!strings.Contains(info, " name=worker ") || !strings.Contains(info, " cmd=client ") {
+		t.Fatalf("Unexpected info: %q", info)
+	}
+
+	list, _ := b.send("CLIENT", "LIST").(string)
+	if lines := strings.Split(strings.TrimSpace(list), "\n"); len(lines) != 2 || !strings.Contains(lines[0], " name=worker ") {
+		t.Fatalf("Unexpected list: %q", list)
+	}
+
+	list, _ = b.send("CLIENT", "LIST", "ID", idB).(string)
+	if lines := strings.Split(strings.TrimSpace(list), "\n"); len(lines) != 1 || strings.Contains(lines[0], " name=worker ") {
+		t.Fatalf("Unexpected list: %q", list)
+	}
+
+	if _, ok := a.send("CLIENT", "NOPE").(gedis.Error); !ok {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestServer_Clients(t *testing.T) {
+	s := clientServer(t)
+
+	a, b := connect(t, s), connect(t, s)
+	a.send("PING")
+	b.send("SET", "lorem", "ipsum")
+
+	clients := s.Clients()
+	if len(clients) != 2 || clients[0].ID() > clients[1].ID() {
+		t.Fatalf("Unexpected clients: %v", clients)
+	}
+
+	info := clients[1].Info()
+	if info.LastCommand != "set" || info.Addr != b.conn.LocalAddr().String() || info.Age < info.Idle {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+}
+
+func TestClientCommand_kill(t *testing.T) {
+	s := clientServer(t)
+
+	a, b, c := connect(t, s), connect(t, s), connect(t, s)
+
+	// The legacy form
+	if res := a.send("CLIENT", "KILL", b.conn.LocalAddr().String()); res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+	if _, err := b.r.ReadString('\n'); err == nil {
+		t.Fatal("The client should be disconnected")
+	}
+
+	if _, ok := a.send("CLIENT", "KILL", "127.0.0.1:1").(gedis.Error); !ok {
+		t.Fatal("Expected an error")
+	}
+
+	// SKIPME is the default
+	if res := a.send("CLIENT", "KILL", "USER", "default"); res != int64(1) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Fatal("The client should be disconnected")
+	}
+
+	id := a.send("CLIENT", "ID")
+	if res := a.send("CLIENT", "KILL", "ID", id, "SKIPME", "no"); res != int64(1) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+	if _, err := a.r.ReadString('\n'); err == nil {
+		t.Fatal("The client should be disconnected after the reply")
+	}
+}
+
+func TestClientCommand_pause(t *testing.T) {
+	s := clientServer(t)
+
+	a, b := connect(t, s), connect(t, s)
+
+	if res := a.send("CLIENT", "PAUSE", 5000, "WRITE"); res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	// Reads aren't paused
+	if res := b.send("PING"); res != gedis.Status("PONG") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	done := make(chan interface{}, 1)
+	go func() {
+		done <- b.send("SET", "lorem", "ipsum")
+	}()
+
+	select {
+	case res := <-done:
+		t.Fatalf("Writes should be paused, got %#v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if res := a.send("CLIENT", "UNPAUSE"); res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	select {
+	case res := <-done:
+		if res != gedis.Status("OK") {
+			t.Fatalf("Unexpected reply: %#v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Writes should be resumed")
+	}
+
+	// Pauses expire
+	start := time.Now()
+	a.send("CLIENT", "PAUSE", 50)
+	if res := b.send("PING"); res != gedis.Status("PONG") || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("Unexpected reply: %#v after %v", res, time.Since(start))
+	}
+}
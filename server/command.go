@@ -0,0 +1,193 @@
+package server
+
+import (
+	"sort"
+	"strings"
+)
+
+// Properties of a command, as reported by COMMAND
+type Flag int
+
+const (
+	// The command only reads data
+	FlagReadOnly Flag = 1 << iota
+	// The command may modify data
+	FlagWrite
+	// The command is meant for operators, like CONFIG or SHUTDOWN
+	FlagAdmin
+	// The command can't be called from scripts
+	FlagNoScript
+	// The command is related to pub/sub
+	FlagPubSub
+	// The command may block the client
+	FlagBlocking
+)
+
+var flagNames = []string{"readonly", "write", "admin", "noscript", "pubsub", "blocking"}
+
+// Returns the names of the flags set, as used by Redis
+func (f Flag) Names() []string {
+	names := []string{}
+	for i, name := range flagNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// A command served by a Server
+//
+// Only Name and Handler are required. Arity follows the Redis
+// convention, counting the command name: a positive arity is the exact
+// number of arguments, and a negative one the minimum, so GET has an
+// arity of 2 and MSET of -3. Zero skips the check.
+//
+// Commands called with the wrong number of arguments get an error
+// reply and never reach the handler.
+type Command struct {
+	Name    string
+	Handler Handler
+	Arity   int
+	Flags   Flag
+
+	// Positions of the first and last keys in the arguments, counting
+	// the command name, and the step between keys; a negative LastKey
+	// counts from the end, and zero means the command takes no keys
+	FirstKey, LastKey, KeyStep int
+
+	// One line summary, reported by COMMAND DOCS
+	Help string
+}
+
+func (cmd *Command) validArity(n int) bool {
+	if cmd.Arity >= 0 {
+		return cmd.Arity == 0 || n == cmd.Arity
+	}
+	return n >= -cmd.Arity
+}
+
+// Add a command
+//
+// The handler is wrapped with the middleware given, and then with the
+// middleware added to the server with Use. A previous command with the
+// same name is replaced.
+func (s *Server) Register(cmd Command, middleware ...Middleware) {
+	cmd.Name = strings.ToUpper(cmd.Name)
+	r := &route{cmd: cmd, middleware: middleware}
+	r.handler = s.chain(r)
+	s.routes[cmd.Name] = r
+}
+
+// Returns the command registered with name, if any
+//
+// Useful for middleware that depend on the flags of the command, like
+// rejecting writes.
+func (s *Server) Lookup(name string) (Command, bool) {
+	r, ok := s.routes[strings.ToUpper(name)]
+	if !ok {
+		return Command{}, false
+	}
+	return r.cmd, true
+}
+
+// Returns the registered commands, sorted by name
+func (s *Server) commands() []Command {
+	cmds := make([]Command, 0, len(s.routes))
+	for _, r := range s.routes {
+		cmds = append(cmds, r.cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Handler for COMMAND and its subcommands COUNT, LIST, INFO and DOCS
+func (s *Server) commandInfo(c *Client, args [][]byte) error {
+	if len(args) == 0 {
+		cmds := s.commands()
+		c.WriteArray(len(cmds))
+		for _, cmd := range cmds {
+			writeCommandInfo(c, cmd)
+		}
+		return nil
+	}
+
+	sub := strings.ToUpper(string(args[0]))
+
+	switch {
+	case sub == "COUNT" && len(args) == 1:
+		return c.WriteInt(int64(len(s.routes)))
+
+	case sub == "LIST" && len(args) == 1:
+		cmds := s.commands()
+		c.WriteArray(len(cmds))
+		for _, cmd := range cmds {
+			c.WriteBulkString(strings.ToLower(cmd.Name))
+		}
+		return nil
+
+	case sub == "INFO":
+		cmds := s.commands()
+		if len(args) > 1 {
+			cmds = cmds[:0]
+			for _, name := range args[1:] {
+				cmd, _ := s.Lookup(string(name))
+				cmds = append(cmds, cmd)
+			}
+		}
+
+		c.WriteArray(len(cmds))
+		for _, cmd := range cmds {
+			if cmd.Name == "" {
+				c.WriteNull()
+			} else {
+				writeCommandInfo(c, cmd)
+			}
+		}
+		return nil
+
+	case sub == "DOCS":
+		cmds := s.commands()
+		if len(args) > 1 {
+			cmds = cmds[:0]
+			for _, name := range args[1:] {
+				if cmd, ok := s.Lookup(string(name)); ok {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+
+		c.WriteMap(len(cmds))
+		for _, cmd := range cmds {
+			c.WriteBulkString(strings.ToLower(cmd.Name))
+			c.WriteMap(1)
+			c.WriteBulkString("summary")
+			c.WriteBulkString(cmd.Help)
+		}
+		return nil
+	}
+
+	_, err := c.Errorf("unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.", args[0])
+	return err
+}
+
+// Write the reply of COMMAND INFO for cmd, in the format of Redis 7
+func writeCommandInfo(c *Client, cmd Command) {
+	flags := cmd.Flags.Names()
+
+	c.WriteArray(10)
+	c.WriteBulkString(strings.ToLower(cmd.Name))
+	c.WriteInt(int64(cmd.Arity))
+	c.WriteSet(len(flags))
+	for _, flag := range flags {
+		c.Status(flag)
+	}
+	c.WriteInt(int64(cmd.FirstKey))
+	c.WriteInt(int64(cmd.LastKey))
+	c.WriteInt(int64(cmd.KeyStep))
+
+	// ACL categories, tips, key specifications and subcommands
+	for i := 0; i < 4; i++ {
+		c.WriteArray(0)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"github.com/inkel/gedis"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlag_Names(t *testing.T) {
+	if names := (FlagWrite | FlagBlocking).Names(); !reflect.DeepEqual(names, []string{"write", "blocking"}) {
+		t.Fatalf("Unexpected names: %q", names)
+	}
+
+	if names := Flag(0).Names(); len(names) != 0 {
+		t.Fatalf("Unexpected names: %q", names)
+	}
+}
+
+func TestServer_Register_arity(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	ok := func(c *Client, args [][]byte) error {
+		_, err := c.Status("OK")
+		return err
+	}
+
+	s.Register(Command{Name: "get", Handler: ok, Arity: 2})
+	s.Register(Command{Name: "mset", Handler: ok, Arity: -3})
+
+	tests := []struct {
+		args     []interface{}
+		expected interface{}
+	}{
+		{[]interface{}{"GET", "a"}, gedis.Status("OK")},
+		{[]interface{}{"GET"}, gedis.Error("ERR wrong number of arguments for 'get' command")},
+		{[]interface{}{"get", "a", "b"}, gedis.Error("ERR wrong number of arguments for 'get' command")},
+		{[]interface{}{"MSET", "a", "1"}, gedis.Status("OK")},
+		{[]interface{}{"MSET", "a", "1", "b", "2"}, gedis.Status("OK")},
+		{[]interface{}{"MSET", "a"}, gedis.Error("ERR wrong number of arguments for 'mset' command")},
+		{[]interface{}{"PING", "a", "b", "c"}, gedis.Status("PONG")},
+	}
+
+	for _, tt := range tests {
+		if res := connect(t, s).send(tt.args...); res != tt.expected {
+			t.Errorf("%q: expected %#v, got %#v", tt.args, tt.expected, res)
+		}
+	}
+}
+
+func TestServer_Lookup(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	s.Register(Command{Name: "set", Arity: -3, Flags: FlagWrite})
+
+	cmd, ok := s.Lookup("SET")
+	if !ok || cmd.Name != "SET" || cmd.Flags != FlagWrite {
+		t.Fatalf("Unexpected command: %#v, %v", cmd, ok)
+	}
+
+	if _, ok = s.Lookup("GET"); ok {
+		t.Fatal("GET isn't registered")
+	}
+}
+
+func TestServer_command(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	s.Register(Command{
+		Name:     "GET",
+		Arity:    2,
+		Flags:    FlagReadOnly,
+		FirstKey: 1,
+		LastKey:  1,
+		KeyStep:  1,
+		Help:     "Get the value of a key",
+	})
+
+	c := connect(t, s)
+
+	if res := c.send("COMMAND", "COUNT"); res != int64(4) {
+		t.Fatalf("Unexpected count: %#v", res)
+	}
+
+	res := c.send("COMMAND", "LIST")
+	if !reflect.DeepEqual(res, []interface{}{"command", "get", "hello", "ping"}) {
+		t.Fatalf("Unexpected list: %#v", res)
+	}
+
+	res = c.send("COMMAND", "INFO", "get", "nope")
+	expected := []interface{}{
+		[]interface{}{"get", int64(2), []interface{}{gedis.Status("readonly")}, int64(1), int64(1), int64(1),
+			[]interface{}{}, []interface{}{}, []interface{}{}, []interface{}{}},
+		nil,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Unexpected info:\n%#v\n%#v", expected, res)
+	}
+
+	res = c.send("COMMAND")
+	if arr, ok := res.([]interface{}); !ok || len(arr) != 4 {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	res = c.send("COMMAND", "DOCS", "GET")
+	if !reflect.DeepEqual(res, []interface{}{"get", []interface{}{"summary", "Get the value of a key"}}) {
+		t.Fatalf("Unexpected docs: %#v", res)
+	}
+
+	res = c.send("COMMAND", "NOPE")
+	if err, ok := res.(gedis.Error); !ok || !strings.Contains(string(err), "unknown subcommand") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
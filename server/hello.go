@@ -0,0 +1,71 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Reported by HELLO
+const (
+	serverName    = "gedis"
+	serverVersion = "0.1.0"
+)
+
+// Handler for the HELLO command, registered by NewServer
+//
+// HELLO switches the protocol used by the connection to the requested
+// version, 2 or 3, and replies with information about the server. With
+// no version it just replies with the information. The SETNAME option
+// sets the name of the connection.
+func Hello(c *Client, args [][]byte) error {
+	proto := c.Protocol()
+
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			_, err = c.Errorf("Protocol version is not an integer or out of range")
+			return err
+		}
+
+		if v != 2 && v != 3 {
+			_, err = c.Write([]byte("-NOPROTO unsupported protocol version\r\n"))
+			return err
+		}
+
+		proto = v
+
+		for i := 1; i < len(args); i++ {
+			opt := strings.ToUpper(string(args[i]))
+
+			if opt != "SETNAME" || i+1 == len(args) {
+				_, err = c.Errorf("Syntax error in HELLO option '%s'", strings.ToLower(opt))
+				return err
+			}
+
+			i++
+			if err = c.SetName(string(args[i])); err != nil {
+				_, err = c.Error(err)
+				return err
+			}
+		}
+	}
+
+	c.SetProtocol(proto)
+
+	c.WriteMap(7)
+	c.WriteBulkString("server")
+	c.WriteBulkString(serverName)
+	c.WriteBulkString("version")
+	c.WriteBulkString(serverVersion)
+	c.WriteBulkString("proto")
+	c.WriteInt(int64(proto))
+	c.WriteBulkString("id")
+	c.WriteInt(c.ID())
+	c.WriteBulkString("mode")
+	c.WriteBulkString("standalone")
+	c.WriteBulkString("role")
+	c.WriteBulkString("master")
+	c.WriteBulkString("modules")
+
+	return c.WriteArray(0)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/inkel/gedis"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	conn, r := dial(t, s)
+
+	hello := func(args string) string {
+		if _, err := conn.Write([]byte(args)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return line
+	}
+
+	// RESP2 maps are arrays
+	if line := hello("*1\r\n$5\r\nHELLO\r\n"); line != "*14\r\n" {
+		t.Fatalf("Unexpected reply: %q", line)
+	}
+	for i := 0; i < 14; i++ {
+		if _, err := gedis.Read(r); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if line := hello("*2\r\n$5\r\nHELLO\r\n$1\r\n4\r\n"); line != "-NOPROTO unsupported protocol version\r\n" {
+		t.Fatalf("Unexpected reply: %q", line)
+	}
+
+	if line := hello("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"); line != "%7\r\n" {
+		t.Fatalf("Unexpected reply: %q", line)
+	}
+
+	// server and version pairs come first
+	for i := 0; i < 8; i++ {
+		r.ReadString('\n')
+	}
+
+	for _, expected := range []string{"$5\r\n", "proto\r\n", ":3\r\n"} {
+		if line, _ := r.ReadString('\n'); line != expected {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+}
+
+func TestHello_setname(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	var name string
+	s.Handle("GETNAME", func(c *Client, args [][]byte) error {
+		name = c.Name()
+		return c.WriteBulkString(name)
+	})
+
+	c := connect(t, s)
+
+	if _, ok := c.send("HELLO", 3, "SETNAME", "bad name").(gedis.Error); !ok {
+		t.Fatal("Expected an error for a name with spaces")
+	}
+
+	if _, ok := c.send("HELLO", 3, "SETNAME").(gedis.Error); !ok {
+		t.Fatal("Expected a syntax error")
+	}
+
+	if res, ok := c.send("HELLO", 2, "setname", "worker-1").([]interface{}); !ok || res[6] != "id" || res[7] == int64(0) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	if res := c.send("GETNAME"); res != "worker-1" {
+		t.Fatalf("Unexpected name: %#v", res)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"github.com/inkel/gedis"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_MaxClients(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.MaxClients = 1
+	})
+	defer s.Close()
+
+	conn, r := dial(t, s)
+	if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+
+	_, r2 := dial(t, s)
+	if res, _ := r2.ReadString('\n'); res != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("Unexpected reply: %q", res)
+	}
+	if _, err := r2.ReadString('\n'); err == nil {
+		t.Fatal("The connection should be closed")
+	}
+
+	// The first client is still served
+	if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+	})
+	defer s.Close()
+
+	conn, r := dial(t, s)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+			t.Fatalf("Unexpected %q, %v", res, err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("The connection should be closed")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("The idle client wasn't disconnected in time")
+	}
+}
+
+func TestServer_ReadTimeout(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.ReadTimeout = 50 * time.Millisecond
+	})
+	defer s.Close()
+
+	conn, r := dial(t, s)
+
+	// Waiting for a command doesn't count
+	time.Sleep(100 * time.Millisecond)
+	if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+
+	conn.Write([]byte("*1\r\n$4\r\n"))
+	if res, err := r.ReadString('\n'); err == nil {
+		t.Fatalf("The connection should be closed, got %q", res)
+	}
+}
+
+func TestServer_OutputBufferLimit_hard(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.OutputBufferLimit.Hard = 1024
+	})
+	defer s.Close()
+
+	s.Handle("BIG", func(c *Client, args [][]byte) error {
+		return c.WriteBulk(bytes.Repeat([]byte("x"), 2048))
+	})
+
+	conn, r := dial(t, s)
+
+	if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+
+	if res, err := command(conn, r, "BIG"); err == nil {
+		t.Fatalf("The connection should be closed, got %q", res)
+	}
+}
+
+func TestServer_OutputBufferLimit_soft(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.OutputBufferLimit = OutputBufferLimit{Soft: 10, SoftDuration: 20 * time.Millisecond}
+	})
+	defer s.Close()
+
+	s.Handle("SLOW", func(c *Client, args [][]byte) error {
+		c.WriteArray(3)
+		c.WriteBulkString(strings.Repeat("x", 10))
+		c.WriteBulkString("quick")
+		time.Sleep(50 * time.Millisecond)
+		return c.WriteBulkString("slow")
+	})
+
+	s.Handle("FAST", func(c *Client, args [][]byte) error {
+		c.WriteArray(2)
+		c.WriteBulkString(strings.Repeat("x", 10))
+		return c.WriteBulkString("quick")
+	})
+
+	conn, r := dial(t, s)
+
+	if res, err := command(conn, r, "FAST"); err != nil || res != "*2\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+	for i := 0; i < 4; i++ {
+		r.ReadString('\n')
+	}
+
+	if res, err := command(conn, r, "SLOW"); err == nil {
+		t.Fatalf("The connection should be closed, got %q", res)
+	}
+}
+
+func TestClient_Write_overLimit(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.OutputBufferLimit.Hard = 8
+	})
+	defer s.Close()
+
+	errs := make(chan error, 2)
+	s.Handle("BIG", func(c *Client, args [][]byte) error {
+		errs <- c.WriteBulkString("lorem ipsum")
+		errs <- c.WriteInt(1)
+		return nil
+	})
+
+	conn, r := dial(t, s)
+	command(conn, r, "BIG")
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrOutputBufferLimit {
+			t.Fatalf("Expected ErrOutputBufferLimit, got %v", err)
+		}
+	}
+}
+
+func TestServer_OutputBufferLimit_slowReader(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		s.OutputBufferLimit.Hard = 1024 * 1024
+	})
+	defer s.Close()
+
+	clients := make(chan *Client, 1)
+	s.Handle("HELLO", func(c *Client, args [][]byte) error {
+		clients <- c
+		_, err := c.Status("OK")
+		return err
+	})
+
+	conn, r := dial(t, s)
+	if res, err := command(conn, r, "HELLO"); err != nil || res != "+OK\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+
+	c := <-clients
+
+	// Writes outside of a handler, like pub/sub messages, to a client
+	// that never reads them
+	errs := make(chan error, 1)
+	go func() {
+		msg := gedis.WriteBulk(strings.Repeat("x", 64*1024))
+		for i := 0; i < 4096; i++ {
+			if _, err := c.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	select {
+	case err := <-errs:
+		if err != ErrOutputBufferLimit {
+			t.Fatalf("Expected ErrOutputBufferLimit, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writing to a client that doesn't read blocked")
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// A function that wraps a Handler to add behaviour to it, like
+// logging or authentication
+//
+// Middleware can reply and return without calling next to stop the
+// command from running.
+type Middleware func(next Handler) Handler
+
+// A command as registered, with its own middleware, and its handler
+// wrapped with all the middleware
+type route struct {
+	cmd        Command
+	middleware []Middleware
+	handler    Handler
+}
+
+// Wrap every handler with middleware
+//
+// Middleware run in the order they are added, the first one being the
+// outermost, before the middleware given to Handle. Like Handle, Use
+// must be called before Loop.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+
+	for _, r := range s.routes {
+		r.handler = s.chain(r)
+	}
+}
+
+// Wrap the handler of a route with its middleware and then with the
+// middleware of the server
+func (s *Server) chain(r *route) Handler {
+	h := r.cmd.Handler
+
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+
+	return h
+}
+
+// Middleware that turns a panic in a handler into an error reply,
+// instead of crashing the server
+//
+// Any reply the handler wrote before panicking is dropped. The error
+// returned includes the stack trace, and is logged by the server.
+// NewServer adds it to every server.
+func Recover(next Handler) Handler {
+	return func(c *Client, args [][]byte) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				c.discardReply()
+				c.Errorf("internal error running '%s'", strings.ToLower(c.Command()))
+				err = fmt.Errorf("panic running %s: %v\n%s", c.Command(), r, debug.Stack())
+			}
+		}()
+
+		return next(c, args)
+	}
+}
+
+// Apply middleware only to the given commands
+func Only(middleware Middleware, cmds ...string) Middleware {
+	return when(middleware, cmds, true)
+}
+
+// Apply middleware to every command except the given ones
+func Except(middleware Middleware, cmds ...string) Middleware {
+	return when(middleware, cmds, false)
+}
+
+func when(middleware Middleware, cmds []string, apply bool) Middleware {
+	set := make(map[string]bool, len(cmds))
+	for _, cmd := range cmds {
+		set[strings.ToUpper(cmd)] = true
+	}
+
+	return func(next Handler) Handler {
+		wrapped := middleware(next)
+
+		return func(c *Client, args [][]byte) error {
+			if set[c.Command()] == apply {
+				return wrapped(c, args)
+			}
+			return next(c, args)
+		}
+	}
+}
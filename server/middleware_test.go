@@ -0,0 +1,123 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// Record the order in which middleware run
+func tracing(name string, trace *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(c *Client, args [][]byte) error {
+			*trace = append(*trace, name)
+			return next(c, args)
+		}
+	}
+}
+
+func TestServer_Use(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	var trace []string
+
+	s.Handle("ECHO", func(c *Client, args [][]byte) error {
+		trace = append(trace, "handler")
+		return c.WriteBulk(args[0])
+	}, tracing("command", &trace))
+
+	// Use applies to handlers registered before and after it
+	s.Use(tracing("first", &trace), tracing("second", &trace))
+
+	s.Handle("NOOP", func(c *Client, args [][]byte) error {
+		trace = append(trace, "noop")
+		_, err := c.Status("OK")
+		return err
+	})
+
+	conn, r := dial(t, s)
+
+	conn.Write([]byte("*2\r\n$4\r\nECHO\r\n$5\r\nlorem\r\n"))
+	r.ReadString('\n')
+	r.ReadString('\n')
+
+	if strings.Join(trace, ",") != "first,second,command,handler" {
+		t.Fatalf("Unexpected order: %q", trace)
+	}
+
+	trace = nil
+
+	command(conn, r, "NOOP")
+
+	if strings.Join(trace, ",") != "first,second,noop" {
+		t.Fatalf("Unexpected order: %q", trace)
+	}
+}
+
+func TestServer_Use_stop(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	readOnly := func(next Handler) Handler {
+		return func(c *Client, args [][]byte) error {
+			_, err := c.Write([]byte("-READONLY You can't write against a read only server.\r\n"))
+			return err
+		}
+	}
+
+	s.Use(Except(readOnly, "PING"))
+
+	conn, r := dial(t, s)
+
+	if res, _ := command(conn, r, "PING"); res != "+PONG\r\n" {
+		t.Fatalf("Unexpected reply: %q", res)
+	}
+
+	s.Handle("FLUSHALL", func(c *Client, args [][]byte) error {
+		t.Error("The handler shouldn't run")
+		return nil
+	})
+
+	if res, _ := command(conn, r, "FLUSHALL"); !strings.HasPrefix(res, "-READONLY") {
+		t.Fatalf("Unexpected reply: %q", res)
+	}
+}
+
+func TestOnly(t *testing.T) {
+	var trace []string
+
+	h := Only(tracing("mw", &trace), "get")(func(c *Client, args [][]byte) error {
+		return nil
+	})
+
+	for _, cmd := range []string{"GET", "SET"} {
+		c := bufferedClient(2)
+		c.startCommand(cmd)
+		h(c, nil)
+	}
+
+	if len(trace) != 1 {
+		t.Fatalf("Unexpected trace: %q", trace)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	s.Handle("PANIC", func(c *Client, args [][]byte) error {
+		c.Status("partial")
+		panic("boom")
+	})
+
+	conn, r := dial(t, s)
+
+	// The panic doesn't affect the replies of pipelined commands
+	conn.Write([]byte("*1\r\n$4\r\nPING\r\n*1\r\n$5\r\nPANIC\r\n*1\r\n$4\r\nPING\r\n"))
+
+	for _, expected := range []string{"+PONG\r\n", "-ERR internal error running 'panic'\r\n", "+PONG\r\n"} {
+		if res, err := r.ReadString('\n'); err != nil || res != expected {
+			t.Fatalf("Expected %q, got %q, %v", expected, res, err)
+		}
+	}
+}
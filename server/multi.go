@@ -0,0 +1,294 @@
+package server
+
+import (
+	"sync"
+)
+
+// Commands that run right away inside a transaction
+var multiCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"QUIT":    true,
+}
+
+// Support for MULTI, EXEC, DISCARD, WATCH and UNWATCH
+//
+// After MULTI the commands of a client are queued, replying QUEUED,
+// and run together by EXEC. Commands refused while queueing, i.e.
+// unknown ones or with a wrong number of arguments, make EXEC abort
+// the transaction with an EXECABORT error.
+//
+// WATCH needs KeyVersion: EXEC runs nothing and replies a null array
+// if the version of a watched key changed since it was watched.
+type Transactions struct {
+	// Returns the version of a key in a database, which must change
+	// every time the key is modified, deleted or expires; provided by
+	// the storage
+	KeyVersion func(db int, key string) uint64
+
+	// Held while EXEC runs the queued commands
+	//
+	// By default it's a server-wide lock that every other command
+	// holds for reading, so transactions run in isolation. Storage
+	// with its own locking, like a lock on the keyspace, can provide
+	// it instead, and then other commands aren't locked.
+	//
+	// Commands flagged with FlagBlocking, like BLPOP, don't hold the
+	// default lock, as they could keep EXEC, and every command queued
+	// behind it, waiting for as long as they block. Their handlers
+	// aren't isolated from transactions unless the storage locks them.
+	Lock sync.Locker
+
+	mu sync.RWMutex
+}
+
+// The transaction of a client, kept in its values
+type txState struct {
+	multi   bool
+	exec    bool
+	dirty   bool
+	queued  []queuedCommand
+	watched map[watchedKey]uint64
+}
+
+type queuedCommand struct {
+	r    *route
+	name string
+	args [][]byte
+}
+
+type watchedKey struct {
+	db  int
+	key string
+}
+
+type txKey struct{}
+
+// Create the transaction support; set KeyVersion to support WATCH
+func NewTransactions() *Transactions {
+	return &Transactions{}
+}
+
+// Add the transaction commands to the server
+//
+// Like Use, Register must be called before Loop.
+func (tx *Transactions) Register(s *Server) {
+	s.Register(Command{
+		Name:    "MULTI",
+		Handler: tx.multi,
+		Arity:   1,
+		Flags:   FlagNoScript,
+		Help:    "Start a transaction",
+	})
+	s.Register(Command{
+		Name:    "EXEC",
+		Handler: tx.exec,
+		Arity:   1,
+		Flags:   FlagNoScript,
+		Help:    "Execute all commands issued after MULTI",
+	})
+	s.Register(Command{
+		Name:    "DISCARD",
+		Handler: tx.discard,
+		Arity:   1,
+		Flags:   FlagNoScript,
+		Help:    "Discard all commands issued after MULTI",
+	})
+	s.Register(Command{
+		Name:     "WATCH",
+		Handler:  tx.watch,
+		Arity:    -2,
+		Flags:    FlagNoScript,
+		FirstKey: 1,
+		LastKey:  -1,
+		KeyStep:  1,
+		Help:     "Watch keys to determine execution of the MULTI/EXEC block",
+	})
+	s.Register(Command{
+		Name:    "UNWATCH",
+		Handler: tx.unwatch,
+		Arity:   1,
+		Flags:   FlagNoScript,
+		Help:    "Forget about all watched keys",
+	})
+
+	s.Use(tx.queue)
+
+	s.onReject = append(s.onReject, func(c *Client) {
+		if st := tx.state(c); st.multi {
+			st.dirty = true
+		}
+	})
+}
+
+// Returns the transaction of c, creating it if needed
+func (tx *Transactions) state(c *Client) *txState {
+	st, ok := c.Value(txKey{}).(*txState)
+	if !ok {
+		st = &txState{}
+		c.SetValue(txKey{}, st)
+	}
+	return st
+}
+
+func (st *txState) reset() {
+	st.multi = false
+	st.dirty = false
+	st.queued = nil
+	st.watched = nil
+}
+
+// Middleware queueing commands inside a transaction, and holding the
+// server-wide lock for the rest, except blocking ones
+func (tx *Transactions) queue(next Handler) Handler {
+	return func(c *Client, args [][]byte) error {
+		cmd := c.Command()
+		st := tx.state(c)
+
+		switch {
+		case st.exec, multiCommands[cmd]:
+			return next(c, args)
+
+		case st.multi:
+			st.queued = append(st.queued, queuedCommand{c.server.routes[cmd], cmd, args})
+			_, err := c.Status("QUEUED")
+			return err
+		}
+
+		if r := c.server.routes[cmd]; tx.Lock == nil && (r == nil || r.cmd.Flags&FlagBlocking == 0) {
+			tx.mu.RLock()
+			defer tx.mu.RUnlock()
+		}
+
+		return next(c, args)
+	}
+}
+
+func (tx *Transactions) lock() {
+	if tx.Lock != nil {
+		tx.Lock.Lock()
+	} else {
+		tx.mu.Lock()
+	}
+}
+
+func (tx *Transactions) unlock() {
+	if tx.Lock != nil {
+		tx.Lock.Unlock()
+	} else {
+		tx.mu.Unlock()
+	}
+}
+
+func (tx *Transactions) multi(c *Client, args [][]byte) error {
+	st := tx.state(c)
+
+	if st.multi {
+		_, err := c.Errorf("MULTI calls can not be nested")
+		return err
+	}
+
+	st.multi = true
+
+	_, err := c.Status("OK")
+	return err
+}
+
+func (tx *Transactions) discard(c *Client, args [][]byte) error {
+	st := tx.state(c)
+
+	if !st.multi {
+		_, err := c.Errorf("DISCARD without MULTI")
+		return err
+	}
+
+	st.reset()
+
+	_, err := c.Status("OK")
+	return err
+}
+
+func (tx *Transactions) exec(c *Client, args [][]byte) error {
+	st := tx.state(c)
+
+	if !st.multi {
+		_, err := c.Errorf("EXEC without MULTI")
+		return err
+	}
+
+	queued, dirty, watched := st.queued, st.dirty, st.watched
+	st.reset()
+
+	if dirty {
+		_, err := c.Write([]byte("-EXECABORT Transaction discarded because of previous errors.\r\n"))
+		return err
+	}
+
+	tx.lock()
+	defer tx.unlock()
+
+	for k, version := range watched {
+		if tx.KeyVersion(k.db, k.key) != version {
+			return c.WriteNullArray()
+		}
+	}
+
+	st.exec = true
+	defer func() { st.exec = false }()
+
+	var res error
+
+	c.WriteArray(len(queued))
+	for _, q := range queued {
+		c.setCommand(q.name)
+		if err := q.r.handler(c, q.args); err != nil && res == nil {
+			res = err
+		}
+	}
+	c.setCommand("EXEC")
+
+	return res
+}
+
+func (tx *Transactions) watch(c *Client, args [][]byte) error {
+	st := tx.state(c)
+
+	if st.multi {
+		_, err := c.Errorf("WATCH inside MULTI is not allowed")
+		return err
+	}
+
+	if tx.KeyVersion == nil {
+		_, err := c.Errorf("WATCH is not supported by this server")
+		return err
+	}
+
+	if st.watched == nil {
+		st.watched = make(map[watchedKey]uint64)
+	}
+
+	db := c.DB()
+	for _, key := range args {
+		k := watchedKey{db, string(key)}
+		if _, ok := st.watched[k]; !ok {
+			st.watched[k] = tx.KeyVersion(db, k.key)
+		}
+	}
+
+	_, err := c.Status("OK")
+	return err
+}
+
+func (tx *Transactions) unwatch(c *Client, args [][]byte) error {
+	tx.state(c).watched = nil
+	_, err := c.Status("OK")
+	return err
+}
+
+// Returns whether c is queueing the commands of a transaction
+func (tx *Transactions) InMulti(c *Client) bool {
+	st, ok := c.Value(txKey{}).(*txState)
+	return ok && st.multi
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"github.com/inkel/gedis"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A key-value store with versioned keys
+type versionedStore struct {
+	mu       sync.Mutex
+	values   map[string]int64
+	versions map[string]uint64
+}
+
+func (vs *versionedStore) version(db int, key string) uint64 {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.versions[key]
+}
+
+// Increment a key, waiting before writing it back to make races
+// likely
+func (vs *versionedStore) incr(c *Client, args [][]byte) error {
+	key := string(args[0])
+
+	vs.mu.Lock()
+	n := vs.values[key] + 1
+	vs.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	vs.mu.Lock()
+	vs.values[key] = n
+	vs.versions[key]++
+	vs.mu.Unlock()
+
+	return c.WriteInt(n)
+}
+
+func multiServer(t *testing.T) (*Server, *versionedStore) {
+	vs := &versionedStore{values: make(map[string]int64), versions: make(map[string]uint64)}
+
+	s, _ := startServerWith(t, func(s *Server) {
+		tx := NewTransactions()
+		tx.KeyVersion = vs.version
+		tx.Register(s)
+
+		s.Register(Command{Name: "INCR", Handler: vs.incr, Arity: 2, Flags: FlagWrite})
+	})
+	t.Cleanup(func() { s.Close() })
+
+	return s, vs
+}
+
+func TestTransactions(t *testing.T) {
+	s, _ := multiServer(t)
+
+	c := connect(t, s)
+
+	if res := c.send("MULTI"); res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := c.send("INCR", "counter"); res != gedis.Status("QUEUED") {
+			t.Fatalf("Unexpected reply: %#v", res)
+		}
+	}
+	c.send("PING")
+
+	expectReply(t, c.send("EXEC"), int64(1), int64(2), gedis.Status("PONG"))
+
+	// Out of the transaction commands run right away
+	if res := c.send("INCR", "counter"); res != int64(3) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
+
+func TestTransactions_errors(t *testing.T) {
+	s, vs := multiServer(t)
+
+	c := connect(t, s)
+
+	tests := []struct {
+		cmd      []interface{}
+		expected interface{}
+	}{
+		{[]interface{}{"EXEC"}, gedis.Error("ERR EXEC without MULTI")},
+		{[]interface{}{"DISCARD"}, gedis.Error("ERR DISCARD without MULTI")},
+		{[]interface{}{"MULTI"}, gedis.Status("OK")},
+		{[]interface{}{"INCR", "counter"}, gedis.Status("QUEUED")},
+		{[]interface{}{"DISCARD"}, gedis.Status("OK")},
+		{[]interface{}{"MULTI"}, gedis.Status("OK")},
+		{[]interface{}{"INCR", "counter"}, gedis.Status("QUEUED")},
+		{[]interface{}{"INCR"}, gedis.Error("ERR wrong number of arguments for 'incr' command")},
+		{[]interface{}{"EXEC"}, gedis.Error("EXECABORT Transaction discarded because of previous errors.")},
+		{[]interface{}{"MULTI"}, gedis.Status("OK")},
+		{[]interface{}{"NOPE"}, gedis.Error("ERR Unrecognized command 'NOPE'")},
+		{[]interface{}{"EXEC"}, gedis.Error("EXECABORT Transaction discarded because of previous errors.")},
+	}
+
+	for _, tt := range tests {
+		if res := c.send(tt.cmd...); res != tt.expected {
+			t.Fatalf("%q: expected %#v, got %#v", tt.cmd, tt.expected, res)
+		}
+	}
+
+	if vs.values["counter"] != 0 {
+		t.Fatalf("No command should have run, got %d", vs.values["counter"])
+	}
+
+	// A nested MULTI or a WATCH inside MULTI is refused, but doesn't
+	// abort the transaction
+	tests = []struct {
+		cmd      []interface{}
+		expected interface{}
+	}{
+		{[]interface{}{"MULTI"}, gedis.Status("OK")},
+		{[]interface{}{"INCR", "counter"}, gedis.Status("QUEUED")},
+		{[]interface{}{"MULTI"}, gedis.Error("ERR MULTI calls can not be nested")},
+		{[]interface{}{"WATCH", "counter"}, gedis.Error("ERR WATCH inside MULTI is not allowed")},
+	}
+
+	for _, tt := range tests {
+		if res := c.send(tt.cmd...); res != tt.expected {
+			t.Fatalf("%q: expected %#v, got %#v", tt.cmd, tt.expected, res)
+		}
+	}
+
+	if res, ok := c.send("EXEC").([]interface{}); !ok || len(res) != 1 || res[0] != int64(1) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
+
+func TestTransactions_watch(t *testing.T) {
+	s, _ := multiServer(t)
+
+	a, b := connect(t, s), connect(t, s)
+
+	if res := a.send("WATCH", "counter"); res != gedis.Status("OK") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	a.send("MULTI")
+	a.send("INCR", "counter")
+
+	b.send("INCR", "counter")
+
+	if res := a.send("EXEC"); res != nil {
+		t.Fatalf("The transaction should be aborted, got %#v", res)
+	}
+
+	// EXEC unwatches every key
+	a.send("MULTI")
+	a.send("INCR", "counter")
+	b.send("INCR", "counter")
+	expectReply(t, a.send("EXEC"), int64(3))
+
+	// So does UNWATCH
+	a.send("WATCH", "counter")
+	a.send("UNWATCH")
+	b.send("INCR", "counter")
+	a.send("MULTI")
+	a.send("INCR", "counter")
+	expectReply(t, a.send("EXEC"), int64(5))
+
+	// Changes to other keys don't matter
+	a.send("WATCH", "other")
+	b.send("INCR", "counter")
+	a.send("MULTI")
+	if res, ok := a.send("EXEC").([]interface{}); !ok || len(res) != 0 {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
+
+func TestTransactions_isolation(t *testing.T) {
+	s, vs := multiServer(t)
+
+	a, b := connect(t, s), connect(t, s)
+
+	a.send("MULTI")
+	for i := 0; i < 20; i++ {
+		a.send("INCR", "counter")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			b.send("INCR", "counter")
+		}
+	}()
+
+	res, ok := a.send("EXEC").([]interface{})
+	if !ok || len(res) != 20 {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	// The transaction saw consecutive values
+	first := res[0].(int64)
+	for i, n := range res {
+		if n != first+int64(i) {
+			t.Fatalf("The transaction was interleaved: %v", res)
+		}
+	}
+
+	<-done
+
+	if vs.values["counter"] != 40 {
+		t.Fatalf("Expected 40, got %d", vs.values["counter"])
+	}
+}
+
+func TestTransactions_blocking(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	s, _ := startServerWith(t, func(s *Server) {
+		NewTransactions().Register(s)
+
+		s.Register(Command{
+			Name:  "BLOCK",
+			Arity: 1,
+			Flags: FlagBlocking,
+			Handler: func(c *Client, args [][]byte) error {
+				<-release
+				_, err := c.Status("OK")
+				return err
+			},
+		})
+	})
+	defer s.Close()
+
+	blocked, a, b := connect(t, s), connect(t, s), connect(t, s)
+
+	blocked.conn.Write([]byte("*1\r\n$5\r\nBLOCK\r\n"))
+	time.Sleep(20 * time.Millisecond)
+
+	// Neither EXEC nor the commands after it wait for BLOCK
+	done := make(chan interface{}, 1)
+	go func() {
+		a.send("MULTI")
+		a.send("PING")
+		done <- a.send("EXEC")
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	b.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if res := b.send("PING"); res != gedis.Status("PONG") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	select {
+	case res := <-done:
+		expectReply(t, res, gedis.Status("PONG"))
+	case <-time.After(time.Second):
+		t.Fatal("EXEC waited for BLOCK")
+	}
+}
+
+func TestTransactions_withoutKeyVersion(t *testing.T) {
+	s, _ := startServerWith(t, func(s *Server) {
+		NewTransactions().Register(s)
+	})
+	defer s.Close()
+
+	c := connect(t, s)
+
+	if _, ok := c.send("WATCH", "key").(gedis.Error); !ok {
+		t.Fatal("Expected an error")
+	}
+
+	c.send("MULTI")
+	c.send("PING")
+	expectReply(t, c.send("EXEC"), gedis.Status("PONG"))
+}
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"github.com/inkel/gedis"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Commands allowed to RESP2 clients with subscriptions
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// Publish/subscribe engine for a Server
+//
+// Register adds SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE, PUNSUBSCRIBE,
+// PUBLISH and PUBSUB to a server; Go code in the same process can
+// publish messages with Publish.
+//
+// Messages are queued for each subscriber and sent in the background,
+// so publishing never waits for the network. Subscribers that fall
+// QueueSize messages behind are disconnected.
+type PubSub struct {
+	// Maximum number of messages waiting to be sent to a subscriber,
+	// defaults to 1024
+	QueueSize int
+
+	mu          sync.RWMutex
+	channels    map[string]map[*subscriber]struct{}
+	patterns    map[string]map[*subscriber]struct{}
+	subscribers map[*Client]*subscriber
+}
+
+// The subscriptions of a client
+type subscriber struct {
+	c        *Client
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	queue    chan message
+}
+
+// A published message; pattern is set for pattern subscriptions
+type message struct {
+	pattern string
+	channel string
+	payload []byte
+}
+
+// Create a pub/sub engine
+func NewPubSub() *PubSub {
+	return &PubSub{
+		QueueSize:   1024,
+		channels:    make(map[string]map[*subscriber]struct{}),
+		patterns:    make(map[string]map[*subscriber]struct{}),
+		subscribers: make(map[*Client]*subscriber),
+	}
+}
+
+// Add the pub/sub commands to the server
+//
+// In RESP2 clients with subscriptions can only run the commands that
+// manage them, PING and QUIT, as in Redis. Like Use, Register must be
+// called before Loop.
+func (ps *PubSub) Register(s *Server) {
+	s.Register(Command{
+		Name:    "SUBSCRIBE",
+		Handler: ps.subscribe,
+		Arity:   -2,
+		Flags:   FlagPubSub | FlagNoScript,
+		Help:    "Listen for messages published to channels",
+	})
+	s.Register(Command{
+		Name:    "UNSUBSCRIBE",
+		Handler: ps.unsubscribe,
+		Arity:   -1,
+		Flags:   FlagPubSub | FlagNoScript,
+		Help:    "Stop listening for messages posted to channels",
+	})
+	s.Register(Command{
+		Name:    "PSUBSCRIBE",
+		Handler: ps.psubscribe,
+		Arity:   -2,
+		Flags:   FlagPubSub | FlagNoScript,
+		Help:    "Listen for messages published to channels matching patterns",
+	})
+	s.Register(Command{
+		Name:    "PUNSUBSCRIBE",
+		Handler: ps.punsubscribe,
+		Arity:   -1,
+		Flags:   FlagPubSub | FlagNoScript,
+		Help:    "Stop listening for messages posted to channels matching patterns",
+	})
+	s.Register(Command{
+		Name:    "PUBLISH",
+		Handler: ps.publish,
+		Arity:   3,
+		Flags:   FlagPubSub,
+		Help:    "Post a message to a channel",
+	})
+	s.Register(Command{
+		Name:    "PUBSUB",
+		Handler: ps.pubsub,
+		Arity:   -2,
+		Flags:   FlagPubSub,
+		Help:    "Inspect the state of the pub/sub subsystem",
+	})
+
+	s.Use(ps.restrict)
+}
+
+// Middleware restricting the commands of RESP2 clients in subscribed
+// mode
+func (ps *PubSub) restrict(next Handler) Handler {
+	return func(c *Client, args [][]byte) error {
+		cmd := c.Command()
+
+		if !subscribedCommands[cmd] && !c.resp3() && ps.count(c) > 0 {
+			_, err := c.Errorf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(cmd))
+			return err
+		}
+
+		return next(c, args)
+	}
+}
+
+// Post a message to a channel, returning the number of clients that
+// received it
+func (ps *PubSub) Publish(channel string, payload []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	n := 0
+
+	for sub := range ps.channels[channel] {
+		if sub.send(message{channel: channel, payload: payload}) {
+			n++
+		}
+	}
+
+	for pattern, subs := range ps.patterns {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			if sub.send(message{pattern: pattern, channel: channel, payload: payload}) {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// Queue a message, disconnecting the client if it's too far behind
+func (sub *subscriber) send(msg message) bool {
+	select {
+	case sub.queue <- msg:
+		return true
+	default:
+		sub.c.Close()
+		return false
+	}
+}
+
+// Send the queued messages to the client until it disconnects
+func (ps *PubSub) deliver(sub *subscriber) {
+	done := sub.c.Context().Done()
+
+	for {
+		select {
+		case <-done:
+			ps.remove(sub)
+			return
+		case msg := <-sub.queue:
+			if err := sub.c.push(msg.encode(sub.c.resp3())); err != nil {
+				sub.c.Close()
+			}
+		}
+	}
+}
+
+// Encode the message as a push for the client
+func (msg message) encode(resp3 bool) []byte {
+	kind := byte('*')
+	if resp3 {
+		kind = '>'
+	}
+
+	buf := []byte{kind}
+	if msg.pattern != "" {
+		buf = append(buf, "4\r\n"...)
+		buf, _ = gedis.AppendArg(buf, "pmessage")
+		buf, _ = gedis.AppendArg(buf, msg.pattern)
+	} else {
+		buf = append(buf, "3\r\n"...)
+		buf, _ = gedis.AppendArg(buf, "message")
+	}
+	buf, _ = gedis.AppendArg(buf, msg.channel)
+	buf, _ = gedis.AppendArg(buf, msg.payload)
+
+	return buf
+}
+
+// Returns the subscriptions of c, creating them if needed; must be
+// called with the lock held
+func (ps *PubSub) subscriber(c *Client) *subscriber {
+	sub, ok := ps.subscribers[c]
+	if !ok {
+		sub = &subscriber{
+			c:        c,
+			channels: make(map[string]struct{}),
+			patterns: make(map[string]struct{}),
+			queue:    make(chan message, ps.QueueSize),
+		}
+		ps.subscribers[c] = sub
+		go ps.deliver(sub)
+	}
+	return sub
+}
+
+// Remove every subscription of a disconnected client
+func (ps *PubSub) remove(sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for channel := range sub.channels {
+		unindex(ps.channels, channel, sub)
+	}
+	for pattern := range sub.patterns {
+		unindex(ps.patterns, pattern, sub)
+	}
+
+	delete(ps.subscribers, sub.c)
+}
+
+func unindex(index map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	delete(index[name], sub)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+// Returns the number of subscriptions of c
+func (ps *PubSub) count(c *Client) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	if sub, ok := ps.subscribers[c]; ok {
+		return len(sub.channels) + len(sub.patterns)
+	}
+	return 0
+}
+
+// Write a subscription confirmation, like ["subscribe", "news", 1]
+func confirm(c *Client, kind string, name []byte, count int) error {
+	c.WritePush(3)
+	c.WriteBulkString(kind)
+	if name == nil {
+		c.WriteNull()
+	} else {
+		c.WriteBulk(name)
+	}
+	return c.WriteInt(int64(count))
+}
+
+func (ps *PubSub) subscribe(c *Client, args [][]byte) error {
+	return ps.add(c, args, false)
+}
+
+func (ps *PubSub) psubscribe(c *Client, args [][]byte) error {
+	return ps.add(c, args, true)
+}
+
+func (ps *PubSub) unsubscribe(c *Client, args [][]byte) error {
+	return ps.del(c, args, false)
+}
+
+func (ps *PubSub) punsubscribe(c *Client, args [][]byte) error {
+	return ps.del(c, args, true)
+}
+
+func (ps *PubSub) add(c *Client, names [][]byte, patterns bool) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	sub := ps.subscriber(c)
+
+	kind, index, subs := "subscribe", ps.channels, sub.channels
+	if patterns {
+		kind, index, subs = "psubscribe", ps.patterns, sub.patterns
+	}
+
+	var err error
+
+	for _, name := range names {
+		key := string(name)
+
+		if _, ok := subs[key]; !ok {
+			subs[key] = struct{}{}
+			if index[key] == nil {
+				index[key] = make(map[*subscriber]struct{})
+			}
+			index[key][sub] = struct{}{}
+		}
+
+		err = confirm(c, kind, name, len(sub.channels)+len(sub.patterns))
+	}
+
+	c.setSubscriptions(len(sub.channels) + len(sub.patterns))
+
+	return err
+}
+
+func (ps *PubSub) del(c *Client, names [][]byte, patterns bool) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind := "unsubscribe"
+	if patterns {
+		kind = "punsubscribe"
+	}
+
+	sub, ok := ps.subscribers[c]
+	if !ok {
+		sub = &subscriber{}
+	}
+
+	index, subs := ps.channels, sub.channels
+	if patterns {
+		index, subs = ps.patterns, sub.patterns
+	}
+
+	// Without names, unsubscribe from everything
+	if len(names) == 0 {
+		for name := range subs {
+			names = append(names, []byte(name))
+		}
+		sort.Slice(names, func(i, j int) bool { return string(names[i]) < string(names[j]) })
+	}
+
+	if len(names) == 0 {
+		return confirm(c, kind, nil, len(sub.channels)+len(sub.patterns))
+	}
+
+	var err error
+
+	for _, name := range names {
+		key := string(name)
+
+		if _, ok := subs[key]; ok {
+			delete(subs, key)
+			unindex(index, key, sub)
+		}
+
+		err = confirm(c, kind, name, len(sub.channels)+len(sub.patterns))
+	}
+
+	c.setSubscriptions(len(sub.channels) + len(sub.patterns))
+
+	return err
+}
+
+func (ps *PubSub) publish(c *Client, args [][]byte) error {
+	return c.WriteInt(int64(ps.Publish(string(args[0]), args[1])))
+}
+
+// Returns the channels with subscribers, optionally only those
+// matching a glob-style pattern, sorted
+func (ps *PubSub) Channels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	channels := []string{}
+	for channel := range ps.channels {
+		if pattern == "" || matchGlob(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+
+	return channels
+}
+
+// Returns the number of subscribers of a channel, not counting pattern
+// subscriptions
+func (ps *PubSub) NumSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.channels[channel])
+}
+
+// Returns the number of patterns with subscribers
+func (ps *PubSub) NumPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.patterns)
+}
+
+// PUBSUB CHANNELS [pattern], NUMSUB [channel ...] and NUMPAT
+func (ps *PubSub) pubsub(c *Client, args [][]byte) error {
+	sub := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch {
+	case sub == "CHANNELS" && len(args) <= 1:
+		pattern := ""
+		if len(args) == 1 {
+			pattern = string(args[0])
+		}
+
+		channels := ps.Channels(pattern)
+		c.WriteArray(len(channels))
+		for _, channel := range channels {
+			c.WriteBulkString(channel)
+		}
+		return nil
+
+	case sub == "NUMSUB":
+		c.WriteMap(len(args))
+		for _, channel := range args {
+			c.WriteBulk(channel)
+			c.WriteInt(int64(ps.NumSub(string(channel))))
+		}
+		return nil
+
+	case sub == "NUMPAT" && len(args) == 0:
+		return c.WriteInt(int64(ps.NumPat()))
+	}
+
+	_, err := c.Errorf("unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", strings.ToLower(sub))
+	return err
+}
+
+// Whether s matches a glob-style pattern, as in Redis: * matches any
+// sequence, ? any character, [...] a set of characters, with ^ to
+// negate it and - for ranges, and \ escapes the next character
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+
+			i := 1
+			not := i < len(pattern) && pattern[i] == '^'
+			if not {
+				i++
+			}
+
+			match := false
+			for ; i < len(pattern) && pattern[i] != ']'; i++ {
+				switch {
+				case pattern[i] == '\\' && i+1 < len(pattern):
+					i++
+					match = match || pattern[i] == s[0]
+				case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+					lo, hi := pattern[i], pattern[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (s[0] >= lo && s[0] <= hi)
+					i += 2
+				default:
+					match = match || pattern[i] == s[0]
+				}
+			}
+
+			if match == not {
+				return false
+			}
+
+			s = s[1:]
+			if i < len(pattern) {
+				i++
+			}
+			pattern = pattern[i:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+
+	return len(s) == 0
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"github.com/inkel/gedis"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"news", "news", true},
+		{"news", "new", false},
+		{"news.*", "news.tech", true},
+		{"news.*", "news.", true},
+		{"news.*", "sport.tech", false},
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+	}
+
+	for _, tt := range tests {
+		if matchGlob(tt.pattern, tt.s) != tt.match {
+			t.Errorf("matchGlob(%q, %q) should be %v", tt.pattern, tt.s, tt.match)
+		}
+	}
+}
+
+func pubsubServer(t *testing.T) (*Server, *PubSub) {
+	ps := NewPubSub()
+
+	s, _ := startServerWith(t, func(s *Server) {
+		ps.Register(s)
+	})
+	t.Cleanup(func() { s.Close() })
+
+	return s, ps
+}
+
+func expectReply(t *testing.T, res interface{}, expected ...interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected %#v, got %#v", expected, res)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	s, _ := pubsubServer(t)
+
+	sub, pub := connect(t, s), connect(t, s)
+
+	expectReply(t, sub.send("SUBSCRIBE", "news", "sport"), "subscribe", "news", int64(1))
+	expectReply(t, sub.read(), "subscribe", "sport", int64(2))
+
+	expectReply(t, sub.send("PSUBSCRIBE", "news.*"), "psubscribe", "news.*", int64(3))
+
+	if res := pub.send("PUBLISH", "news", "lorem"); res != int64(1) {
+		t.Fatalf("Unexpected receivers: %#v", res)
+	}
+	expectReply(t, sub.read(), "message", "news", "lorem")
+
+	if res := pub.send("PUBLISH", "news.tech", "ipsum"); res != int64(1) {
+		t.Fatalf("Unexpected receivers: %#v", res)
+	}
+	expectReply(t, sub.read(), "pmessage", "news.*", "news.tech", "ipsum")
+
+	if res := pub.send("PUBLISH", "weather", "sunny"); res != int64(0) {
+		t.Fatalf("Unexpected receivers: %#v", res)
+	}
+
+	expectReply(t, pub.send("PUBSUB", "CHANNELS"), "news", "sport")
+	expectReply(t, pub.send("PUBSUB", "CHANNELS", "s*"), "sport")
+	expectReply(t, pub.send("PUBSUB", "NUMSUB", "news", "weather"), "news", int64(1), "weather", int64(0))
+	if res := pub.send("PUBSUB", "NUMPAT"); res != int64(1) {
+		t.Fatalf("Unexpected patterns: %#v", res)
+	}
+
+	// Unsubscribe from every channel, keeping the pattern
+	expectReply(t, sub.send("UNSUBSCRIBE"), "unsubscribe", "news", int64(2))
+	expectReply(t, sub.read(), "unsubscribe", "sport", int64(1))
+
+	expectReply(t, sub.send("PUNSUBSCRIBE", "news.*"), "punsubscribe", "news.*", int64(0))
+	expectReply(t, sub.send("PUNSUBSCRIBE"), "punsubscribe", nil, int64(0))
+
+	if res := pub.send("PUBLISH", "news", "lorem"); res != int64(0) {
+		t.Fatalf("Unexpected receivers: %#v", res)
+	}
+}
+
+func TestPubSub_subscribedMode(t *testing.T) {
+	s, _ := pubsubServer(t)
+
+	c := connect(t, s)
+	c.send("SUBSCRIBE", "news")
+
+	err, ok := c.send("PUBLISH", "news", "lorem").(gedis.Error)
+	if !ok || string(err) != "ERR Can't execute 'publish': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context" {
+		t.Fatalf("Unexpected reply: %#v", err)
+	}
+
+	if res := c.send("PING"); res != gedis.Status("PONG") {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	c.send("UNSUBSCRIBE")
+
+	if res := c.send("PUBLISH", "news", "lorem"); res != int64(0) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+}
+
+func TestPubSub_resp3(t *testing.T) {
+	s, ps := pubsubServer(t)
+
+	c := connect(t, s)
+
+	// Skip the reply to HELLO, up to the empty list of modules
+	c.conn.Write([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"))
+	for line := ""; line != "*0\r\n"; {
+		var err error
+		if line, err = c.r.ReadString('\n'); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	c.conn.Write([]byte("*2\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n"))
+	if line, _ := c.r.ReadString('\n'); line != ">3\r\n" {
+		t.Fatalf("Expected a push, got %q", line)
+	}
+	expectReply(t, []interface{}{c.read(), c.read(), c.read()}, "subscribe", "news", int64(1))
+
+	// Any command can be run while subscribed
+	if res := c.send("PUBLISH", "news", "lorem"); res != int64(1) {
+		t.Fatalf("Unexpected reply: %#v", res)
+	}
+
+	if line, _ := c.r.ReadString('\n'); line != ">3\r\n" {
+		t.Fatalf("Expected a push, got %q", line)
+	}
+	expectReply(t, []interface{}{c.read(), c.read(), c.read()}, "message", "news", "lorem")
+
+	// Publishing from Go
+	if n := ps.Publish("news", []byte("ipsum")); n != 1 {
+		t.Fatalf("Unexpected receivers: %d", n)
+	}
+
+	c.r.ReadString('\n')
+	expectReply(t, []interface{}{c.read(), c.read(), c.read()}, "message", "news", "ipsum")
+}
+
+func TestPubSub_disconnect(t *testing.T) {
+	s, ps := pubsubServer(t)
+
+	c := connect(t, s)
+	c.send("SUBSCRIBE", "news")
+	c.conn.Close()
+
+	for i := 0; ps.NumSub("news") > 0; i++ {
+		if i == 100 {
+			t.Fatal("The subscriptions of the client weren't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPubSub_idleTimeout(t *testing.T) {
+	ps := NewPubSub()
+
+	s, _ := startServerWith(t, func(s *Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+		ps.Register(s)
+	})
+	defer s.Close()
+
+	c := connect(t, s)
+	c.send("SUBSCRIBE", "news")
+
+	// Subscribers wait for messages for as long as they want
+	time.Sleep(200 * time.Millisecond)
+
+	if n := ps.Publish("news", []byte("lorem")); n != 1 {
+		t.Fatalf("Unexpected receivers: %d", n)
+	}
+	expectReply(t, c.read(), "message", "news", "lorem")
+
+	// Until they unsubscribe
+	c.send("UNSUBSCRIBE")
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Fatal("The connection should be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("The idle client wasn't disconnected")
+	}
+}
+
+func TestPubSub_slowSubscriber(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := newClient(nil, a)
+	sub := &subscriber{c: c, queue: make(chan message, 1)}
+
+	if !sub.send(message{channel: "news"}) {
+		t.Fatal("The message should be queued")
+	}
+
+	if sub.send(message{channel: "news"}) {
+		t.Fatal("The queue should be full")
+	}
+
+	if c.Context().Err() == nil {
+		t.Fatal("The slow subscriber should be disconnected")
+	}
+}
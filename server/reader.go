@@ -1,6 +1,16 @@
 package server
 
-import "github.com/inkel/gedis"
+import (
+	"github.com/inkel/gedis"
+	"io"
+)
+
+// Limits of the requests of clients, as in Redis: the number of
+// arguments of a command, and the size of each one
+const (
+	maxMultiBulkLength = 1024 * 1024
+	maxBulkLength      = 512 * 1024 * 1024
+)
 
 // Read a bulk as defined in the Redis protocol
 //
@@ -23,16 +33,22 @@ func readBulk(r gedis.Reader) (bs []byte, err error) {
 		return bs, err
 	}
 
+	if n < 0 || n > maxBulkLength {
+		return bs, gedis.NewParseError("Protocol error: invalid bulk length")
+	}
+
 	bs = make([]byte, n)
 
-	_, err = r.Read(bs)
+	// A single Read might return less bytes than requested when
+	// reading from a buffer or a network connection
+	_, err = io.ReadFull(r, bs)
 	if err != nil {
 		return bs, err
 	}
 
 	crlf := make([]byte, 2)
 
-	if _, err = r.Read(crlf); err != nil {
+	if _, err = io.ReadFull(r, crlf); err != nil {
 		return bs, err
 	}
 
@@ -59,6 +75,9 @@ func readByte(r gedis.Reader) (byte, error) {
 //
 // In truth they can also send an inline request, however that is
 // currently not covered by this implementation.
+//
+// Requests without arguments, or with more arguments or bigger ones
+// than Redis accepts, are a protocol error.
 func Read(r gedis.Reader) (res [][]byte, err error) {
 	var b byte
 
@@ -75,6 +94,10 @@ func Read(r gedis.Reader) (res [][]byte, err error) {
 			return res, err
 		}
 
+		if n < 1 || n > maxMultiBulkLength {
+			return res, gedis.NewParseError("Protocol error: invalid multibulk length")
+		}
+
 		res = make([][]byte, n)
 
 		for i := int64(0); i < n; i++ {
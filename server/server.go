@@ -34,10 +34,12 @@ that only responds to the PING command:
     package main
 
     import (
+    	"context"
     	"fmt"
     	gedis "github.com/inkel/gedis/server"
     	"os"
     	"os/signal"
+    	"time"
     )
 
     func main() {
@@ -48,7 +50,6 @@ that only responds to the PING command:
     	if err != nil {
     		panic(err)
     	}
-    	defer s.Close()
 
     	pong := []byte("+PONG\r\n")
     	earg := []byte("-ERR wrong number of arguments for 'ping' command\r\n")
@@ -68,85 +69,343 @@ that only responds to the PING command:
 
     	<-c
 
+    	// Let running commands finish
+    	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    	defer cancel()
+
+    	if err = s.Shutdown(ctx); err != nil {
+    		s.Close()
+    	}
+
     	fmt.Println("Bye!")
     }
 */
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Returned by Loop after the server is closed or shut down
+var ErrServerClosed = errors.New("server: Server closed")
+
+// Returned by the write methods of Client when the replies waiting to
+// be sent exceed the limits of the server; the client is disconnected
+var ErrOutputBufferLimit = errors.New("server: output buffer limit reached")
+
+// How often Shutdown checks whether every client is done
+const shutdownPollInterval = 10 * time.Millisecond
+
 // Signature that command handler functions must have
 type Handler func(c *Client, args [][]byte) error
 
+// Limits the size of the replies waiting to be sent to a client, like
+// the client-output-buffer-limit setting of Redis
+//
+// A client is disconnected as soon as its replies exceed Hard bytes,
+// or when they exceed Soft bytes for longer than SoftDuration. Zero
+// disables a limit. Replies count until they're sent, so a client that
+// doesn't read them fast enough is disconnected too.
+type OutputBufferLimit struct {
+	Hard         int
+	Soft         int
+	SoftDuration time.Duration
+}
+
 // Structure to hold the necessary information to run a generic Redis
 // server
+//
+// The limits must be set before calling Loop.
 type Server struct {
-	ln       net.Listener
-	handlers map[string]Handler
+	ln         net.Listener
+	routes     map[string]*route
+	middleware []Middleware
+
+	// Maximum number of connected clients; zero means no limit
+	MaxClients int
+	// Disconnect clients that don't send a command for this long,
+	// unless they have pub/sub subscriptions; zero disables it
+	IdleTimeout time.Duration
+	// Maximum time to read a command once it starts to arrive
+	ReadTimeout time.Duration
+	// Maximum time to send replies to a client
+	WriteTimeout time.Duration
+
+	OutputBufferLimit OutputBufferLimit
+
+	mu       sync.Mutex
+	clients  map[*Client]struct{}
+	shutdown bool
+
+	// Set by CLIENT PAUSE; unpaused is closed by CLIENT UNPAUSE
+	pauseUntil time.Time
+	pauseAll   bool
+	unpaused   chan struct{}
+
+	// Called when a command is refused before reaching its handler
+	onReject []func(c *Client)
 }
 
 // Returns a new Server that listen in the specified network address
-func NewServer(network, address string) (s Server, err error) {
-	s.handlers = make(map[string]Handler)
-	s.ln, err = net.Listen(network, address)
-	return
+//
+// The server handles HELLO, to let clients switch to RESP3, and
+// COMMAND; use Register to override them. Handlers are wrapped with the
+// Recover middleware.
+func NewServer(network, address string) (*Server, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:         ln,
+		routes:     make(map[string]*route),
+		middleware: []Middleware{Recover},
+		clients:    make(map[*Client]struct{}),
+		unpaused:   make(chan struct{}),
+	}
+
+	s.Register(Command{
+		Name:    "HELLO",
+		Handler: Hello,
+		Arity:   -1,
+		Flags:   FlagNoScript,
+		Help:    "Handshake with the server, optionally switching the protocol",
+	})
+
+	s.Register(Command{
+		Name:    "COMMAND",
+		Handler: s.commandInfo,
+		Arity:   -1,
+		Help:    "Return information about the commands of the server",
+	})
+
+	return s, nil
+}
+
+// Returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
 }
 
 // Closes a Redis server and stop processing
+//
+// The connections of all clients are closed immediately, even if they
+// are running a command. Use Shutdown to let them finish.
 func (s *Server) Close() error {
+	s.mu.Lock()
+	s.shutdown = true
+	for c := range s.clients {
+		c.Close()
+	}
+	s.mu.Unlock()
+
 	return s.ln.Close()
 }
 
+// Gracefully shut down the server
+//
+// Shutdown stops accepting new connections, closes the connections of
+// idle clients, and waits for the rest to finish the command they are
+// running before closing them. If ctx is done before every client is
+// done, Shutdown returns ctx.Err() and the remaining clients are left
+// running; call Close to stop them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+
+	for {
+		if s.closeIdle() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Close the connections of the clients that aren't running a
+// command, returning whether there are no clients left
+func (s *Server) closeIdle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		if !c.active {
+			c.Close()
+		}
+	}
+
+	return len(s.clients) == 0
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// Mark a client as running a command or idle, returning false if the
+// server is shutting down and the client must be disconnected
+func (s *Server) setActive(c *Client, active bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+
+	c.active = active
+
+	return true
+}
+
 // Add a command handler
 //
+// The handler is wrapped with the middleware given, and then with the
+// middleware added to the server with Use. It's a shortcut to Register
+// a command without arity, flags or keys.
+//
 // Note that this function does not validate that the command is a
 // valid Redis command, nor that the command hasn't already a handler.
-func (s *Server) Handle(cmd string, handler Handler) {
-	cmd = strings.ToUpper(cmd)
-	s.handlers[cmd] = handler
+func (s *Server) Handle(cmd string, handler Handler, middleware ...Middleware) {
+	s.Register(Command{Name: cmd, Handler: handler}, middleware...)
 }
 
 // Goroutine to process data from a Client
 func (s *Server) process(c *Client) {
-	defer c.Close()
+	defer func() {
+		// Let the last replies go out, like the reply to QUIT
+		c.drain()
+		c.Close()
+
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
 
 	for {
-		in, err := c.Read()
+		in, err := c.readCommand()
 		if err != nil {
-			if err != io.EOF {
+			// Reply to protocol errors, not to network errors like
+			// timeouts
+			if _, ok := err.(net.Error); !ok && err != io.EOF && !s.shuttingDown() {
 				c.Error(err)
 			}
 			return
 		}
 
+		// Commands that arrive while shutting down are dropped
+		if !s.setActive(c, true) {
+			return
+		}
+
 		cmd := strings.ToUpper(string(in[0]))
 
-		if fn := s.handlers[cmd]; fn != nil {
-			err = fn(c, in[1:])
+		c.startCommand(cmd)
+
+		if r := s.routes[cmd]; r == nil {
+			c.Errorf("Unrecognized command '%s'", in[0])
+			s.rejected(c)
+		} else if !r.cmd.validArity(len(in)) {
+			c.Errorf("wrong number of arguments for '%s' command", strings.ToLower(cmd))
+			s.rejected(c)
+		} else {
+			s.waitPause(&r.cmd)
 
-			if err != nil {
+			if err = r.handler(c, in[1:]); err != nil && err != ErrOutputBufferLimit {
 				fmt.Printf("Unexpected error while processing connection: %v\n", err)
 			}
-		} else {
-			c.Errorf("Unrecognized command '%s'", in[0])
+		}
+
+		c.endCommand()
+
+		if err = c.stopBuffering(); err != nil || c.closing() {
+			return
+		}
+
+		if !s.setActive(c, false) {
+			return
 		}
 	}
 }
 
+// Notify that the command of c was refused before running it
+func (s *Server) rejected(c *Client) {
+	for _, fn := range s.onReject {
+		fn(c)
+	}
+}
+
 // Main event loop for Redis clients
-func (s *Server) Loop() {
+//
+// Loop always returns an error: ErrServerClosed after Close or
+// Shutdown, or the error that stopped it from accepting connections.
+// Temporary errors are retried with an increasing delay.
+func (s *Server) Loop() error {
+	var delay time.Duration
+
 	for {
-		c, err := s.ln.Accept()
+		conn, err := s.ln.Accept()
 		if err != nil {
-			fmt.Printf("Error while accepting a connection: %v\n", err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				fmt.Printf("Error while accepting a connection: %v; retrying in %v\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			return err
+		}
+
+		delay = 0
+
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		if s.MaxClients > 0 && len(s.clients) >= s.MaxClients {
+			s.mu.Unlock()
+			go s.reject(conn)
 			continue
 		}
-		client := &Client{s, &c}
+		client := newClient(s, conn)
+		s.clients[client] = struct{}{}
+		s.mu.Unlock()
+
 		go s.process(client)
 	}
 }
+
+// Tell a client that connected over the limit and disconnect it
+func (s *Server) reject(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("-ERR max number of clients reached\r\n"))
+	conn.Close()
+}
@@ -1,10 +1,18 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"github.com/inkel/gedis"
+	"net"
 	"path"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func fail_Read(t *testing.T, input string) {
@@ -36,6 +44,11 @@ func TestRead_errors(t *testing.T) {
 	// fail_Read(t, "*1\r\n$5\r\nlorem\r\n$-1\r\n")
 	fail_Read(t, "*2\r\n$5\r\nlorem\r\n:1234\r\n")
 	// fail_Read(t, "*1\r\n$5\r\nlorem\r\n$5\r\nipsum\r\n")
+	fail_Read(t, "*0\r\n")
+	fail_Read(t, "*-2\r\n")
+	fail_Read(t, "*2000000\r\n")
+	fail_Read(t, "*1\r\n$-2\r\n")
+	fail_Read(t, "*1\r\n$1000000000\r\n")
 }
 
 func pass_Read(t *testing.T, input string, expected ...[]byte) {
@@ -56,7 +69,7 @@ func pass_Read(t *testing.T, input string, expected ...[]byte) {
 
 	for i, exp := range expected {
 		if !bytes.Equal(exp, res[i]) {
-			t.Fatal("\r\t%s:%d: at index %d\nexpected %#v\ngot      %#v", file, ln, i, exp, res[i])
+			t.Fatalf("\r\t%s:%d: at index %d\nexpected %#v\ngot      %#v", file, ln, i, exp, res[i])
 		}
 	}
 }
@@ -95,3 +108,364 @@ func Benchmark_Read(b *testing.B) {
 		Read(reader)
 	}
 }
+
+func startServer(t *testing.T) (*Server, chan error) {
+	return startServerWith(t, func(s *Server) {})
+}
+
+// Start a server after setting it up with setup
+func startServerWith(t *testing.T, setup func(s *Server)) (*Server, chan error) {
+	s, err := NewServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start server: %v", err)
+	}
+
+	setup(s)
+
+	s.Handle("PING", func(c *Client, args [][]byte) error {
+		_, err := c.Status("PONG")
+		return err
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Loop()
+	}()
+
+	return s, done
+}
+
+func dial(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// A connection that sends commands and reads their replies
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    interface {
+		ReadString(byte) (string, error)
+		gedis.Reader
+	}
+}
+
+func connect(t *testing.T, s *Server) *testConn {
+	conn, r := dial(t, s)
+	return &testConn{t, conn, r}
+}
+
+func (tc *testConn) send(args ...interface{}) interface{} {
+	tc.t.Helper()
+
+	bs, _ := gedis.EncodeCommand(args...)
+	if _, err := tc.conn.Write(bs); err != nil {
+		tc.t.Fatalf("Unexpected error: %v", err)
+	}
+
+	res, err := gedis.Read(tc.r)
+	if err != nil {
+		return err
+	}
+	return res
+}
+
+// Read a reply, failing after a second
+func (tc *testConn) read() interface{} {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer tc.conn.SetReadDeadline(time.Time{})
+
+	res, err := gedis.Read(tc.r)
+	if err != nil {
+		if _, ok := err.(gedis.Error); !ok {
+			tc.t.Fatalf("Unexpected error: %v", err)
+		}
+		return err
+	}
+	return res
+}
+
+func command(conn net.Conn, r *bufio.Reader, cmd string) (string, error) {
+	if _, err := conn.Write([]byte("*1\r\n$" + strconv.Itoa(len(cmd)) + "\r\n" + cmd + "\r\n")); err != nil {
+		return "", err
+	}
+	return r.ReadString('\n')
+}
+
+func loopReturns(t *testing.T, done chan error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Fatalf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Loop didn't return")
+	}
+}
+
+func TestServer_protocolError(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	for _, req := range []string{"*0\r\n", "*-2\r\n", "*1\r\n$-2\r\n"} {
+		conn, r := dial(t, s)
+
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if res, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(res, "-ERR Protocol error") {
+			t.Fatalf("%q: unexpected %q, %v", req, res, err)
+		}
+
+		// The server is still up
+		conn, r = dial(t, s)
+		if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+			t.Fatalf("%q: unexpected %q, %v", req, res, err)
+		}
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	s, done := startServer(t)
+	conn, r := dial(t, s)
+
+	if res, err := command(conn, r, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	loopReturns(t, done)
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("The connection should be closed")
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s, done := startServer(t)
+
+	started := make(chan struct{})
+	s.Handle("SLOW", func(c *Client, args [][]byte) error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, err := c.Status("OK")
+		return err
+	})
+
+	busy, busyR := dial(t, s)
+	idle, idleR := dial(t, s)
+
+	if res, err := command(idle, idleR, "PING"); err != nil || res != "+PONG\r\n" {
+		t.Fatalf("Unexpected %q, %v", res, err)
+	}
+
+	reply := make(chan string, 1)
+	go func() {
+		res, _ := command(busy, busyR, "SLOW")
+		reply <- res
+	}()
+
+	<-started
+
+	start := time.Now()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Shutdown didn't wait for the running command")
+	}
+
+	if res := <-reply; res != "+OK\r\n" {
+		t.Fatalf("The running command didn't finish: %q", res)
+	}
+
+	if _, err := idleR.ReadString('\n'); err == nil {
+		t.Fatal("The idle connection should be closed")
+	}
+
+	loopReturns(t, done)
+
+	if _, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		t.Fatal("The server should not accept connections")
+	}
+}
+
+func TestServer_Shutdown_timeout(t *testing.T) {
+	s, done := startServer(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.Handle("BLOCK", func(c *Client, args [][]byte) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	conn, r := dial(t, s)
+	go command(conn, r, "BLOCK")
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	close(release)
+	s.Close()
+
+	loopReturns(t, done)
+}
+
+func TestServer_Shutdown_load(t *testing.T) {
+	s, done := startServer(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	replies := 0
+
+	for i := 0; i < 20; i++ {
+		conn, r := dial(t, s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				res, err := command(conn, r, "PING")
+				if err != nil {
+					return
+				}
+				if res != "+PONG\r\n" {
+					t.Errorf("Unexpected reply: %q", res)
+					return
+				}
+				mu.Lock()
+				replies++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Every client is disconnected
+	wg.Wait()
+
+	loopReturns(t, done)
+
+	if replies == 0 {
+		t.Fatal("No commands were processed")
+	}
+}
+
+// A connection that reads from a buffer and counts its writes
+type countingConn struct {
+	net.Conn
+	in     *bytes.Reader
+	out    bytes.Buffer
+	writes int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.out.Write(b)
+}
+
+func (c *countingConn) Close() error {
+	return nil
+}
+
+func TestServer_pipelining(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Close()
+
+	ping := "*1\r\n$4\r\nPING\r\n"
+
+	var conn net.Conn = &countingConn{in: bytes.NewReader([]byte(strings.Repeat(ping, 100)))}
+	cc := conn.(*countingConn)
+
+	s.process(newClient(s, conn))
+
+	if cc.out.String() != strings.Repeat("+PONG\r\n", 100) {
+		t.Fatalf("Unexpected replies: %q", cc.out.String())
+	}
+
+	if cc.writes != 1 {
+		t.Fatalf("Expected the replies to be written at once, got %d writes", cc.writes)
+	}
+}
+
+func benchmarkPing(b *testing.B, pipeline int) {
+	s, err := NewServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Cannot start server: %v", err)
+	}
+	defer s.Close()
+
+	pong := []byte("+PONG\r\n")
+	s.Handle("PING", func(c *Client, args [][]byte) error {
+		_, err := c.Write(pong)
+		return err
+	})
+
+	go s.Loop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		b.Fatalf("Cannot dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	batch := []byte(strings.Repeat("*1\r\n$4\r\nPING\r\n", pipeline))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += pipeline {
+		if _, err = conn.Write(batch); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+		for j := 0; j < pipeline; j++ {
+			if _, err = r.ReadString('\n'); err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+// Equivalent to redis-benchmark -t PING_MBULK
+func BenchmarkServer_ping(b *testing.B) {
+	benchmarkPing(b, 1)
+}
+
+// Equivalent to redis-benchmark -t PING_MBULK -P 16
+func BenchmarkServer_pingPipelined(b *testing.B) {
+	benchmarkPing(b, 16)
+}
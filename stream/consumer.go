@@ -0,0 +1,396 @@
+/*
+Copyright (c) 2013 Leandro López
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+/*
+gedis stream - Redis Streams consumer groups
+
+This package processes the entries of a Redis stream as a member of a
+consumer group, taking care of the XREADGROUP, XACK and XAUTOCLAIM
+dance.
+
+Redis streams: http://redis.io/topics/streams-intro
+
+Example
+
+    package main
+
+    import (
+    	"context"
+    	"fmt"
+    	"github.com/inkel/gedis/client"
+    	"github.com/inkel/gedis/stream"
+    )
+
+    func main() {
+    	c, err := client.Dial("tcp", "localhost:6379")
+    	if err != nil {
+    		panic(err)
+    	}
+    	defer c.Close()
+
+    	consumer := &stream.Consumer{
+    		Stream:      "jobs",
+    		Group:       "workers",
+    		Name:        "worker-1",
+    		Concurrency: 4,
+    		Handler: func(ctx context.Context, msg client.XMessage) error {
+    			fmt.Println(msg.ID, msg.Values)
+    			return nil
+    		},
+    	}
+
+    	panic(consumer.Run(context.Background(), &c))
+    }
+*/
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis"
+	"github.com/inkel/gedis/client"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature that entry handler functions must have
+//
+// Entries are acknowledged when the handler returns nil. Otherwise
+// they stay pending and are delivered again once reclaimed.
+type Handler func(ctx context.Context, msg client.XMessage) error
+
+// A member of a consumer group
+//
+// Only Stream, Group, Name and Handler are required; the other fields
+// have sensible defaults.
+type Consumer struct {
+	Stream  string
+	Group   string
+	Name    string
+	Handler Handler
+
+	// Number of entries handled at the same time, defaults to 1
+	Concurrency int
+	// Maximum number of entries read at once, defaults to 10
+	Count int
+	// How long to wait for new entries, defaults to 5 seconds
+	Block time.Duration
+
+	// Entries pending for longer than MinIdle, i.e. because their
+	// consumer died, are claimed by this consumer; defaults to 1
+	// minute
+	MinIdle time.Duration
+
+	// Entries delivered this many times are moved to the DeadLetter
+	// stream instead of being handled again; zero disables it
+	MaxDeliveries int64
+	// Defaults to the name of the stream followed by ":dead"
+	DeadLetter string
+}
+
+func (c *Consumer) defaults() error {
+	if c.Stream == "" || c.Group == "" || c.Name == "" {
+		return errors.New("stream: Stream, Group and Name are required")
+	}
+	if c.Handler == nil {
+		return errors.New("stream: Handler is required")
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.Count <= 0 {
+		c.Count = 10
+	}
+	if c.Block <= 0 {
+		c.Block = 5 * time.Second
+	}
+	if c.MinIdle <= 0 {
+		c.MinIdle = time.Minute
+	}
+	if c.DeadLetter == "" {
+		c.DeadLetter = c.Stream + ":dead"
+	}
+	return nil
+}
+
+// Read and handle entries until ctx is done or there's an error
+// talking to the server
+//
+// The group is created, along with the stream, if it doesn't exist.
+// Entries that were delivered to this consumer before and never
+// acknowledged are handled first.
+//
+// Run uses cl exclusively. As with any blocking command, cl is closed
+// if ctx is done while waiting for new entries.
+func (c *Consumer) Run(ctx context.Context, cl *client.Client) error {
+	if err := c.defaults(); err != nil {
+		return err
+	}
+
+	if err := c.createGroup(cl); err != nil {
+		return err
+	}
+
+	if err := c.history(ctx, cl); err != nil {
+		return err
+	}
+
+	var reclaimed time.Time
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if time.Since(reclaimed) >= c.MinIdle {
+			if err := c.reclaim(ctx, cl); err != nil {
+				return err
+			}
+			reclaimed = time.Now()
+		}
+
+		streams, err := cl.XReadGroup(ctx, c.Group, c.Name, c.Block, c.Count, c.Stream, ">")
+		if err == gedis.ErrNil {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, s := range streams {
+			if err := c.handle(ctx, cl, s.Messages); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Consumer) createGroup(cl *client.Client) error {
+	_, err := cl.Send("XGROUP", "CREATE", c.Stream, c.Group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// Handle the entries delivered to this consumer but not acknowledged
+func (c *Consumer) history(ctx context.Context, cl *client.Client) error {
+	last := "0"
+
+	for {
+		res, err := cl.Send("XREADGROUP", "GROUP", c.Group, c.Name, "COUNT", c.Count, "STREAMS", c.Stream, last)
+		if err != nil {
+			return err
+		}
+
+		var msgs []client.XMessage
+		if res != nil {
+			streams, err := client.ParseXStreams(res)
+			if err != nil {
+				return err
+			}
+			for _, s := range streams {
+				msgs = append(msgs, s.Messages...)
+			}
+		}
+
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		if err := c.handle(ctx, cl, msgs); err != nil {
+			return err
+		}
+
+		last = msgs[len(msgs)-1].ID
+	}
+}
+
+// Move poison entries to the dead-letter stream and claim the entries
+// that have been pending for too long
+//
+// XAUTOCLAIM only looks at a limited number of pending entries per
+// call, so it's called again from the cursor it returns until the
+// whole pending list was scanned.
+func (c *Consumer) reclaim(ctx context.Context, cl *client.Client) error {
+	if c.MaxDeliveries > 0 {
+		if err := c.deadLetters(cl); err != nil {
+			return err
+		}
+	}
+
+	cursor := "0-0"
+
+	for {
+		res, err := cl.Send("XAUTOCLAIM", c.Stream, c.Group, c.Name, c.MinIdle.Milliseconds(), cursor, "COUNT", c.Count)
+		if err != nil {
+			return err
+		}
+
+		arr, ok := res.([]interface{})
+		if !ok || len(arr) < 2 {
+			return fmt.Errorf("stream: unexpected XAUTOCLAIM reply: %#v", res)
+		}
+
+		if err = gedis.Scan(arr[0], &cursor); err != nil {
+			return err
+		}
+
+		msgs, err := client.ParseXMessages(arr[1])
+		if err != nil {
+			return err
+		}
+
+		if err = c.handle(ctx, cl, msgs); err != nil {
+			return err
+		}
+
+		if cursor == "0-0" {
+			return nil
+		}
+	}
+}
+
+// Move the entries delivered at least MaxDeliveries times to the
+// dead-letter stream, going through the pending entries Count at a
+// time
+func (c *Consumer) deadLetters(cl *client.Client) error {
+	start := "-"
+
+	for {
+		res, err := cl.Send("XPENDING", c.Stream, c.Group, "IDLE", c.MinIdle.Milliseconds(), start, "+", c.Count)
+		if err != nil {
+			return err
+		}
+
+		var pending [][]interface{}
+		if err = gedis.Scan(res, &pending); err != nil {
+			return err
+		}
+
+		var id string
+
+		for _, p := range pending {
+			if len(p) != 4 {
+				return fmt.Errorf("stream: unexpected XPENDING reply: %#v", res)
+			}
+
+			var deliveries int64
+
+			if err = gedis.Scan(p[0], &id); err != nil {
+				return err
+			}
+			if err = gedis.Scan(p[3], &deliveries); err != nil {
+				return err
+			}
+
+			if deliveries >= c.MaxDeliveries {
+				if err = c.deadLetter(cl, id, deliveries); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(pending) < c.Count {
+			return nil
+		}
+
+		// Continue after the last entry of this page
+		start = "(" + id
+	}
+}
+
+// Copy an entry to the dead-letter stream, along with where it came
+// from, and acknowledge it
+func (c *Consumer) deadLetter(cl *client.Client, id string, deliveries int64) error {
+	res, err := cl.Send("XRANGE", c.Stream, id, id)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := client.ParseXMessages(res)
+	if err != nil {
+		return err
+	}
+
+	// The entry might have been deleted from the stream
+	if len(msgs) > 0 {
+		args := []interface{}{"XADD", c.DeadLetter, "*",
+			"stream", c.Stream, "id", id, "group", c.Group, "deliveries", deliveries}
+		for k, v := range msgs[0].Values {
+			args = append(args, k, v)
+		}
+
+		if _, err = cl.Send(args...); err != nil {
+			return err
+		}
+	}
+
+	_, err = cl.Send("XACK", c.Stream, c.Group, id)
+
+	return err
+}
+
+// Dispatch entries to the handler and acknowledge those handled
+// successfully
+func (c *Consumer) handle(ctx context.Context, cl *client.Client, msgs []client.XMessage) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	ack := []interface{}{"XACK", c.Stream, c.Group}
+	sem := make(chan struct{}, c.Concurrency)
+
+	for _, msg := range msgs {
+		// Entries deleted while pending can't be handled
+		if msg.Values == nil {
+			ack = append(ack, msg.ID)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(msg client.XMessage) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if c.Handler(ctx, msg) == nil {
+				mu.Lock()
+				ack = append(ack, msg.ID)
+				mu.Unlock()
+			}
+		}(msg)
+	}
+
+	wg.Wait()
+
+	if len(ack) == 3 {
+		return nil
+	}
+
+	_, err := cl.Send(ack...)
+
+	return err
+}
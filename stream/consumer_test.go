@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/inkel/gedis/client"
+	"github.com/inkel/gedis/internal/redistest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dial(t *testing.T, s *redistest.Server) *client.Client {
+	c, err := client.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Cannot connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &c
+}
+
+func send(t *testing.T, c *client.Client, args ...interface{}) interface{} {
+	res, err := c.Send(args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return res
+}
+
+func TestConsumer(t *testing.T) {
+	s := redistest.NewServer(t)
+	c := dial(t, s)
+
+	// The group doesn't see entries added before it was created, so
+	// create it at the beginning of the stream
+	send(t, c, "XGROUP", "CREATE", "jobs", "workers", "0", "MKSTREAM")
+
+	for i := 0; i < 20; i++ {
+		send(t, c, "XADD", "jobs", "*", "n", i)
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string]bool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consumer := &Consumer{
+		Stream:      "jobs",
+		Group:       "workers",
+		Name:        "worker-1",
+		Concurrency: 4,
+		Block:       10 * time.Millisecond,
+		Handler: func(ctx context.Context, msg client.XMessage) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[msg.Values["n"]] = true
+			if len(handled) == 20 {
+				cancel()
+			}
+			return nil
+		},
+	}
+
+	err := consumer.Run(ctx, dial(t, s))
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(handled) != 20 {
+		t.Fatalf("Expected 20 entries handled, got %d", len(handled))
+	}
+
+	if res := send(t, c, "XPENDING", "jobs", "workers"); res.([]interface{})[0] != int64(0) {
+		t.Fatalf("Expected every entry acknowledged: %#v", res)
+	}
+}
+
+func TestConsumer_reclaimAndDeadLetter(t *testing.T) {
+	s := redistest.NewServer(t)
+	s.SetTime(time.Unix(1700000000, 0))
+	c := dial(t, s)
+
+	send(t, c, "XGROUP", "CREATE", "jobs", "workers", "$", "MKSTREAM")
+
+	// More entries of each kind than the consumer reads at once, so
+	// reclaiming them takes more than one XPENDING and XAUTOCLAIM
+	var poison []string
+	for i := 0; i < 3; i++ {
+		send(t, c, "XADD", "jobs", "*", "kind", "ok")
+		poison = append(poison, send(t, c, "XADD", "jobs", "*", "kind", "poison").(string))
+	}
+
+	// Every entry was delivered to a consumer that died, and the
+	// poison ones were delivered twice more
+	send(t, c, "XREADGROUP", "GROUP", "workers", "dead", "STREAMS", "jobs", ">")
+	for i := 0; i < 2; i++ {
+		for _, id := range poison {
+			send(t, c, "XCLAIM", "jobs", "workers", "dead", 0, id)
+		}
+	}
+
+	s.Advance(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var handled []string
+
+	consumer := &Consumer{
+		Stream:        "jobs",
+		Group:         "workers",
+		Name:          "worker-1",
+		Count:         2,
+		Block:         10 * time.Millisecond,
+		MinIdle:       time.Minute,
+		MaxDeliveries: 3,
+		Handler: func(ctx context.Context, msg client.XMessage) error {
+			handled = append(handled, msg.Values["kind"])
+			if len(handled) == 3 {
+				cancel()
+			}
+			if msg.Values["kind"] == "poison" {
+				return errors.New("poison")
+			}
+			return nil
+		},
+	}
+
+	err := consumer.Run(ctx, dial(t, s))
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if fmt.Sprint(handled) != "[ok ok ok]" {
+		t.Fatalf("Expected only the ok entries to be handled, got %q", handled)
+	}
+
+	if res := send(t, c, "XPENDING", "jobs", "workers"); res.([]interface{})[0] != int64(0) {
+		t.Fatalf("Expected every entry acknowledged: %#v", res)
+	}
+
+	dead, err := client.ParseXMessages(send(t, c, "XRANGE", "jobs:dead", "-", "+"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 3 {
+		t.Fatalf("Expected 3 dead letters, got %d", len(dead))
+	}
+
+	for i, msg := range dead {
+		fields := fmt.Sprint(msg.Values)
+		if msg.Values["id"] != poison[i] || msg.Values["kind"] != "poison" || msg.Values["deliveries"] != "3" {
+			t.Fatalf("Unexpected dead letter: %s", fields)
+		}
+	}
+}
@@ -11,11 +11,20 @@ type Writer interface {
 	Write(p []byte) (n int, err error)
 }
 
+// Writes a sequence of values to w using the Redis Multi-Bulk format
+//
+// See WriteMultiBulk for how each value is encoded. Unlike
+// WriteMultiBulk, unsupported types return an error instead of
+// panicking.
 func Write(w Writer, args ...interface{}) (n int, err error) {
 	if len(args) == 0 {
 		return -1, fmt.Errorf("Must write at least one argument")
 	}
-	return w.Write(WriteMultiBulk(args...))
+	bs, err := encodeMultiBulk(args)
+	if err != nil {
+		return -1, err
+	}
+	return w.Write(bs)
 }
 
 // Writes a string as a sequence of bytes to be send to a Redis
@@ -78,9 +87,22 @@ func WriteStatus(status string) []byte {
 
 // BUG(inkel): writeMultiBulk can't write multi-bulks inside multi-bulks
 
-// Writes a sequence of strings as a sequence of bytes to be send to a
+// Writes a sequence of values as a sequence of bytes to be send to a
 // Redis instance, using the Redis Multi-Bulk format.
+//
+// Integers are written as Redis integers, errors as Redis errors and
+// nil as a nil bulk. Any other value supported by AppendArg is written
+// as a bulk. Unsupported types panic; use EncodeCommand to send
+// commands to a Redis server, as it only accepts bulks.
 func WriteMultiBulk(args ...interface{}) []byte {
+	bs, err := encodeMultiBulk(args)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func encodeMultiBulk(args []interface{}) ([]byte, error) {
 	var buffer bytes.Buffer
 
 	buffer.WriteByte('*')
@@ -88,6 +110,7 @@ func WriteMultiBulk(args ...interface{}) []byte {
 	buffer.WriteString("\r\n")
 
 	var bs []byte
+	var err error
 
 	for _, arg := range args {
 		bs = []byte{}
@@ -104,11 +127,13 @@ func WriteMultiBulk(args ...interface{}) []byte {
 		case nil:
 			bs = []byte("$-1\r\n")
 		default:
-			panic(fmt.Errorf("Unrecognized type: %#v", arg))
+			if bs, err = AppendArg(bs, arg); err != nil {
+				return nil, err
+			}
 		}
 
 		buffer.Write(bs)
 	}
 
-	return buffer.Bytes()
+	return buffer.Bytes(), nil
 }
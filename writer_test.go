@@ -121,3 +121,17 @@ func TestWrite_error(t *testing.T) {
 	a.NotNil(err)
 	a.StringEq("", writer.String())
 }
+
+func TestWrite_unsupported(t *testing.T) {
+	var writer bytes.Buffer
+
+	a := Asserter{t, 1}
+
+	_, err := Write(&writer, "SET", "lorem", struct{}{})
+	a.NotNil(err)
+	a.StringEq("", writer.String())
+
+	_, err = Write(&writer, "SET", "lorem", 3.5)
+	a.Nil(err)
+	a.StringEq("*3\r\n$3\r\nSET\r\n$5\r\nlorem\r\n$3\r\n3.5\r\n", writer.String())
+}